@@ -0,0 +1,106 @@
+package cf
+
+import "math"
+
+// ChangeEvent 检测到的基线变化
+type ChangeEvent struct {
+	Index  int64   // 触发时是第几个样本，从1开始
+	Before float64 // 变化前的基线
+	After  float64 // 变化后的基线估计，为偏移开始之后样本的中位数
+	Score  float64 // 触发时的CUSUM统计量
+}
+
+func (e ChangeEvent) Direction() string {
+	if e.After < e.Before {
+		return "down"
+	}
+	return "up"
+}
+
+// ChangeDetector 在线检测时延基线的变化(例如路由切换)。
+// 先用Warmup个样本估计基线，之后用EWMA跟踪基线和波动，双边CUSUM累计标准化后的偏差，
+// 超过Threshold认为基线变化，然后以新的样本重新估计基线。
+// 单个样本的偏差截断到ClipSigma倍标准差，偶发的毛刺不会触发，持续的偏移才会
+type ChangeDetector struct {
+	Threshold float64 // CUSUM阈值，单位是标准差，越小越灵敏
+	Drift     float64 // 每个样本允许的偏差(k)，单位是标准差
+	Warmup    int     // 估计基线需要的样本数
+	Alpha     float64 // EWMA的平滑系数
+	ClipSigma float64 // 单个样本偏差的上限
+	MinSigma  float64 // 标准差的下限，为基线的比例，避免很稳定的链路上微小的变化也触发
+
+	count    int64
+	warm     Welford
+	warmed   bool
+	mean     float64
+	variance float64
+	pos, neg cusum
+}
+
+// cusum 单边的累计量，同时记录从开始累计以来的样本，用于估计新的基线
+type cusum struct {
+	s      float64
+	values []float64
+}
+
+// maxCusumValues 估计新基线最多使用的样本数
+const maxCusumValues = 256
+
+func (c *cusum) add(z, x float64) {
+	c.s = math.Max(0, c.s+z)
+	if c.s == 0 {
+		c.values = c.values[:0]
+		return
+	}
+	if len(c.values) >= maxCusumValues {
+		c.values = c.values[1:]
+	}
+	c.values = append(c.values, x)
+}
+
+// NewChangeDetector threshold为CUSUM阈值(标准差的倍数)，常用4~10
+func NewChangeDetector(threshold float64) *ChangeDetector {
+	return &ChangeDetector{
+		Threshold: threshold,
+		Drift:     0.5,
+		Warmup:    30,
+		Alpha:     0.01,
+		ClipSigma: 4,
+		MinSigma:  0.02,
+	}
+}
+
+// Add 加入一个样本，检测到基线变化时返回事件
+func (c *ChangeDetector) Add(x float64) (ChangeEvent, bool) {
+	c.count++
+	if !c.warmed {
+		c.warm.Add(x)
+		if c.warm.Count >= int64(c.Warmup) {
+			c.mean, c.variance, c.warmed = c.warm.Mean(), c.warm.Variance(), true
+		}
+		return ChangeEvent{}, false
+	}
+	sigma := Max(math.Sqrt(c.variance), c.MinSigma*math.Abs(c.mean), 1e-9)
+	z := Max(-c.ClipSigma, Min((x-c.mean)/sigma, c.ClipSigma))
+	c.pos.add(z-c.Drift, x)
+	c.neg.add(-z-c.Drift, x)
+	for _, side := range []*cusum{&c.pos, &c.neg} {
+		if side.s > c.Threshold {
+			e := ChangeEvent{Index: c.count, Before: c.mean, After: Percentile(side.values, 50), Score: side.s}
+			c.Reset()
+			return e, true
+		}
+	}
+	//截断后再更新基线，毛刺不会拉高基线
+	d := z * sigma
+	c.mean += c.Alpha * d
+	c.variance += c.Alpha * (d*d - c.variance)
+	return ChangeEvent{}, false
+}
+
+// Reset 丢弃当前基线，重新预热
+func (c *ChangeDetector) Reset() {
+	c.warm = Welford{}
+	c.warmed = false
+	c.pos, c.neg = cusum{}, cusum{}
+}
@@ -0,0 +1,56 @@
+package cf
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChangeDetector(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	d := NewChangeDetector(8)
+	var events []ChangeEvent
+	for i := 1; i <= 600; i++ {
+		x := 10 + r.NormFloat64()*0.3
+		if i > 300 {
+			x += 5 //路由切换，基线从10ms变为15ms
+		}
+		if i%50 == 0 {
+			x = 200 //偶发的毛刺不触发
+		}
+		if e, ok := d.Add(x); ok {
+			events = append(events, e)
+		}
+	}
+	assert.Equal(t, 1, len(events))
+	assert.Equal(t, "up", events[0].Direction())
+	assert.GreaterOrEqual(t, events[0].Index, int64(301))
+	assert.LessOrEqual(t, events[0].Index, int64(305))
+	assert.InDelta(t, 10, events[0].Before, 0.2)
+	assert.InDelta(t, 15, events[0].After, 0.5)
+}
+
+func TestChangeDetectorSensitivity(t *testing.T) {
+	r := rand.New(rand.NewSource(2))
+	series := make([]float64, 0, 400)
+	for i := 0; i < 400; i++ {
+		x := 10 + r.NormFloat64()
+		if i >= 200 {
+			x -= 1.5 //下降1.5个标准差
+		}
+		series = append(series, x)
+	}
+	count := func(threshold float64) int {
+		d, n := NewChangeDetector(threshold), 0
+		for _, x := range series {
+			if e, ok := d.Add(x); ok {
+				assert.Equal(t, "down", e.Direction())
+				n++
+			}
+		}
+		return n
+	}
+	assert.Equal(t, 1, count(8))
+	assert.Equal(t, 0, count(1000))
+}
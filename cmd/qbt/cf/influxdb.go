@@ -9,17 +9,39 @@ import (
 )
 
 type InfluxdbPoint struct {
-	Measurement string
-	Tags        map[string]string
-	Fields      map[string]float64
-	Time        time.Time
+	Measurement string             `json:"measurement"`
+	Tags        map[string]string  `json:"tags"`
+	Fields      map[string]float64 `json:"fields"`
+	Time        time.Time          `json:"time"`
 }
 
 var (
 	InfluxdbWriteUrl = "http://10.11.1.33:8086/write?db=statsd"
+	//PointsHook 不为nil时WritePoints交给它处理，例如推送给 qbt serve --collector
+	PointsHook func(points []InfluxdbPoint) error
+	//InfluxSpool 不为nil时写入失败的数据存到磁盘，恢复后重放
+	InfluxSpool *Spool
 )
 
+// WritePoints 写入数据点，默认直接写influxdb
 func WritePoints(points []InfluxdbPoint) error {
+	if PointsHook != nil {
+		return PointsHook(points)
+	}
+	return WriteInflux(points)
+}
+
+// WriteInflux 以line protocol写入InfluxdbWriteUrl，配置了InfluxSpool时失败的数据写入spool
+func WriteInflux(points []InfluxdbPoint) error {
+	content := InfluxLines(points)
+	if InfluxSpool != nil {
+		return InfluxSpool.Write(content)
+	}
+	return PostInflux(content)
+}
+
+// InfluxLines 把数据点转成line protocol
+func InfluxLines(points []InfluxdbPoint) []byte {
 	lines := make([]string, 0, len(points))
 	for _, p := range points {
 		tagStrList := make([]string, 0, len(p.Tags))
@@ -35,9 +57,12 @@ func WritePoints(points []InfluxdbPoint) error {
 		line := fmt.Sprintf("%s,%s %s %d", p.Measurement, tagStr, fieldStr, p.Time.UnixNano())
 		lines = append(lines, line)
 	}
-	content := strings.Join(lines, "\n")
+	return []byte(strings.Join(lines, "\n"))
+}
 
-	req, err := http.NewRequest("POST", InfluxdbWriteUrl, bytes.NewBufferString(content))
+// PostInflux 把line protocol数据POST到InfluxdbWriteUrl
+func PostInflux(content []byte) error {
+	req, err := http.NewRequest("POST", InfluxdbWriteUrl, bytes.NewReader(content))
 	if err != nil {
 		fmt.Println("Error creating request:", err)
 		return err
@@ -54,5 +79,8 @@ func WritePoints(points []InfluxdbPoint) error {
 	defer resp.Body.Close()
 
 	fmt.Println("Response Status:", resp.Status)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("influxdb response %s", resp.Status)
+	}
 	return nil
 }
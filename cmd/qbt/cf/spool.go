@@ -0,0 +1,134 @@
+package cf
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const spoolExt = ".batch"
+
+type spoolFile struct {
+	seq  uint64
+	size int64
+}
+
+// Spool 后端不可用时把发送失败的批次按顺序写到磁盘，后端恢复后按原顺序重放。
+// 磁盘占用超过maxBytes时丢弃最旧的批次，一个目录只能被一个进程使用
+type Spool struct {
+	dir      string
+	maxBytes int64
+	send     func(data []byte) error
+
+	mu      sync.Mutex
+	files   []spoolFile // 积压的批次，最旧的在前
+	size    int64
+	seq     uint64
+	evicted int // 因超过磁盘上限丢弃的批次数
+}
+
+// NewSpool 打开目录并加载上次退出时未发送的批次
+func NewSpool(dir string, maxBytes int64, send func(data []byte) error) (*Spool, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	s := &Spool{dir: dir, maxBytes: maxBytes, send: send}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, spoolExt) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, spoolExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		s.files = append(s.files, spoolFile{seq: seq, size: info.Size()})
+		s.size += info.Size()
+		s.seq = Max(s.seq, seq)
+	}
+	sort.Slice(s.files, func(i, j int) bool { return s.files[i].seq < s.files[j].seq })
+	return s, nil
+}
+
+func (s *Spool) path(seq uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d%s", seq, spoolExt))
+}
+
+// Write 先重放积压的批次，全部成功后再发送data，发送失败时把data存到磁盘。
+// 只有写磁盘失败才返回错误，data为空时只重放
+func (s *Spool) Write(data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.replay() == nil && len(data) > 0 {
+		if s.send(data) == nil {
+			return nil
+		}
+	}
+	if len(data) == 0 {
+		return nil
+	}
+	return s.store(data)
+}
+
+// Pending 返回积压的批次数和字节数
+func (s *Spool) Pending() (files int, bytes int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.files), s.size
+}
+
+// replay 按顺序发送积压的批次，遇到失败就停下保持顺序
+func (s *Spool) replay() error {
+	for len(s.files) > 0 {
+		f := s.files[0]
+		data, err := os.ReadFile(s.path(f.seq))
+		if err == nil {
+			if err = s.send(data); err != nil {
+				return err
+			}
+		} else {
+			fmt.Println("spool read error, skip batch:", err)
+		}
+		_ = os.Remove(s.path(f.seq))
+		s.files = s.files[1:]
+		s.size -= f.size
+		if len(s.files) == 0 {
+			fmt.Println("spool", s.dir, "replayed")
+		}
+	}
+	return nil
+}
+
+func (s *Spool) store(data []byte) error {
+	s.seq++
+	if err := os.WriteFile(s.path(s.seq), data, 0644); err != nil {
+		return err
+	}
+	s.files = append(s.files, spoolFile{seq: s.seq, size: int64(len(data))})
+	s.size += int64(len(data))
+	if len(s.files) == 1 {
+		fmt.Println("backend unreachable, spooling to", s.dir)
+	}
+	//超过磁盘上限时丢弃最旧的批次，至少保留刚写入的一批
+	for s.maxBytes > 0 && s.size > s.maxBytes && len(s.files) > 1 {
+		f := s.files[0]
+		_ = os.Remove(s.path(f.seq))
+		s.files = s.files[1:]
+		s.size -= f.size
+		s.evicted++
+		fmt.Println("spool", s.dir, "over", s.maxBytes, "bytes, evicted", s.evicted, "batches so far")
+	}
+	return nil
+}
@@ -0,0 +1,39 @@
+package cf
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSpool(t *testing.T) {
+	dir := t.TempDir()
+	var sent []string
+	down := true
+	send := func(data []byte) error {
+		if down {
+			return errors.New("backend down")
+		}
+		sent = append(sent, string(data))
+		return nil
+	}
+	s, err := NewSpool(dir, 10, send)
+	assert.Nil(t, err)
+	for _, data := range []string{"aaaa", "bbbb", "cccc"} {
+		assert.Nil(t, s.Write([]byte(data)))
+	}
+	//超过10字节丢弃最旧的一批
+	files, size := s.Pending()
+	assert.Equal(t, 2, files)
+	assert.Equal(t, int64(8), size)
+
+	//重新打开后恢复积压，后端恢复时按顺序重放
+	s, err = NewSpool(dir, 10, send)
+	assert.Nil(t, err)
+	down = false
+	assert.Nil(t, s.Write([]byte("dddd")))
+	assert.Equal(t, []string{"bbbb", "cccc", "dddd"}, sent)
+	files, _ = s.Pending()
+	assert.Equal(t, 0, files)
+}
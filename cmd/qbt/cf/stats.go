@@ -0,0 +1,188 @@
+package cf
+
+import (
+	"math"
+	"sort"
+)
+
+// Welford 流式计算均值和方差，内存占用固定
+type Welford struct {
+	Count int64
+	mean  float64
+	m2    float64
+}
+
+func (w *Welford) Add(x float64) {
+	w.Count++
+	delta := x - w.mean
+	w.mean += delta / float64(w.Count)
+	w.m2 += delta * (x - w.mean)
+}
+
+// Merge 合并另一组统计(Chan等人的并行算法)
+func (w *Welford) Merge(o Welford) {
+	if o.Count == 0 {
+		return
+	}
+	if w.Count == 0 {
+		*w = o
+		return
+	}
+	count := w.Count + o.Count
+	delta := o.mean - w.mean
+	w.mean += delta * float64(o.Count) / float64(count)
+	w.m2 += o.m2 + delta*delta*float64(w.Count)*float64(o.Count)/float64(count)
+	w.Count = count
+}
+
+func (w *Welford) Mean() float64 {
+	return w.mean
+}
+
+// Variance 总体方差
+func (w *Welford) Variance() float64 {
+	if w.Count == 0 {
+		return 0
+	}
+	return w.m2 / float64(w.Count)
+}
+
+func (w *Welford) StdDev() float64 {
+	return math.Sqrt(w.Variance())
+}
+
+// QuantileSketch 对数分桶的分位数草图(类似DDSketch)，分位数的相对误差不超过accuracy，
+// 桶的数量只和数值范围有关，可以合并
+type QuantileSketch struct {
+	accuracy float64
+	gamma    float64
+	logGamma float64
+	buckets  map[int]uint64
+	zeros    uint64 // 小于等于0的值
+	count    uint64
+}
+
+// NewQuantileSketch accuracy为相对误差，例如0.01
+func NewQuantileSketch(accuracy float64) *QuantileSketch {
+	gamma := (1 + accuracy) / (1 - accuracy)
+	return &QuantileSketch{
+		accuracy: accuracy,
+		gamma:    gamma,
+		logGamma: math.Log(gamma),
+		buckets:  make(map[int]uint64),
+	}
+}
+
+func (s *QuantileSketch) Add(x float64) {
+	s.count++
+	if x <= 0 {
+		s.zeros++
+		return
+	}
+	s.buckets[int(math.Ceil(math.Log(x)/s.logGamma))]++
+}
+
+// Merge 合并相同精度的草图
+func (s *QuantileSketch) Merge(o *QuantileSketch) {
+	for k, v := range o.buckets {
+		s.buckets[k] += v
+	}
+	s.zeros += o.zeros
+	s.count += o.count
+}
+
+func (s *QuantileSketch) Count() uint64 {
+	return s.count
+}
+
+// Buckets 当前使用的桶数量
+func (s *QuantileSketch) Buckets() int {
+	return len(s.buckets)
+}
+
+// Quantile 返回第p百分位(0~100)的估计值
+func (s *QuantileSketch) Quantile(p float64) float64 {
+	if s.count == 0 {
+		return 0
+	}
+	rank := uint64(math.Ceil(p / 100 * float64(s.count)))
+	rank = Max(rank, 1)
+	if rank <= s.zeros {
+		return 0
+	}
+	keys := make([]int, 0, len(s.buckets))
+	for k := range s.buckets {
+		keys = append(keys, k)
+	}
+	sort.Ints(keys)
+	seen := s.zeros
+	for _, k := range keys {
+		seen += s.buckets[k]
+		if seen >= rank {
+			//桶(gamma^(k-1), gamma^k]的中点，相对误差不超过accuracy
+			return 2 * math.Pow(s.gamma, float64(k)) / (s.gamma + 1)
+		}
+	}
+	return 2 * math.Pow(s.gamma, float64(keys[len(keys)-1])) / (s.gamma + 1)
+}
+
+// Jitter 时延变化的统计：RFC 3550的到达间隔抖动、相邻差值绝对值的均值(MASD)和分布(IPDV)。
+// 只记录成功的样本，丢包时相邻关系跳过丢失的样本，和RFC 3550一致
+type Jitter struct {
+	prev    float64
+	hasPrev bool
+	j       float64
+	masd    Welford
+	ipdv    *QuantileSketch
+}
+
+func NewJitter() *Jitter {
+	return &Jitter{ipdv: NewQuantileSketch(0.01)}
+}
+
+func (j *Jitter) Add(x float64) {
+	if j.hasPrev {
+		d := math.Abs(x - j.prev)
+		j.j += (d - j.j) / 16
+		j.masd.Add(d)
+		j.ipdv.Add(d)
+	}
+	j.prev, j.hasPrev = x, true
+}
+
+// Next 接着j的最后一个样本统计下一段，段之间的差值计入下一段，RFC 3550的估计值也接着算
+func (j *Jitter) Next() *Jitter {
+	n := NewJitter()
+	n.prev, n.hasPrev, n.j = j.prev, j.hasPrev, j.j
+	return n
+}
+
+// Merge 合并用j.Next()统计的下一段样本，合并后和逐个Add的结果一致
+func (j *Jitter) Merge(o *Jitter) {
+	if !o.hasPrev {
+		return
+	}
+	j.prev, j.hasPrev, j.j = o.prev, true, o.j
+	j.masd.Merge(o.masd)
+	j.ipdv.Merge(o.ipdv)
+}
+
+// Count 相邻差值的个数
+func (j *Jitter) Count() int64 {
+	return j.masd.Count
+}
+
+// Jitter RFC 3550的平滑抖动估计 J += (|D| - J)/16
+func (j *Jitter) Jitter() float64 {
+	return j.j
+}
+
+// MASD 相邻样本差值绝对值的均值
+func (j *Jitter) MASD() float64 {
+	return j.masd.Mean()
+}
+
+// IPDV 相邻样本差值绝对值的第p百分位
+func (j *Jitter) IPDV(p float64) float64 {
+	return j.ipdv.Quantile(p)
+}
@@ -0,0 +1,95 @@
+package cf
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWelford(t *testing.T) {
+	list := []float64{2, 4, 4, 4, 5, 5, 7, 9}
+	var all, a, b Welford
+	for i, x := range list {
+		all.Add(x)
+		if i < 3 {
+			a.Add(x)
+		} else {
+			b.Add(x)
+		}
+	}
+	assert.InDelta(t, 5.0, all.Mean(), 1e-9)
+	assert.InDelta(t, 2.0, all.StdDev(), 1e-9)
+	a.Merge(b)
+	assert.Equal(t, all.Count, a.Count)
+	assert.InDelta(t, all.Mean(), a.Mean(), 1e-9)
+	assert.InDelta(t, all.Variance(), a.Variance(), 1e-9)
+}
+
+func TestQuantileSketch(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	list := make([]float64, 0, 10000)
+	s1, s2 := NewQuantileSketch(0.01), NewQuantileSketch(0.01)
+	for i := 0; i < 10000; i++ {
+		x := math.Exp(r.NormFloat64()) //对数正态分布，接近真实的rtt
+		list = append(list, x)
+		if i%2 == 0 {
+			s1.Add(x)
+		} else {
+			s2.Add(x)
+		}
+	}
+	s1.Merge(s2)
+	assert.Equal(t, uint64(10000), s1.Count())
+	for _, p := range []float64{1, 50, 90, 99, 99.9, 100} {
+		exact := Percentile(list, p)
+		assert.InEpsilon(t, exact, s1.Quantile(p), 0.01, "p%v", p)
+	}
+	assert.Equal(t, 0.0, NewQuantileSketch(0.01).Quantile(50))
+}
+
+func BenchmarkQuantileSketch(b *testing.B) {
+	s := NewQuantileSketch(0.01)
+	r := rand.New(rand.NewSource(1))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		s.Add(math.Exp(r.NormFloat64()))
+	}
+	b.ReportMetric(float64(s.Buckets()), "buckets")
+}
+
+func TestJitter(t *testing.T) {
+	all, a := NewJitter(), NewJitter()
+	var b *Jitter
+	for i, x := range []float64{10, 12, 11, 15, 11, 11, 13} {
+		all.Add(x)
+		if i < 4 {
+			a.Add(x)
+			continue
+		}
+		if b == nil {
+			b = a.Next()
+		}
+		b.Add(x)
+	}
+	//差值 2,1,4,4,0,2
+	assert.InDelta(t, 13.0/6, all.MASD(), 1e-9)
+	j := 0.0
+	for _, d := range []float64{2, 1, 4, 4, 0, 2} {
+		j += (d - j) / 16
+	}
+	assert.InDelta(t, j, all.Jitter(), 1e-9)
+	assert.InEpsilon(t, 4.0, all.IPDV(99), 0.01)
+
+	//分段统计时段之间的差值(15->11)计入下一段，合并后和逐个Add一致
+	assert.InDelta(t, 6.0/3, b.MASD(), 1e-9)
+	a.Merge(b)
+	assert.InDelta(t, all.MASD(), a.MASD(), 1e-9)
+	assert.InDelta(t, all.Jitter(), a.Jitter(), 1e-9)
+	assert.Equal(t, all.IPDV(99), a.IPDV(99))
+
+	//空的一段不影响
+	a.Merge(a.Next())
+	assert.InDelta(t, all.Jitter(), a.Jitter(), 1e-9)
+}
@@ -1,5 +1,10 @@
 package cf
 
+import (
+	"math"
+	"sort"
+)
+
 type baseType interface {
 	~int | ~uint | ~int8 | ~uint8 | ~int16 | ~uint16 | ~int32 | ~uint32 | ~int64 | ~uint64 | ~float32 | ~float64
 }
@@ -53,3 +58,21 @@ func Mean[T baseType](list []T) T {
 	res := sum / T(len(list))
 	return res
 }
+
+// Percentile 计算list的第p百分位数(0~100)，使用最近秩法，不修改list
+func Percentile[T baseType](list []T, p float64) T {
+	if len(list) == 0 {
+		return 0
+	}
+	sorted := make([]T, len(list))
+	copy(sorted, list)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	if rank > len(sorted) {
+		rank = len(sorted)
+	}
+	return sorted[rank-1]
+}
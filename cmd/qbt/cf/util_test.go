@@ -0,0 +1,33 @@
+package cf
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPercentile(t *testing.T) {
+	tests := []struct {
+		name string
+		list []float64
+		p    float64
+		want float64
+	}{
+		{"empty", nil, 50, 0},
+		{"single", []float64{7}, 99, 7},
+		{"p0 is min", []float64{3, 1, 2}, 0, 1},
+		{"p50 odd", []float64{5, 1, 3}, 50, 3},
+		{"p50 even", []float64{4, 1, 3, 2}, 50, 2},
+		{"p90 nearest rank", []float64{10, 9, 8, 7, 6, 5, 4, 3, 2, 1}, 90, 9},
+		{"p99 of ten", []float64{10, 9, 8, 7, 6, 5, 4, 3, 2, 1}, 99, 10},
+		{"p100 is max", []float64{3, 1, 2}, 100, 3},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, Percentile(tt.list, tt.p), tt.name)
+	}
+
+	//不修改输入的顺序
+	list := []int{3, 1, 2}
+	assert.Equal(t, 2, Percentile(list, 50))
+	assert.Equal(t, []int{3, 1, 2}, list)
+}
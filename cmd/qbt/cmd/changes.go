@@ -0,0 +1,214 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DataDog/datadog-go/v5/statsd"
+	"github.com/qbtrade/qbt/cmd/qbt/cf"
+	"github.com/spf13/cobra"
+)
+
+// changeEvent 某个target的rtt基线变化
+type changeEvent struct {
+	cf.ChangeEvent
+	Ts     time.Time
+	Host   string
+	Target string
+	Kind   string
+}
+
+// Shift 变化的百分比
+func (e changeEvent) Shift() float64 {
+	if e.Before == 0 {
+		return 0
+	}
+	return (e.After - e.Before) / e.Before * 100
+}
+
+func (e changeEvent) String() string {
+	return fmt.Sprintf("[change] %s %s %s baseline %s %.3fms -> %.3fms (%+.1f%%), score %.1f",
+		e.Ts.Format("2006-01-02 15:04:05.000"), e.Kind, e.Target, e.Direction(), e.Before, e.After, e.Shift(), e.Score)
+}
+
+// point 写入influxdb的事件，grafana中可以作为annotation
+func (e changeEvent) point() cf.InfluxdbPoint {
+	//grpc-ping的target是 ip:port/service，和grpc_ping一样分成port和service两个tag
+	address, service, _ := strings.Cut(e.Target, "/")
+	ip, port, _ := net.SplitHostPort(address)
+	point := cf.InfluxdbPoint{
+		Measurement: e.Kind + "_change",
+		Tags: map[string]string{
+			"host":      e.Host,
+			"ip":        ip,
+			"port":      port,
+			"direction": e.Direction(),
+		},
+		Fields: map[string]float64{
+			"before": e.Before,
+			"after":  e.After,
+			"shift":  e.Shift(),
+			"score":  e.Score,
+		},
+		Time: e.Ts,
+	}
+	if service != "" {
+		point.Tags["service"] = service
+	}
+	return point
+}
+
+// statsdEvent 发送到statsd(datadog)的事件
+func (e changeEvent) statsdEvent() *statsd.Event {
+	alertType := statsd.Warning
+	if e.Direction() == "down" {
+		alertType = statsd.Info
+	}
+	return &statsd.Event{
+		Title:     fmt.Sprintf("qbt %s latency baseline changed: %s", e.Target, e.Direction()),
+		Text:      e.String(),
+		Timestamp: e.Ts,
+		Hostname:  e.Host,
+		AlertType: alertType,
+		Tags:      []string{"host:" + e.Host, "address:" + e.Target, "direction:" + e.Direction()},
+	}
+}
+
+// changeTracker 每个target一个检测器，丢包的探测不参与检测
+type changeTracker struct {
+	threshold float64
+	warmup    int
+
+	mu        sync.Mutex
+	detectors map[string]*cf.ChangeDetector
+}
+
+// probeChanges tcp-ping的基线变化检测，为nil表示没有开启 --detect-changes
+var probeChanges *changeTracker
+
+func newChangeTracker(threshold float64, warmup int) *changeTracker {
+	return &changeTracker{threshold: threshold, warmup: warmup, detectors: map[string]*cf.ChangeDetector{}}
+}
+
+func (t *changeTracker) add(p storedProbe) (changeEvent, bool) {
+	if p.Loss {
+		return changeEvent{}, false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	detector, ok := t.detectors[p.Target]
+	if !ok {
+		detector = cf.NewChangeDetector(t.threshold)
+		detector.Warmup = t.warmup
+		t.detectors[p.Target] = detector
+	}
+	e, ok := detector.Add(p.Rtt)
+	if !ok {
+		return changeEvent{}, false
+	}
+	return changeEvent{ChangeEvent: e, Ts: p.Ts, Host: p.Host, Target: p.Target, Kind: p.Kind}, true
+}
+
+// addChangeFlags 基线变化检测的灵敏度参数
+func addChangeFlags(cmd *cobra.Command) {
+	cmd.Flags().Float64("change-threshold", 8, "CUSUM threshold of change detection in standard deviations, lower is more sensitive")
+	cmd.Flags().Int("change-warmup", 30, "probes used to learn the baseline at start and after every change")
+}
+
+func changeTrackerFromFlags(cmd *cobra.Command) *changeTracker {
+	threshold, _ := cmd.Flags().GetFloat64("change-threshold")
+	warmup, _ := cmd.Flags().GetInt("change-warmup")
+	return newChangeTracker(threshold, warmup)
+}
+
+// setupChanges 开启 --detect-changes 时设置probeChanges
+func setupChanges(cmd *cobra.Command) *changeTracker {
+	if detect, _ := cmd.Flags().GetBool("detect-changes"); !detect {
+		return nil
+	}
+	probeChanges = changeTrackerFromFlags(cmd)
+	return probeChanges
+}
+
+// changesCmd 用录制的数据回放基线变化检测，用于调整灵敏度
+var changesCmd = &cobra.Command{
+	Use:   "changes [csv files...]",
+	Short: "replay change detection on recorded probes",
+	Long: `replay latency baseline change detection on tcp-ping csv recordings (.csv or .csv.gz)
+or the --store database and print the detected changes, to tune --change-threshold before
+enabling --detect-changes on tcp-ping or monitor-tcp. Files are replayed in the given order,
+summary csv files are skipped.
+For example:
+qbt changes host_tcp_ping_2026101908.csv host_tcp_ping_2026101909.csv.gz
+qbt changes --change-threshold 5 --store qbt.db --from -168h --target "10.110.1.*:22"`,
+	Args: func(cmd *cobra.Command, args []string) error {
+		storePath, _ := cmd.Flags().GetString("store")
+		if storePath == "" && len(args) == 0 {
+			return fmt.Errorf("no csv files or --store to replay")
+		}
+		return nil
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		storePath, _ := cmd.Flags().GetString("store")
+		fromStr, _ := cmd.Flags().GetString("from")
+		toStr, _ := cmd.Flags().GetString("to")
+		targets, _ := cmd.Flags().GetStringSlice("target")
+		tracker := changeTrackerFromFlags(cmd)
+		match := targetMatcher(targets)
+		probes, events := 0, 0
+		replay := func(p storedProbe) error {
+			if !match(p.Target) {
+				return nil
+			}
+			probes++
+			if e, ok := tracker.add(p); ok {
+				events++
+				fmt.Println(e.String())
+			}
+			return nil
+		}
+
+		var err error
+		if storePath != "" {
+			now := time.Now()
+			from, errFrom := parseQueryTime(fromStr, now)
+			to, errTo := parseQueryTime(toStr, now)
+			if errFrom != nil || errTo != nil {
+				fmt.Println("parse time error:", errFrom, errTo)
+				return
+			}
+			err = storeScan(storePath, storeProbesBucket, match, from, to,
+				func(target string, value []byte) error {
+					var p storedProbe
+					if err := json.Unmarshal(value, &p); err != nil {
+						return err
+					}
+					return replay(p)
+				})
+		}
+		for _, filename := range args {
+			if err != nil {
+				break
+			}
+			err = readTcpPingCsv(filename, replay)
+		}
+		if err != nil {
+			fmt.Println("replay error:", err)
+			return
+		}
+		fmt.Printf("replayed %d probes of %d targets, %d changes\n", probes, len(tracker.detectors), events)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(changesCmd)
+	addChangeFlags(changesCmd)
+	changesCmd.Flags().String("store", "", "replay from this database written by tcp-ping --store")
+	changesCmd.Flags().String("from", "-24h", "start time when replaying from --store")
+	changesCmd.Flags().String("to", "now", "end time when replaying from --store")
+	changesCmd.Flags().StringSlice("target", nil, "only these targets (wildcards allowed)")
+}
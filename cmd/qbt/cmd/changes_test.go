@@ -0,0 +1,55 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChangeTrackerReplay(t *testing.T) {
+	var b strings.Builder
+	b.WriteString(strings.Join(tcpPingCsvHeader, ",") + "\n")
+	for i := 0; i < 200; i++ {
+		ms := int64(1792368000000 + i*1000)
+		rtt := 1.0 + float64(i%5)*0.01
+		if i >= 100 {
+			rtt += 0.5
+		}
+		//第二个地址没有变化，丢包不参与检测
+		fmt.Fprintf(&b, "%d,host,10.0.0.1,22,%.4f,false\n", ms, rtt)
+		fmt.Fprintf(&b, "%d,host,10.0.0.2,22,%.4f,%v\n", ms, 2.0+float64(i%5)*0.01, i%20 == 0)
+	}
+	filename := filepath.Join(t.TempDir(), "host_tcp_ping_2026101908.csv")
+	assert.Nil(t, os.WriteFile(filename, []byte(b.String()), 0644))
+
+	tracker := newChangeTracker(8, 30)
+	var events []changeEvent
+	err := readTcpPingCsv(filename, func(p storedProbe) error {
+		if e, ok := tracker.add(p); ok {
+			events = append(events, e)
+		}
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(events))
+	e := events[0]
+	assert.Equal(t, "10.0.0.1:22", e.Target)
+	assert.Equal(t, "up", e.Direction())
+	assert.InDelta(t, 1.52, e.After, 0.03)
+	assert.InDelta(t, 50, e.Shift(), 5)
+
+	point := e.point()
+	assert.Equal(t, "tcp_ping_change", point.Measurement)
+	assert.Equal(t, map[string]string{"host": "host", "ip": "10.0.0.1", "port": "22", "direction": "up"}, point.Tags)
+
+	//grpc-ping的service单独作为tag
+	e.Kind, e.Target = "grpc_ping", "10.0.0.1:50051/order.OrderService"
+	point = e.point()
+	assert.Equal(t, "grpc_ping_change", point.Measurement)
+	assert.Equal(t, map[string]string{"host": "host", "ip": "10.0.0.1", "port": "50051",
+		"service": "order.OrderService", "direction": "up"}, point.Tags)
+}
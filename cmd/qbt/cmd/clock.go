@@ -0,0 +1,359 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/qbtrade/qbt/cmd/qbt/cf"
+	"github.com/spf13/cobra"
+)
+
+const (
+	ntpPacketLen = 48
+	//NTP时间从1900年开始计算
+	ntpEpochOffset = 2208988800
+	//计算漂移最多使用最近多少个样本
+	clockDriftSamples = 1000
+	//clockTracker 查询参考时钟的间隔和每次查询的样本数
+	clockTrackInterval = 16 * time.Second
+	clockTrackSamples  = 4
+)
+
+var errKissOfDeath = errors.New("ntp server sent kiss-o'-death")
+
+// clockSample 一次时钟偏差测量，offset为对端时钟减本机时钟
+type clockSample struct {
+	ts      time.Time
+	server  string
+	kind    string // ntp 或 qbt
+	offset  time.Duration
+	delay   time.Duration
+	stratum int
+}
+
+// clockOffset 由四个时间戳按NTP算法计算时钟偏差和往返时延
+func clockOffset(t1, t2, t3, t4 time.Time) (offset, delay time.Duration) {
+	offset = (t2.Sub(t1) + t3.Sub(t4)) / 2
+	delay = t4.Sub(t1) - t3.Sub(t2)
+	return offset, delay
+}
+
+func toNtpTime(t time.Time) uint64 {
+	sec := uint64(t.Unix() + ntpEpochOffset)
+	frac := (uint64(t.Nanosecond()) << 32) / 1e9
+	return sec<<32 | frac
+}
+
+func fromNtpTime(v uint64) time.Time {
+	sec := int64(v>>32) - ntpEpochOffset
+	nsec := (int64(v&0xffffffff) * 1e9) >> 32
+	return time.Unix(sec, nsec)
+}
+
+// sntpQuery 以SNTP客户端模式向NTP服务器查询一次
+func sntpQuery(server string, timeout time.Duration) (clockSample, error) {
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "123")
+	}
+	sample := clockSample{server: server, kind: "ntp"}
+	conn, err := net.DialTimeout("udp", server, timeout)
+	if err != nil {
+		return sample, err
+	}
+	defer conn.Close()
+
+	req := make([]byte, ntpPacketLen)
+	//LI=0 VN=4 Mode=3(client)
+	req[0] = 0x23
+	t1 := time.Now()
+	binary.BigEndian.PutUint64(req[40:48], toNtpTime(t1))
+	_ = conn.SetDeadline(t1.Add(timeout))
+	if _, err = conn.Write(req); err != nil {
+		return sample, err
+	}
+	resp := make([]byte, 128)
+	for {
+		n, err := conn.Read(resp)
+		t4 := time.Now()
+		if err != nil {
+			return sample, err
+		}
+		//只接受originate timestamp和请求一致的服务端回包
+		if n < ntpPacketLen || resp[0]&0x07 != 4 || !bytes.Equal(resp[24:32], req[40:48]) {
+			continue
+		}
+		sample.stratum = int(resp[1])
+		if sample.stratum == 0 {
+			return sample, errKissOfDeath
+		}
+		t2 := fromNtpTime(binary.BigEndian.Uint64(resp[32:40]))
+		t3 := fromNtpTime(binary.BigEndian.Uint64(resp[40:48]))
+		sample.ts = t1
+		sample.offset, sample.delay = clockOffset(t1, t2, t3, t4)
+		return sample, nil
+	}
+}
+
+// reflectorClockQuery 通过 qbt serve --reflector 测量和另一台qbt机器的时钟偏差
+func reflectorClockQuery(conn net.Conn, seq uint64, secret string, timeout time.Duration) (clockSample, error) {
+	sample := clockSample{server: conn.RemoteAddr().String(), kind: "qbt"}
+	p, t4, err := reflectorProbe(conn, seq, 0, secret, timeout)
+	if err != nil {
+		return sample, err
+	}
+	sample.ts = time.Unix(0, p.t1)
+	sample.offset, sample.delay = clockOffset(time.Unix(0, p.t1), time.Unix(0, p.t2), time.Unix(0, p.t3), t4)
+	return sample, nil
+}
+
+// bestClockSample NTP时钟过滤：往返时延最小的样本受排队影响最小，偏差最可信
+func bestClockSample(samples []clockSample) clockSample {
+	best := samples[0]
+	for _, s := range samples[1:] {
+		if s.delay < best.delay {
+			best = s
+		}
+	}
+	return best
+}
+
+// clockTracker 定期通过SNTP测量本机相对参考时钟的偏差，供时间戳修正使用
+type clockTracker struct {
+	server   string
+	interval time.Duration
+	timeout  time.Duration
+
+	mu       sync.RWMutex
+	offset   time.Duration // 参考时钟减本机时钟
+	errBound time.Duration // 偏差的误差上界
+	updated  time.Time
+}
+
+func newClockTracker(server string, interval time.Duration) *clockTracker {
+	return &clockTracker{server: server, interval: interval, timeout: 2 * time.Second}
+}
+
+func (c *clockTracker) run() {
+	for {
+		c.update()
+		time.Sleep(c.interval)
+	}
+}
+
+// update 查询几次参考时钟，取时延最小的样本，误差上界为其单程时延加上几次偏差的离散程度
+func (c *clockTracker) update() {
+	samples := make([]clockSample, 0, clockTrackSamples)
+	for i := 0; i < clockTrackSamples; i++ {
+		s, err := sntpQuery(c.server, c.timeout)
+		if err != nil {
+			fmt.Println("clock reference", c.server, "error:", err)
+			continue
+		}
+		samples = append(samples, s)
+	}
+	if len(samples) == 0 {
+		return
+	}
+	best := bestClockSample(samples)
+	var spread time.Duration
+	for _, s := range samples {
+		spread = cf.Max(spread, s.offset-best.offset, best.offset-s.offset)
+	}
+	c.mu.Lock()
+	c.offset = best.offset
+	c.errBound = best.delay/2 + spread
+	c.updated = time.Now()
+	c.mu.Unlock()
+}
+
+// current 返回最近的偏差，从未同步或者太久没有更新时ok为false
+func (c *clockTracker) current() (offset, errBound time.Duration, ok bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.updated.IsZero() || time.Since(c.updated) > 4*c.interval {
+		return 0, 0, false
+	}
+	return c.offset, c.errBound, true
+}
+
+// clockDrift 对偏差序列做最小二乘拟合，斜率即本机相对对端的频率漂移
+type clockDrift struct {
+	ts     []float64 // 秒
+	offset []float64 // 纳秒
+}
+
+func (d *clockDrift) add(s clockSample) {
+	d.ts = append(d.ts, float64(s.ts.UnixNano())/1e9)
+	d.offset = append(d.offset, float64(s.offset.Nanoseconds()))
+	if len(d.ts) > clockDriftSamples {
+		d.ts = d.ts[1:]
+		d.offset = d.offset[1:]
+	}
+}
+
+// ppm 返回漂移，单位百万分之一(微秒/秒)，样本不足返回false
+func (d *clockDrift) ppm() (float64, bool) {
+	n := float64(len(d.ts))
+	if n < 2 {
+		return 0, false
+	}
+	meanT, meanO := cf.Mean(d.ts), cf.Mean(d.offset)
+	var num, den float64
+	for i := range d.ts {
+		num += (d.ts[i] - meanT) * (d.offset[i] - meanO)
+		den += (d.ts[i] - meanT) * (d.ts[i] - meanT)
+	}
+	if den == 0 {
+		return 0, false
+	}
+	//纳秒/秒 换算为 微秒/秒
+	return num / den / 1e3, true
+}
+
+var clockCmd = &cobra.Command{
+	Use:   "clock",
+	Short: "measure clock offset against ntp servers and qbt agents",
+	Long: `measure clock offset and delay against ntp servers (sntp) and other qbt serve --reflector instances,
+track the drift over time and export to influxdb and statsd, so the ts in csv files can be trusted.
+offset is the remote clock minus the local clock.
+For example:
+qbt clock --ntp ntp.aliyun.com,time.google.com --peer 10.110.1.86:7008 -i 10`,
+	Args: func(cmd *cobra.Command, args []string) error {
+		ntpServers, _ := cmd.Flags().GetStringSlice("ntp")
+		peers, _ := cmd.Flags().GetStringSlice("peer")
+		if len(ntpServers) == 0 && len(peers) == 0 {
+			return fmt.Errorf("no ntp server or peer to query")
+		}
+		return nil
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		ntpServers, _ := cmd.Flags().GetStringSlice("ntp")
+		peers, _ := cmd.Flags().GetStringSlice("peer")
+		interval, _ := cmd.Flags().GetFloat64("interval")
+		count, _ := cmd.Flags().GetInt("count")
+		samplesPerRound, _ := cmd.Flags().GetInt("samples")
+		timeout, _ := cmd.Flags().GetFloat64("timeout")
+		warnOffset, _ := cmd.Flags().GetFloat64("warn-offset")
+		statsdServer, _ := cmd.Flags().GetString("statsd")
+		secret := secretFromFlags(cmd)
+		if collector := setupCollector(cmd); collector != nil {
+			defer collector.close()
+		}
+		hostname, _ := os.Hostname()
+		samplesPerRound = cf.Max(samplesPerRound, 1)
+		timeoutDuration := time.Duration(timeout*1000) * time.Millisecond
+
+		statsdClient, err := newStatsdClient(statsdServer)
+		if err != nil {
+			fmt.Printf("new statsd client to %s error: %v\n", statsdServer, err)
+		}
+		peerConns := make(map[string]net.Conn)
+		for _, peer := range peers {
+			conn, err := net.Dial("udp", peer)
+			if err != nil {
+				fmt.Println("dial peer", peer, "error:", err)
+				continue
+			}
+			defer conn.Close()
+			peerConns[peer] = conn
+		}
+
+		drifts := make(map[string]*clockDrift)
+		var seq uint64
+		for n := 1; n <= count; n++ {
+			start := time.Now()
+			var best []clockSample
+			query := func(name string, q func() (clockSample, error)) {
+				samples := make([]clockSample, 0, samplesPerRound)
+				for i := 0; i < samplesPerRound; i++ {
+					s, err := q()
+					if err != nil {
+						fmt.Println("clock query", name, "error:", err)
+						continue
+					}
+					samples = append(samples, s)
+				}
+				if len(samples) > 0 {
+					best = append(best, bestClockSample(samples))
+				}
+			}
+			for _, server := range ntpServers {
+				server := server
+				query(server, func() (clockSample, error) { return sntpQuery(server, timeoutDuration) })
+			}
+			for peer, conn := range peerConns {
+				conn := conn
+				query(peer, func() (clockSample, error) {
+					seq++
+					return reflectorClockQuery(conn, seq, secret, timeoutDuration)
+				})
+			}
+
+			points := make([]cf.InfluxdbPoint, 0, len(best))
+			for _, s := range best {
+				drift, ok := drifts[s.server]
+				if !ok {
+					drift = &clockDrift{}
+					drifts[s.server] = drift
+				}
+				drift.add(s)
+				offsetMs := float64(s.offset.Nanoseconds()) / 1e6
+				delayMs := float64(s.delay.Nanoseconds()) / 1e6
+				line := fmt.Sprintf("%s %s (%s) offset=%+.3fms delay=%.3fms", s.ts.Format(time.RFC3339), s.server, s.kind, offsetMs, delayMs)
+				fields := map[string]float64{"offset": offsetMs, "delay": delayMs}
+				if ppm, ok := drift.ppm(); ok {
+					line += fmt.Sprintf(" drift=%+.3fppm", ppm)
+					fields["drift_ppm"] = ppm
+				}
+				fmt.Println(line)
+				if warnOffset > 0 && math.Abs(offsetMs) > warnOffset {
+					fmt.Printf("[WARN] local clock is %.3fms off %s, ts recorded on %s is not trustworthy\n",
+						-offsetMs, s.server, hostname)
+				}
+
+				tags := []string{fmt.Sprintf("host:%s", hostname), fmt.Sprintf("server:%s", s.server), fmt.Sprintf("kind:%s", s.kind)}
+				_ = statsdClient.Gauge("qbt/clock-offset", offsetMs, tags, 1)
+				_ = statsdClient.Gauge("qbt/clock-delay", delayMs, tags, 1)
+				points = append(points, cf.InfluxdbPoint{
+					Measurement: "clock_offset",
+					Tags: map[string]string{
+						"host":   hostname,
+						"server": s.server,
+						"kind":   s.kind,
+					},
+					Fields: fields,
+					Time:   s.ts,
+				})
+			}
+			if len(points) > 0 {
+				if errInfluxdb := cf.WritePoints(points); errInfluxdb != nil {
+					fmt.Println("write to influxdb error", errInfluxdb)
+				}
+			}
+			if n < count {
+				time.Sleep(time.Duration(interval*1000)*time.Millisecond - time.Since(start))
+			}
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(clockCmd)
+	clockCmd.Flags().StringSlice("ntp", []string{"pool.ntp.org"}, "ntp servers to query, HOST or HOST:PORT")
+	clockCmd.Flags().StringSlice("peer", nil, "qbt serve --reflector instances to query, IP:PORT")
+	clockCmd.Flags().Float64P("interval", "i", 16, "query interval in seconds")
+	clockCmd.Flags().IntP("count", "c", math.MaxInt, "max rounds to query")
+	clockCmd.Flags().Int("samples", 4, "queries per server each round, the one with the lowest delay is used")
+	clockCmd.Flags().Float64P("timeout", "t", 2, "query timeout in seconds")
+	clockCmd.Flags().Float64("warn-offset", 1, "warn when the absolute offset exceeds this many ms, 0 disables")
+	clockCmd.Flags().String("statsd", "10.11.1.33:8125", "send offset to statsd")
+	addCollectorFlags(clockCmd)
+	clockCmd.Flags().String("secret", "", "shared secret of qbt serve peers (default from config key secret)")
+}
@@ -0,0 +1,78 @@
+package cmd
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNtpTime(t *testing.T) {
+	now := time.Unix(1700000000, 123456789)
+	back := fromNtpTime(toNtpTime(now))
+	assert.InDelta(t, 0, float64(back.Sub(now)), float64(time.Microsecond))
+}
+
+func TestClockOffset(t *testing.T) {
+	t1 := time.Unix(100, 0)
+	//对端快5ms，去程2ms，回程4ms，对端处理1ms
+	t2 := t1.Add(2*time.Millisecond + 5*time.Millisecond)
+	t3 := t2.Add(time.Millisecond)
+	t4 := t3.Add(-5*time.Millisecond + 4*time.Millisecond)
+	offset, delay := clockOffset(t1, t2, t3, t4)
+	//非对称路径会带来(去程-回程)/2的误差
+	assert.Equal(t, 4*time.Millisecond, offset)
+	assert.Equal(t, 6*time.Millisecond, delay)
+}
+
+// fakeNtpServer 时钟比本机快skew的SNTP服务端
+func fakeNtpServer(t *testing.T, skew time.Duration) string {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	t.Cleanup(func() { _ = pc.Close() })
+	go func() {
+		buf := make([]byte, 128)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if n < ntpPacketLen {
+				continue
+			}
+			resp := make([]byte, ntpPacketLen)
+			resp[0] = 0x24
+			resp[1] = 2
+			copy(resp[24:32], buf[40:48])
+			binary.BigEndian.PutUint64(resp[32:40], toNtpTime(time.Now().Add(skew)))
+			binary.BigEndian.PutUint64(resp[40:48], toNtpTime(time.Now().Add(skew)))
+			_, _ = pc.WriteTo(resp, addr)
+		}
+	}()
+	return pc.LocalAddr().String()
+}
+
+func TestSntpQuery(t *testing.T) {
+	server := fakeNtpServer(t, 50*time.Millisecond)
+	sample, err := sntpQuery(server, time.Second)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, sample.stratum)
+	assert.InDelta(t, float64(50*time.Millisecond), float64(sample.offset), float64(5*time.Millisecond))
+	assert.True(t, sample.delay >= 0)
+}
+
+func TestClockDrift(t *testing.T) {
+	d := &clockDrift{}
+	_, ok := d.ppm()
+	assert.False(t, ok)
+	start := time.Unix(1700000000, 0)
+	//每秒偏差增加10微秒，即10ppm
+	for i := 0; i < 10; i++ {
+		d.add(clockSample{ts: start.Add(time.Duration(i) * time.Second), offset: time.Duration(i) * 10 * time.Microsecond})
+	}
+	ppm, ok := d.ppm()
+	assert.True(t, ok)
+	assert.InDelta(t, 10, ppm, 1e-6)
+}
@@ -0,0 +1,353 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/qbtrade/qbt/cmd/qbt/cf"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+const collectorMacHeader = "X-Qbt-Mac"
+
+// errCollectorBuffered 数据已经放进collector的发送队列，只是暂时没送达，调用方不需要保留重发
+var errCollectorBuffered = errors.New("buffered for retry")
+
+// collectorBatch agent推送给collector的一批数据点，(agent, boot, seq)唯一标识一批数据，重发时不变
+type collectorBatch struct {
+	Agent  string             `json:"agent"`
+	Boot   int64              `json:"boot"` // agent进程启动时间，区分重启后重新计数的seq
+	Seq    uint64             `json:"seq"`
+	Points []cf.InfluxdbPoint `json:"points"`
+}
+
+// collectorClient agent端，按顺序推送批次，collector不可用时在内存中缓存，超过上限丢弃最旧的批次
+type collectorClient struct {
+	url    string
+	agent  string
+	secret string
+	limit  int // 缓存的数据点上限
+	boot   int64
+	client *http.Client
+	spool  *cf.Spool // 配置了spool时不在内存中缓存，发送失败的批次存到磁盘
+
+	sendMu  sync.Mutex // 保证批次按seq顺序发送，发送时不持有mu
+	mu      sync.Mutex
+	seq     uint64
+	pending []collectorBatch
+	queued  int // pending中的数据点数
+	dropped int // 因缓存满被丢弃的数据点数
+}
+
+func newCollectorClient(url, agent, secret string, limit int) *collectorClient {
+	return &collectorClient{
+		url:    url,
+		agent:  agent,
+		secret: secret,
+		limit:  limit,
+		boot:   time.Now().UnixNano(),
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// write 把新数据点加入队列并尝试发送全部积压的批次，points为空时只重试积压。
+// 数据进入队列后就算被接收，发送失败返回errCollectorBuffered，调用方不要再用新的seq重发同一批数据
+func (c *collectorClient) write(points []cf.InfluxdbPoint) error {
+	if c.spool != nil {
+		//seq和写spool要一起有序，spool内部按顺序重放
+		c.sendMu.Lock()
+		defer c.sendMu.Unlock()
+		var body []byte
+		if len(points) > 0 {
+			c.mu.Lock()
+			c.seq++
+			batch := collectorBatch{Agent: c.agent, Boot: c.boot, Seq: c.seq, Points: points}
+			c.mu.Unlock()
+			var err error
+			if body, err = json.Marshal(batch); err != nil {
+				return err
+			}
+		}
+		return c.spool.Write(body)
+	}
+	c.mu.Lock()
+	if len(points) > 0 {
+		c.seq++
+		c.pending = append(c.pending, collectorBatch{Agent: c.agent, Boot: c.boot, Seq: c.seq, Points: points})
+		c.queued += len(points)
+	}
+	for c.queued > c.limit && len(c.pending) > 1 {
+		c.dropped += len(c.pending[0].Points)
+		c.queued -= len(c.pending[0].Points)
+		c.pending = c.pending[1:]
+		fmt.Println("collector buffer full, dropped", c.dropped, "points so far")
+	}
+	c.mu.Unlock()
+	//其他goroutine正在发送时不等待，新批次留在队列中由它或下一次write发送
+	if !c.sendMu.TryLock() {
+		return nil
+	}
+	defer c.sendMu.Unlock()
+	return c.drain()
+}
+
+// drain 按顺序发送队列中的批次，调用方持有sendMu
+func (c *collectorClient) drain() error {
+	for {
+		c.mu.Lock()
+		if len(c.pending) == 0 {
+			c.mu.Unlock()
+			return nil
+		}
+		batch := c.pending[0]
+		c.mu.Unlock()
+		err := c.send(batch)
+		c.mu.Lock()
+		if err != nil {
+			queued := c.queued
+			c.mu.Unlock()
+			return fmt.Errorf("%w, push to collector (%d points buffered): %v", errCollectorBuffered, queued, err)
+		}
+		//发送期间缓存满时这一批可能已经被丢弃
+		if len(c.pending) > 0 && c.pending[0].Seq == batch.Seq {
+			c.queued -= len(batch.Points)
+			c.pending = c.pending[1:]
+		}
+		c.mu.Unlock()
+	}
+}
+
+func (c *collectorClient) send(batch collectorBatch) error {
+	body, err := json.Marshal(batch)
+	if err != nil {
+		return err
+	}
+	return c.post(body)
+}
+
+func (c *collectorClient) post(body []byte) error {
+	req, err := http.NewRequest("POST", c.url+"/collect", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.secret != "" {
+		req.Header.Set(collectorMacHeader, hex.EncodeToString(authMac(c.secret, body)))
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 256))
+		return fmt.Errorf("collector response %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// close 退出前最后发送一次，等待正在进行的发送，报告没能送达的数据
+func (c *collectorClient) close() {
+	var err error
+	if c.spool != nil {
+		err = c.write(nil)
+	} else {
+		c.sendMu.Lock()
+		err = c.drain()
+		c.sendMu.Unlock()
+	}
+	if err != nil {
+		fmt.Println("collector error:", err)
+	}
+	if c.spool != nil {
+		if files, _ := c.spool.Pending(); files > 0 {
+			fmt.Println(files, "collector batches left in spool, they are replayed on next run")
+		}
+	}
+}
+
+// addCollectorFlags 推送到collector相关的参数
+func addCollectorFlags(cmd *cobra.Command) {
+	cmd.Flags().String("collector", "", "push results to qbt serve --collector at this http address instead of influxdb "+
+		"(default from config key collector.url)")
+	cmd.Flags().Int("collector-buffer", 100000, "max points buffered in memory while the collector is unreachable")
+}
+
+// setupCollector 配置了collector时把cf.WritePoints改为推送给collector，返回nil表示未配置
+func setupCollector(cmd *cobra.Command) *collectorClient {
+	url, _ := cmd.Flags().GetString("collector")
+	limit, _ := cmd.Flags().GetInt("collector-buffer")
+	if url == "" {
+		url = viper.GetString("collector.url")
+	}
+	if url == "" {
+		return nil
+	}
+	if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+		url = "http://" + url
+	}
+	hostname, _ := os.Hostname()
+	client := newCollectorClient(url, hostname, secretFromFlags(cmd), limit)
+	client.spool = openSpool("collector", client.post)
+	cf.PointsHook = client.write
+	return client
+}
+
+// collectorAgentStats collector记录的每个agent的状态
+type collectorAgentStats struct {
+	Boot       int64     `json:"boot"`
+	LastSeq    uint64    `json:"last_seq"`
+	Batches    int64     `json:"batches"`
+	Points     int64     `json:"points"`
+	Duplicates int64     `json:"duplicates"` // 重发的批次
+	Gaps       int64     `json:"gaps"`       // agent缓存满丢弃的批次
+	LastSeen   time.Time `json:"last_seen"`
+}
+
+// collector 服务端，接收agent推送的数据点，去重后存档并写入influxdb
+type collector struct {
+	secret string
+	dir    string // 存档目录，为空不存档
+	export func(points []cf.InfluxdbPoint) error
+
+	mu     sync.Mutex
+	agents map[string]*collectorAgentStats
+	locks  map[string]*sync.Mutex
+}
+
+func newCollector(secret, dir string) *collector {
+	return &collector{
+		secret: secret,
+		dir:    dir,
+		export: cf.WriteInflux,
+		agents: make(map[string]*collectorAgentStats),
+		locks:  make(map[string]*sync.Mutex),
+	}
+}
+
+// register 注册 POST /collect 和 GET /collector
+func (c *collector) register(mux *http.ServeMux) {
+	mux.HandleFunc("/collect", c.handleCollect)
+	mux.HandleFunc("/collector", func(w http.ResponseWriter, r *http.Request) {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		writeJSON(w, c.agents)
+	})
+}
+
+func (c *collector) handleCollect(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, 64<<20))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if c.secret != "" {
+		mac, err := hex.DecodeString(r.Header.Get(collectorMacHeader))
+		if err != nil || !hmac.Equal(mac, authMac(c.secret, body)) {
+			http.Error(w, "bad signature", http.StatusUnauthorized)
+			return
+		}
+	}
+	var batch collectorBatch
+	if err = json.Unmarshal(body, &batch); err != nil || batch.Agent == "" {
+		http.Error(w, "bad batch", http.StatusBadRequest)
+		return
+	}
+	if err = c.accept(batch); err != nil {
+		//返回错误让agent保留这批数据稍后重发
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// accept 处理一批数据，重复的批次直接确认，导出失败时不记录seq以便重发
+func (c *collector) accept(batch collectorBatch) error {
+	//同一agent的批次按顺序处理，导出influxdb时不持有mu，不阻塞其他agent和状态查询
+	lock := c.agentLock(batch.Agent)
+	lock.Lock()
+	defer lock.Unlock()
+	c.mu.Lock()
+	agent, ok := c.agents[batch.Agent]
+	if !ok || batch.Boot > agent.Boot {
+		agent = &collectorAgentStats{Boot: batch.Boot}
+		c.agents[batch.Agent] = agent
+	}
+	agent.LastSeen = time.Now()
+	if batch.Boot < agent.Boot || batch.Seq <= agent.LastSeq {
+		agent.Duplicates++
+		c.mu.Unlock()
+		return nil
+	}
+	c.mu.Unlock()
+	for i := range batch.Points {
+		if batch.Points[i].Tags == nil {
+			batch.Points[i].Tags = map[string]string{}
+		}
+		if _, ok := batch.Points[i].Tags["host"]; !ok {
+			batch.Points[i].Tags["host"] = batch.Agent
+		}
+	}
+	if err := c.export(batch.Points); err != nil {
+		return err
+	}
+	if err := c.archive(batch); err != nil {
+		fmt.Println("collector archive error:", err)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if agent.LastSeq > 0 && batch.Seq > agent.LastSeq+1 {
+		agent.Gaps += int64(batch.Seq - agent.LastSeq - 1)
+	}
+	agent.LastSeq = batch.Seq
+	agent.Batches++
+	agent.Points += int64(len(batch.Points))
+	return nil
+}
+
+// agentLock 每个agent一把锁
+func (c *collector) agentLock(agent string) *sync.Mutex {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	lock, ok := c.locks[agent]
+	if !ok {
+		lock = new(sync.Mutex)
+		c.locks[agent] = lock
+	}
+	return lock
+}
+
+// archive 按天把批次追加到 collector_YYYYMMDD.jsonl
+func (c *collector) archive(batch collectorBatch) error {
+	if c.dir == "" {
+		return nil
+	}
+	filename := filepath.Join(c.dir, "collector_"+time.Now().Format("20060102")+".jsonl")
+	file, err := os.OpenFile(filename, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	line, err := json.Marshal(batch)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(append(line, '\n'))
+	return err
+}
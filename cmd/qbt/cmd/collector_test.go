@@ -0,0 +1,99 @@
+package cmd
+
+import (
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/qbtrade/qbt/cmd/qbt/cf"
+	"github.com/stretchr/testify/assert"
+)
+
+func collectorPoints(n int) []cf.InfluxdbPoint {
+	points := make([]cf.InfluxdbPoint, 0, n)
+	for i := 0; i < n; i++ {
+		points = append(points, cf.InfluxdbPoint{
+			Measurement: "tcp_ping",
+			Tags:        map[string]string{"ip": "10.0.0.1"},
+			Fields:      map[string]float64{"rtt": float64(i)},
+			Time:        time.Now(),
+		})
+	}
+	return points
+}
+
+func TestCollector(t *testing.T) {
+	server := newCollector("s3cret", t.TempDir())
+	var exported []cf.InfluxdbPoint
+	exportErr := errors.New("influxdb down")
+	server.export = func(points []cf.InfluxdbPoint) error {
+		if exportErr != nil {
+			return exportErr
+		}
+		exported = append(exported, points...)
+		return nil
+	}
+	mux := newQbtServer("", 0).mux
+	server.register(mux)
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	client := newCollectorClient(ts.URL, "agent1", "s3cret", 5)
+	//collector写influxdb失败时agent保留数据，超过上限丢弃最旧的批次
+	assert.True(t, errors.Is(client.write(collectorPoints(3)), errCollectorBuffered))
+	assert.True(t, errors.Is(client.write(collectorPoints(3)), errCollectorBuffered))
+	assert.Equal(t, 1, len(client.pending))
+	assert.Equal(t, 3, client.dropped)
+
+	exportErr = nil
+	assert.Nil(t, client.write(collectorPoints(2)))
+	assert.Equal(t, 0, len(client.pending))
+	assert.Equal(t, 5, len(exported))
+	assert.Equal(t, "agent1", exported[0].Tags["host"])
+	stats := server.agents["agent1"]
+	assert.Equal(t, uint64(3), stats.LastSeq)
+	assert.Equal(t, int64(5), stats.Points)
+
+	//重发的批次被去重
+	assert.Nil(t, client.send(collectorBatch{Agent: "agent1", Boot: client.boot, Seq: 3, Points: collectorPoints(2)}))
+	assert.Equal(t, 5, len(exported))
+	assert.Equal(t, int64(1), stats.Duplicates)
+
+	//密钥错误被拒绝
+	bad := newCollectorClient(ts.URL, "agent2", "wrong", 5)
+	assert.NotNil(t, bad.write(collectorPoints(1)))
+	assert.Equal(t, 5, len(exported))
+}
+
+func TestCollectorFlushNotRequeued(t *testing.T) {
+	server := newCollector("", "")
+	var exported []cf.InfluxdbPoint
+	exportErr := errors.New("influxdb down")
+	server.export = func(points []cf.InfluxdbPoint) error {
+		if exportErr != nil {
+			return exportErr
+		}
+		exported = append(exported, points...)
+		return nil
+	}
+	mux := newQbtServer("", 0).mux
+	server.register(mux)
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	client := newCollectorClient(ts.URL, "agent1", "", 1000)
+	cf.PointsHook = client.write
+	defer func() { cf.PointsHook = nil }()
+	//collector不可用时flushInfluxPoints不保留已进入队列的数据，避免用新的seq重复发送
+	for i := 0; i < 3; i++ {
+		assert.Empty(t, flushInfluxPoints(collectorPoints(2)))
+	}
+	assert.Equal(t, 3, len(client.pending))
+	assert.Equal(t, 6, client.queued)
+
+	exportErr = nil
+	client.close()
+	assert.Equal(t, 6, len(exported))
+	assert.Equal(t, uint64(3), server.agents["agent1"].LastSeq)
+}
@@ -0,0 +1,279 @@
+package cmd
+
+import (
+	"compress/gzip"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// csvRotateOptions csv文件的切分、压缩和保留策略
+type csvRotateOptions struct {
+	dir      string        // 输出目录
+	every    string        // 按时间切分：hour、day，none表示不按时间切分
+	maxBytes int64         // 单个文件超过该大小切分，0不限制
+	gzip     bool          // 切分后压缩旧文件
+	maxAge   time.Duration // 删除超过该时间的文件，0不限制
+	maxTotal int64         // 所有文件总大小超过后从最旧的开始删除，0不限制
+}
+
+// csvRotator 按时间和大小切分的csv writer，每个新文件都写表头，可以被多个goroutine共用。
+// 文件名为 prefix_YYYYMMDDHH.csv，同一时段按大小切分的文件为 prefix_YYYYMMDDHH_1.csv
+type csvRotator struct {
+	opts   csvRotateOptions
+	prefix string
+	header []string
+
+	mu      sync.Mutex
+	file    *os.File
+	writer  *csv.Writer
+	written *countingWriter
+	period  string
+	part    int
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func newCsvRotator(prefix string, header []string, opts csvRotateOptions) (*csvRotator, error) {
+	if opts.dir == "" {
+		opts.dir = "."
+	}
+	if err := os.MkdirAll(opts.dir, 0755); err != nil {
+		return nil, err
+	}
+	r := &csvRotator{opts: opts, prefix: prefix, header: header}
+	if err := r.open(r.periodOf(time.Now())); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *csvRotator) periodOf(ts time.Time) string {
+	switch r.opts.every {
+	case "day":
+		return ts.Format("20060102")
+	case "none":
+		return ""
+	default:
+		return ts.Format("2006010215")
+	}
+}
+
+func (r *csvRotator) filename(period string, part int) string {
+	name := r.prefix
+	if period != "" {
+		name += "_" + period
+	}
+	if part > 0 {
+		name += "_" + strconv.Itoa(part)
+	}
+	return filepath.Join(r.opts.dir, name+".csv")
+}
+
+// open 打开period时段的文件，已有内容的文件接着追加，超过大小的换下一个序号
+func (r *csvRotator) open(period string) error {
+	r.period = period
+	for r.part = 0; ; r.part++ {
+		filename := r.filename(r.period, r.part)
+		if _, err := os.Stat(filename + ".gz"); err == nil {
+			continue
+		}
+		info, err := os.Stat(filename)
+		if err == nil && r.opts.maxBytes > 0 && info.Size() >= r.opts.maxBytes {
+			continue
+		}
+		file, err := os.OpenFile(filename, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			return err
+		}
+		info, err = file.Stat()
+		if err != nil {
+			_ = file.Close()
+			return err
+		}
+		r.file = file
+		r.written = &countingWriter{w: file, n: info.Size()}
+		r.writer = csv.NewWriter(r.written)
+		//新文件写表头，已有文件直接追加
+		if info.Size() == 0 {
+			if err = r.writer.Write(r.header); err != nil {
+				return err
+			}
+			r.writer.Flush()
+		}
+		return r.writer.Error()
+	}
+}
+
+// Write 写一行，ts进入新的时段或文件超过大小时先切分。
+// 各goroutine的探测完成顺序不定，上一时段晚到的行写入当前文件，不切回已经关闭(可能正在压缩)的文件
+func (r *csvRotator) Write(row []string, ts time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	//时段是定长的数字，可以直接比较先后
+	period := r.periodOf(ts)
+	if period < r.period {
+		period = r.period
+	}
+	if period != r.period || (r.opts.maxBytes > 0 && r.written.n >= r.opts.maxBytes) {
+		if err := r.rotate(period); err != nil {
+			return err
+		}
+	}
+	return r.writer.Write(row)
+}
+
+func (r *csvRotator) rotate(period string) error {
+	closed := r.file.Name()
+	if err := r.close(); err != nil {
+		return err
+	}
+	if err := r.open(period); err != nil {
+		return err
+	}
+	current := r.file.Name()
+	go func() {
+		if r.opts.gzip {
+			if err := gzipFile(closed); err != nil {
+				fmt.Println("gzip csv error:", err)
+			}
+		}
+		r.cleanup(current)
+	}()
+	return nil
+}
+
+func (r *csvRotator) Flush() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.writer.Flush()
+	return r.writer.Error()
+}
+
+func (r *csvRotator) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.close()
+}
+
+func (r *csvRotator) close() error {
+	r.writer.Flush()
+	if err := r.writer.Error(); err != nil {
+		return err
+	}
+	return r.file.Close()
+}
+
+// cleanup 按保留时间和总大小删除旧文件，不删除正在写的文件
+func (r *csvRotator) cleanup(current string) {
+	if r.opts.maxAge <= 0 && r.opts.maxTotal <= 0 {
+		return
+	}
+	matches, _ := filepath.Glob(filepath.Join(r.opts.dir, r.prefix+"_*.csv*"))
+	type csvFile struct {
+		name    string
+		size    int64
+		modTime time.Time
+	}
+	files := make([]csvFile, 0, len(matches))
+	var total int64
+	for _, name := range matches {
+		//prefix之后是时间的才是本组文件，排除 prefix_summary 之类的其他文件
+		suffix := strings.TrimPrefix(filepath.Base(name), r.prefix+"_")
+		if suffix == "" || suffix[0] < '0' || suffix[0] > '9' {
+			continue
+		}
+		info, err := os.Stat(name)
+		if err != nil || name == current {
+			continue
+		}
+		files = append(files, csvFile{name: name, size: info.Size(), modTime: info.ModTime()})
+		total += info.Size()
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].modTime.Before(files[j].modTime) })
+	for _, f := range files {
+		expired := r.opts.maxAge > 0 && time.Since(f.modTime) > r.opts.maxAge
+		oversize := r.opts.maxTotal > 0 && total > r.opts.maxTotal
+		if !expired && !oversize {
+			break
+		}
+		if err := os.Remove(f.name); err != nil {
+			fmt.Println("remove csv error:", err)
+			continue
+		}
+		total -= f.size
+	}
+}
+
+// gzipFile 把文件压缩为.gz并删除原文件
+func gzipFile(filename string) error {
+	src, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.Create(filename + ".gz.tmp")
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(dst)
+	if _, err = io.Copy(zw, src); err == nil {
+		err = zw.Close()
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(dst.Name())
+		return err
+	}
+	if err = os.Rename(dst.Name(), filename+".gz"); err != nil {
+		return err
+	}
+	return os.Remove(filename)
+}
+
+// addCsvFlags csv输出相关的参数
+func addCsvFlags(cmd *cobra.Command) {
+	cmd.Flags().String("csv-dir", ".", "directory of the csv files")
+	cmd.Flags().String("csv-rotate", "hour", "start a new csv file every hour, day or none")
+	cmd.Flags().Int("csv-max-mb", 0, "start a new csv file when the current one exceeds this size, 0 disables")
+	cmd.Flags().Bool("csv-gzip", false, "gzip csv files after they are rotated")
+	cmd.Flags().Float64("csv-keep-days", 0, "delete csv files older than this many days, 0 keeps all")
+	cmd.Flags().Int("csv-keep-mb", 0, "delete the oldest csv files when all files exceed this size, 0 disables")
+}
+
+func csvOptionsFromFlags(cmd *cobra.Command) csvRotateOptions {
+	dir, _ := cmd.Flags().GetString("csv-dir")
+	every, _ := cmd.Flags().GetString("csv-rotate")
+	maxMB, _ := cmd.Flags().GetInt("csv-max-mb")
+	gz, _ := cmd.Flags().GetBool("csv-gzip")
+	keepDays, _ := cmd.Flags().GetFloat64("csv-keep-days")
+	keepMB, _ := cmd.Flags().GetInt("csv-keep-mb")
+	return csvRotateOptions{
+		dir:      dir,
+		every:    every,
+		maxBytes: int64(maxMB) << 20,
+		gzip:     gz,
+		maxAge:   time.Duration(keepDays * float64(24*time.Hour)),
+		maxTotal: int64(keepMB) << 20,
+	}
+}
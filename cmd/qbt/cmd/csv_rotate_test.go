@@ -0,0 +1,66 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCsvRotator(t *testing.T) {
+	dir := t.TempDir()
+	header := []string{"ts", "rtt"}
+	r, err := newCsvRotator("host_tcp_ping", header, csvRotateOptions{dir: dir, every: "hour", gzip: true})
+	assert.Nil(t, err)
+	now := time.Now()
+	assert.Nil(t, r.Write([]string{"1", "0.5"}, now))
+	//进入下一个小时切分文件，旧文件被压缩
+	next := now.Add(time.Hour)
+	assert.Nil(t, r.Write([]string{"2", "0.6"}, next))
+	//上一个小时晚到的行写入当前文件，不切回旧文件
+	assert.Nil(t, r.Write([]string{"late", "0.9"}, now))
+	assert.Nil(t, r.Close())
+
+	first := filepath.Join(dir, "host_tcp_ping_"+now.Format("2006010215")+".csv")
+	second := filepath.Join(dir, "host_tcp_ping_"+next.Format("2006010215")+".csv")
+	assert.Eventually(t, func() bool {
+		_, err := os.Stat(first + ".gz")
+		return err == nil
+	}, time.Second, 10*time.Millisecond)
+	content, err := os.ReadFile(second)
+	assert.Nil(t, err)
+	assert.Equal(t, "ts,rtt\n2,0.6\nlate,0.9\n", string(content))
+	_, err = os.Stat(filepath.Join(dir, "host_tcp_ping_"+now.Format("2006010215")+"_1.csv"))
+	assert.True(t, os.IsNotExist(err))
+
+	//重启后同一时段的文件直接追加，不重复写表头
+	for _, row := range []string{"3", "4"} {
+		r, err = newCsvRotator("host_tcp_ping", header, csvRotateOptions{dir: dir, every: "none"})
+		assert.Nil(t, err)
+		assert.Nil(t, r.Write([]string{row, "0.7"}, now))
+		assert.Nil(t, r.Close())
+	}
+	content, err = os.ReadFile(filepath.Join(dir, "host_tcp_ping.csv"))
+	assert.Nil(t, err)
+	assert.Equal(t, "ts,rtt\n3,0.7\n4,0.7\n", string(content))
+}
+
+func TestCsvRotatorSize(t *testing.T) {
+	dir := t.TempDir()
+	r, err := newCsvRotator("host_tcp_echo", []string{"ts"}, csvRotateOptions{dir: dir, every: "none", maxBytes: 10})
+	assert.Nil(t, err)
+	for i := 0; i < 6; i++ {
+		assert.Nil(t, r.Write([]string{"12345"}, time.Now()))
+		assert.Nil(t, r.Flush())
+	}
+	assert.Nil(t, r.Close())
+	matches, _ := filepath.Glob(filepath.Join(dir, "host_tcp_echo*.csv"))
+	assert.Equal(t, 3, len(matches))
+	for _, name := range matches {
+		content, _ := os.ReadFile(name)
+		assert.True(t, strings.HasPrefix(string(content), "ts\n"), name)
+	}
+}
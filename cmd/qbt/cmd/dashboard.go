@@ -0,0 +1,327 @@
+package cmd
+
+import (
+	"crypto/subtle"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+//go:embed web
+var dashboardFiles embed.FS
+
+// dashboardProbe 推送给浏览器的一次探测结果
+type dashboardProbe struct {
+	Ts     int64   `json:"ts"` // 毫秒
+	Target string  `json:"target"`
+	Rtt    float64 `json:"rtt"`
+	Loss   bool    `json:"loss"`
+}
+
+// dashboardTarget GET /api/targets 返回的一个target的实时统计
+type dashboardTarget struct {
+	Target  string    `json:"target"`
+	Last    float64   `json:"last"`
+	Mean    float64   `json:"mean"`
+	P99     float64   `json:"p99"`
+	LossPct float64   `json:"loss_pct"`
+	Count   int       `json:"count"`
+	Recent  []float64 `json:"recent"` // 丢包为-1
+}
+
+type dashboardEntry struct {
+	stats *tuiTarget
+	stop  chan struct{}
+}
+
+// dashboard qbt serve --dashboard 的网页界面，自己对管理的target做tcp连接探测，
+// 通过SSE推送结果，历史数据来自 --store
+type dashboard struct {
+	secret   string // 修改target需要的密钥，为空时不允许修改
+	host     string
+	interval time.Duration
+	timeout  time.Duration
+
+	mu          sync.Mutex
+	targets     map[string]*dashboardEntry
+	subscribers map[chan dashboardProbe]struct{}
+}
+
+func newDashboard(secret string, interval, timeout time.Duration) *dashboard {
+	host, _ := os.Hostname()
+	return &dashboard{
+		secret:      secret,
+		host:        host,
+		interval:    interval,
+		timeout:     timeout,
+		targets:     map[string]*dashboardEntry{},
+		subscribers: map[chan dashboardProbe]struct{}{},
+	}
+}
+
+func (d *dashboard) register(mux *http.ServeMux) {
+	web, _ := fs.Sub(dashboardFiles, "web")
+	mux.Handle("/", http.FileServer(http.FS(web)))
+	mux.HandleFunc("/api/targets", d.handleTargets)
+	mux.HandleFunc("/api/events", d.handleEvents)
+	mux.HandleFunc("/api/history", d.handleHistory)
+}
+
+// normalizeTarget 统一target的写法，IP写成标准形式，IPv6加方括号
+func normalizeTarget(target string) (string, error) {
+	host, port, err := net.SplitHostPort(strings.TrimSpace(target))
+	if err != nil || host == "" || port == "" {
+		return "", fmt.Errorf("invalid target %q, want IP:PORT", target)
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		host = ip.String()
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// addTarget 开始探测一个target，已存在时忽略
+func (d *dashboard) addTarget(target string) error {
+	target, err := normalizeTarget(target)
+	if err != nil {
+		return err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.targets[target]; ok {
+		return nil
+	}
+	entry := &dashboardEntry{stats: &tuiTarget{target: target}, stop: make(chan struct{})}
+	d.targets[target] = entry
+	go d.probeLoop(target, entry)
+	return nil
+}
+
+func (d *dashboard) removeTarget(target string) bool {
+	target, err := normalizeTarget(target)
+	if err != nil {
+		return false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	entry, ok := d.targets[target]
+	if ok {
+		close(entry.stop)
+		delete(d.targets, target)
+	}
+	return ok
+}
+
+func (d *dashboard) probeLoop(target string, entry *dashboardEntry) {
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+	for {
+		start := time.Now()
+		conn, err := net.DialTimeout("tcp", target, d.timeout)
+		rtt := float64(time.Since(start).Nanoseconds()) / 1e6
+		if err == nil {
+			_ = conn.Close()
+		} else {
+			rtt = 0
+		}
+		d.record(entry, dashboardProbe{Ts: start.UnixMilli(), Target: target, Rtt: rtt, Loss: err != nil})
+		if probeStore != nil {
+			probeStore.addProbe(storedProbe{Ts: start, Host: d.host, Target: target, Kind: "tcp_ping",
+				Rtt: rtt, Loss: err != nil})
+		}
+		select {
+		case <-entry.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// record 更新统计并推送给所有订阅者，订阅者处理不过来时丢弃
+func (d *dashboard) record(entry *dashboardEntry, p dashboardProbe) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	entry.stats.add(p.Rtt, p.Loss)
+	for ch := range d.subscribers {
+		select {
+		case ch <- p:
+		default:
+		}
+	}
+}
+
+func (d *dashboard) list() []dashboardTarget {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	list := make([]dashboardTarget, 0, len(d.targets))
+	for _, entry := range d.targets {
+		t := entry.stats
+		item := dashboardTarget{Target: t.target, Last: t.last, Mean: t.cost.Mean(), P99: t.p99(),
+			LossPct: t.lossPct(), Count: t.count, Recent: make([]float64, 0, len(t.recent))}
+		for _, v := range t.recent {
+			//json不支持NaN，丢包用-1表示
+			if math.IsNaN(v) {
+				v = -1
+			}
+			item.Recent = append(item.Recent, v)
+		}
+		list = append(list, item)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Target < list[j].Target })
+	return list
+}
+
+// authorized 修改target需要 Authorization: Bearer <secret>，没有配置密钥时任何人都不能修改，
+// 否则谁都可以让服务端去连接任意地址
+func (d *dashboard) authorized(r *http.Request) bool {
+	if d.secret == "" {
+		return false
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(d.secret)) == 1
+}
+
+// handleTargets GET列出，POST target=IP:PORT 添加，DELETE ?target=IP:PORT 删除
+func (d *dashboard) handleTargets(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		writeJSON(w, d.list())
+		return
+	}
+	if d.secret == "" {
+		http.Error(w, "changing targets is disabled, start qbt serve with --secret", http.StatusForbidden)
+		return
+	}
+	if !d.authorized(r) {
+		http.Error(w, "bad secret", http.StatusUnauthorized)
+		return
+	}
+	switch r.Method {
+	case http.MethodPost:
+		if err := d.addTarget(strings.TrimSpace(r.FormValue("target"))); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	case http.MethodDelete:
+		if !d.removeTarget(r.URL.Query().Get("target")) {
+			http.Error(w, "no such target", http.StatusNotFound)
+			return
+		}
+	default:
+		http.Error(w, "GET, POST or DELETE only", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, d.list())
+}
+
+// handleEvents 用Server-Sent Events推送每一次探测
+func (d *dashboard) handleEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	ch := make(chan dashboardProbe, 256)
+	d.mu.Lock()
+	d.subscribers[ch] = struct{}{}
+	d.mu.Unlock()
+	defer func() {
+		d.mu.Lock()
+		delete(d.subscribers, ch)
+		d.mu.Unlock()
+	}()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	_, _ = fmt.Fprint(w, ": qbt\n\n")
+	flusher.Flush()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case p := <-ch:
+			data, _ := json.Marshal(p)
+			if _, err := fmt.Fprintf(w, "event: probe\ndata: %s\n\n", data); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// handleHistory 从 --store 查询历史，参数同qbt query：target、from、to、interval
+func (d *dashboard) handleHistory(w http.ResponseWriter, r *http.Request) {
+	if probeStore == nil {
+		http.Error(w, "no --store configured", http.StatusNotFound)
+		return
+	}
+	q := r.URL.Query()
+	now := time.Now()
+	fromStr, intervalStr := q.Get("from"), q.Get("interval")
+	if fromStr == "" {
+		fromStr = "-1h"
+	}
+	if intervalStr == "" {
+		intervalStr = "1m"
+	}
+	from, errFrom := parseQueryTime(fromStr, now)
+	to, errTo := parseQueryTime(q.Get("to"), now)
+	interval, errInterval := time.ParseDuration(intervalStr)
+	if errFrom != nil || errTo != nil || errInterval != nil {
+		http.Error(w, "bad from, to or interval", http.StatusBadRequest)
+		return
+	}
+	var targets []string
+	if target := q.Get("target"); target != "" {
+		targets = []string{target}
+	}
+	aggregator := newQueryAggregator(interval, []float64{50, 99})
+	err := storeScan(probeStore.path, storeProbesBucket, targetMatcher(targets), from, to,
+		func(target string, value []byte) error {
+			var p storedProbe
+			if err := json.Unmarshal(value, &p); err != nil {
+				return err
+			}
+			aggregator.add(target, p.Ts, p.Rtt, p.Loss)
+			return nil
+		})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	writeJSON(w, aggregator.rows())
+}
+
+// startDashboard 注册网页界面，初始target来自 --dashboard-target 或配置文件中的 dashboard.targets
+func startDashboard(cmd *cobra.Command, server *qbtServer, secret string) {
+	targets, _ := cmd.Flags().GetStringSlice("dashboard-target")
+	interval, _ := cmd.Flags().GetFloat64("dashboard-interval")
+	timeout, _ := cmd.Flags().GetFloat64("dashboard-timeout")
+	if len(targets) == 0 {
+		targets = viper.GetStringSlice("dashboard.targets")
+	}
+	d := newDashboard(secret, time.Duration(interval*1000)*time.Millisecond, time.Duration(timeout*1000)*time.Millisecond)
+	for _, target := range targets {
+		if err := d.addTarget(target); err != nil {
+			fmt.Println("dashboard error:", err)
+		}
+	}
+	d.register(server.mux)
+	if setupStore(cmd) != nil {
+		go func() {
+			for range time.Tick(10 * time.Second) {
+				flushStore()
+			}
+		}()
+	}
+}
@@ -0,0 +1,139 @@
+package cmd
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDashboard(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			_ = conn.Close()
+		}
+	}()
+
+	path := filepath.Join(t.TempDir(), "qbt.db")
+	probeStore = newResultStore(path)
+	defer func() { probeStore = nil }()
+
+	d := newDashboard("s3cret", 20*time.Millisecond, time.Second)
+	mux := http.NewServeMux()
+	d.register(mux)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/")
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	_ = resp.Body.Close()
+
+	events, err := http.Get(server.URL + "/api/events")
+	assert.Nil(t, err)
+	defer events.Body.Close()
+	assert.Equal(t, "text/event-stream", events.Header.Get("Content-Type"))
+
+	target := ln.Addr().String()
+	resp, err = http.PostForm(server.URL+"/api/targets", url.Values{"target": {target}})
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	_ = resp.Body.Close()
+	req, _ := http.NewRequest(http.MethodPost, server.URL+"/api/targets", strings.NewReader("target="+target))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Authorization", "Bearer s3cret")
+	resp, err = http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	_ = resp.Body.Close()
+
+	//SSE推送探测结果
+	reader := bufio.NewReader(events.Body)
+	var probe dashboardProbe
+	for {
+		line, err := reader.ReadString('\n')
+		assert.Nil(t, err)
+		if strings.HasPrefix(line, "data: ") {
+			assert.Nil(t, json.Unmarshal([]byte(line[6:]), &probe))
+			break
+		}
+	}
+	assert.Equal(t, target, probe.Target)
+	assert.False(t, probe.Loss)
+
+	time.Sleep(100 * time.Millisecond)
+	list := d.list()
+	assert.Equal(t, 1, len(list))
+	assert.Greater(t, list[0].Count, 1)
+
+	req, _ = http.NewRequest(http.MethodDelete, server.URL+"/api/targets?target="+target, nil)
+	req.Header.Set("Authorization", "Bearer s3cret")
+	resp, err = http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	_ = resp.Body.Close()
+	assert.Equal(t, 0, len(d.list()))
+
+	//历史数据来自store
+	assert.Nil(t, probeStore.flush())
+	resp, err = http.Get(server.URL + "/api/history?interval=0s&target=" + url.QueryEscape(target))
+	assert.Nil(t, err)
+	var rows []queryRow
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&rows))
+	_ = resp.Body.Close()
+	assert.Equal(t, 1, len(rows))
+	assert.GreaterOrEqual(t, rows[0].Count, list[0].Count)
+}
+
+func TestDashboardTargets(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"10.0.0.1:22", "10.0.0.1:22"},
+		{" [2001:DB8:0::1]:443 ", "[2001:db8::1]:443"},
+		{"[::ffff:10.0.0.1]:22", "10.0.0.1:22"},
+		{"gw.example.com:80", "gw.example.com:80"},
+	}
+	for _, tt := range tests {
+		got, err := normalizeTarget(tt.in)
+		assert.Nil(t, err, tt.in)
+		assert.Equal(t, tt.want, got, tt.in)
+	}
+	for _, bad := range []string{"10.0.0.1", ":22", "10.0.0.1:", ""} {
+		_, err := normalizeTarget(bad)
+		assert.NotNil(t, err, bad)
+	}
+
+	//删除时写法和添加时不同也能找到
+	d := newDashboard("s3cret", time.Hour, 10*time.Millisecond)
+	assert.Nil(t, d.addTarget("[2001:db8::1]:443"))
+	assert.True(t, d.removeTarget("[2001:DB8:0:0::1]:443"))
+	assert.False(t, d.removeTarget("[2001:db8::1]:443"))
+
+	//没有配置密钥时不允许修改target
+	open := newDashboard("", time.Hour, 10*time.Millisecond)
+	mux := http.NewServeMux()
+	open.register(mux)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	resp, err := http.PostForm(server.URL+"/api/targets", url.Values{"target": {"10.0.0.1:22"}})
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	_ = resp.Body.Close()
+	assert.Empty(t, open.list())
+}
@@ -0,0 +1,199 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// serverStats qbt serve 各个应答服务的统计，字段用atomic读写
+type serverStats struct {
+	StartedAt        time.Time `json:"started_at"`
+	TcpActive        int64     `json:"tcp_active"`        // 当前TCP连接数
+	TcpAccepted      int64     `json:"tcp_accepted"`      // 累计接受的TCP连接
+	TcpRejected      int64     `json:"tcp_rejected"`      // 超过连接数限制被拒绝的连接
+	TcpBytes         int64     `json:"tcp_bytes"`         // TCP echo回写的字节数
+	UdpEchoPackets   int64     `json:"udp_echo_packets"`  // UDP echo回写的报文数
+	ReflectorPackets int64     `json:"reflector_packets"` // 时间戳反射的报文数
+	InvalidPackets   int64     `json:"invalid_packets"`   // 格式错误的报文数
+	AuthFailures     int64     `json:"auth_failures"`     // 鉴权失败次数
+	ThroughputBytes  int64     `json:"throughput_bytes"`  // 吞吐测试收到的字节数
+}
+
+// qbtServer qbt serve 的配置和运行状态
+type qbtServer struct {
+	secret   string         // 共享密钥，为空时不鉴权
+	maxConns int64          // TCP最大并发连接数，0表示不限制
+	timeout  time.Duration  // 鉴权等握手阶段的超时
+	clock    *clockTracker  // 参考时钟，为nil时反射报文不带时钟偏差
+	mux      *http.ServeMux // --stats 监听的HTTP接口
+	stats    serverStats
+}
+
+func newQbtServer(secret string, maxConns int) *qbtServer {
+	return &qbtServer{
+		secret:   secret,
+		maxConns: int64(maxConns),
+		timeout:  5 * time.Second,
+		mux:      http.NewServeMux(),
+		stats:    serverStats{StartedAt: time.Now()},
+	}
+}
+
+// snapshot 读取当前统计的一份拷贝
+func (s *qbtServer) snapshot() serverStats {
+	return serverStats{
+		StartedAt:        s.stats.StartedAt,
+		TcpActive:        atomic.LoadInt64(&s.stats.TcpActive),
+		TcpAccepted:      atomic.LoadInt64(&s.stats.TcpAccepted),
+		TcpRejected:      atomic.LoadInt64(&s.stats.TcpRejected),
+		TcpBytes:         atomic.LoadInt64(&s.stats.TcpBytes),
+		UdpEchoPackets:   atomic.LoadInt64(&s.stats.UdpEchoPackets),
+		ReflectorPackets: atomic.LoadInt64(&s.stats.ReflectorPackets),
+		InvalidPackets:   atomic.LoadInt64(&s.stats.InvalidPackets),
+		AuthFailures:     atomic.LoadInt64(&s.stats.AuthFailures),
+		ThroughputBytes:  atomic.LoadInt64(&s.stats.ThroughputBytes),
+	}
+}
+
+// serveTcpEcho 监听TCP端口，把收到的数据原样写回，供 tcp-ping --persistent 测量长连接RTT
+func (s *qbtServer) serveTcpEcho(address string) error {
+	ln, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	fmt.Println("tcp echo listening on", ln.Addr())
+	return s.acceptTcpEcho(ln)
+}
+
+func (s *qbtServer) acceptTcpEcho(ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		active := atomic.AddInt64(&s.stats.TcpActive, 1)
+		if s.maxConns > 0 && active > s.maxConns {
+			atomic.AddInt64(&s.stats.TcpActive, -1)
+			atomic.AddInt64(&s.stats.TcpRejected, 1)
+			_ = conn.Close()
+			continue
+		}
+		atomic.AddInt64(&s.stats.TcpAccepted, 1)
+		go s.handleTcpEcho(conn)
+	}
+}
+
+func (s *qbtServer) handleTcpEcho(conn net.Conn) {
+	defer func() {
+		_ = conn.Close()
+		atomic.AddInt64(&s.stats.TcpActive, -1)
+	}()
+	if s.secret != "" {
+		if err := authChallenge(conn, s.secret, s.timeout); err != nil {
+			atomic.AddInt64(&s.stats.AuthFailures, 1)
+			fmt.Println("tcp echo", conn.RemoteAddr(), "auth error:", err)
+			return
+		}
+	}
+	n, err := io.Copy(conn, conn)
+	atomic.AddInt64(&s.stats.TcpBytes, n)
+	if err != nil {
+		fmt.Println("tcp echo", conn.RemoteAddr(), "error:", err)
+	}
+}
+
+// serveUdpEcho 把收到的UDP报文原样发回，配置了密钥时只回复签名正确的报文
+func (s *qbtServer) serveUdpEcho(address string) error {
+	conn, err := net.ListenPacket("udp", address)
+	if err != nil {
+		return err
+	}
+	fmt.Println("udp echo listening on", conn.LocalAddr())
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		if s.secret != "" && !verifyDatagram(s.secret, buf[:n]) {
+			atomic.AddInt64(&s.stats.AuthFailures, 1)
+			continue
+		}
+		if _, err = conn.WriteTo(buf[:n], addr); err != nil {
+			fmt.Println("udp echo", addr, "error:", err)
+			continue
+		}
+		atomic.AddInt64(&s.stats.UdpEchoPackets, 1)
+	}
+}
+
+// serveReflector 时间戳反射：在报文中填入收到时间t2和发回时间t3，用于时钟偏差和单向时延测量
+func (s *qbtServer) serveReflector(address string) error {
+	conn, err := net.ListenPacket("udp", address)
+	if err != nil {
+		return err
+	}
+	fmt.Println("timestamp reflector listening on", conn.LocalAddr())
+	return s.reflect(conn)
+}
+
+func (s *qbtServer) reflect(conn net.PacketConn) error {
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		t2 := time.Now()
+		if err != nil {
+			return err
+		}
+		if s.secret != "" && !verifyDatagram(s.secret, buf[:n]) {
+			atomic.AddInt64(&s.stats.AuthFailures, 1)
+			continue
+		}
+		//签名在报文末尾，反射报文的字段只在签名之前的部分
+		body := buf[:n]
+		if s.secret != "" {
+			body = buf[:n-authMacLen]
+		}
+		var p reflectorPacket
+		if err = p.unmarshal(body); err != nil {
+			atomic.AddInt64(&s.stats.InvalidPackets, 1)
+			continue
+		}
+		p.t2 = t2.UnixNano()
+		p.flags &^= reflectorFlagSynced
+		if s.clock != nil {
+			if offset, errBound, ok := s.clock.current(); ok {
+				p.flags |= reflectorFlagSynced
+				p.refOffset, p.refError = int64(offset), int64(errBound)
+			}
+		}
+		p.t3 = time.Now().UnixNano()
+		p.marshal(body)
+		if s.secret != "" {
+			signDatagram(s.secret, buf[:n])
+		}
+		if _, err = conn.WriteTo(buf[:n], addr); err != nil {
+			fmt.Println("reflector", addr, "error:", err)
+			continue
+		}
+		atomic.AddInt64(&s.stats.ReflectorPackets, 1)
+	}
+}
+
+// serveStats 提供HTTP接口，GET /stats 返回统计，其他功能也把接口注册在s.mux上
+func (s *qbtServer) serveStats(address string) error {
+	s.mux.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, s.snapshot())
+	})
+	fmt.Println("stats listening on", address)
+	return http.ListenAndServe(address, s.mux)
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = fmt.Fprintln(w, Marshal(v))
+}
@@ -0,0 +1,76 @@
+package cmd
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func startTcpEcho(t *testing.T, s *qbtServer) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	t.Cleanup(func() { _ = ln.Close() })
+	go func() { _ = s.acceptTcpEcho(ln) }()
+	return ln.Addr().String()
+}
+
+func TestTcpEchoAuth(t *testing.T) {
+	s := newQbtServer("s3cret", 0)
+	address := startTcpEcho(t, s)
+
+	session := newTcpEchoSession(address, time.Second, 32, "s3cret")
+	defer session.close()
+	rtt, err := session.probe()
+	assert.Nil(t, err)
+	assert.True(t, rtt > 0)
+
+	//密钥错误时服务端会断开连接
+	bad := newTcpEchoSession(address, time.Second, 32, "wrong")
+	defer bad.close()
+	_, err = bad.probe()
+	assert.NotNil(t, err)
+	assert.Eventually(t, func() bool {
+		return atomic.LoadInt64(&s.stats.AuthFailures) == 1
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestTcpEchoMaxConns(t *testing.T) {
+	s := newQbtServer("", 1)
+	address := startTcpEcho(t, s)
+
+	first := newTcpEchoSession(address, time.Second, 16, "")
+	defer first.close()
+	_, err := first.probe()
+	assert.Nil(t, err)
+
+	second := newTcpEchoSession(address, time.Second, 16, "")
+	defer second.close()
+	_, err = second.probe()
+	assert.NotNil(t, err)
+	assert.Equal(t, int64(1), s.snapshot().TcpRejected)
+}
+
+func TestReflector(t *testing.T) {
+	s := newQbtServer("s3cret", 0)
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer pc.Close()
+	go func() { _ = s.reflect(pc) }()
+
+	conn, err := net.Dial("udp", pc.LocalAddr().String())
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	p, t4, err := reflectorProbe(conn, 7, 64, "s3cret", time.Second)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(7), p.seq)
+	assert.True(t, p.t1 <= p.t2 && p.t2 <= p.t3 && p.t3 <= t4.UnixNano())
+
+	//未签名的报文不会被反射
+	_, _, err = reflectorProbe(conn, 8, 64, "", 200*time.Millisecond)
+	assert.NotNil(t, err)
+	assert.Equal(t, int64(1), s.snapshot().AuthFailures)
+}
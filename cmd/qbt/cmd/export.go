@@ -0,0 +1,305 @@
+package cmd
+
+import (
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/qbtrade/qbt/cmd/qbt/cf"
+	"github.com/spf13/cobra"
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/writer"
+)
+
+// parquetProbe parquet文件中一次探测的schema，ts为UTC纳秒时间戳
+type parquetProbe struct {
+	Ts     int64   `parquet:"name=ts, type=INT64, logicaltype=TIMESTAMP, logicaltype.isadjustedtoutc=true, logicaltype.unit=NANOS"`
+	Host   string  `parquet:"name=host, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	Target string  `parquet:"name=target, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	Ip     string  `parquet:"name=ip, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	Port   int32   `parquet:"name=port, type=INT32"`
+	Kind   string  `parquet:"name=kind, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	Rtt    float64 `parquet:"name=rtt_ms, type=DOUBLE"`
+	Loss   bool    `parquet:"name=loss, type=BOOLEAN"`
+}
+
+func newParquetProbe(p storedProbe) (parquetProbe, error) {
+	//grpc-ping的target是 ip:port/service
+	address, _, _ := strings.Cut(p.Target, "/")
+	ip, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return parquetProbe{}, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return parquetProbe{}, err
+	}
+	return parquetProbe{Ts: p.Ts.UnixNano(), Host: p.Host, Target: p.Target, Ip: ip, Port: int32(port),
+		Kind: p.Kind, Rtt: p.Rtt, Loss: p.Loss}, nil
+}
+
+type parquetPartition struct {
+	file   *os.File
+	writer *writer.ParquetWriter
+	rows   int
+}
+
+// parquetExporter 按 date=YYYY-MM-DD/target=IP_PORT 分区写parquet，日期按UTC划分
+type parquetExporter struct {
+	dir        string
+	name       string // 分区内的文件名
+	partitions map[string]*parquetPartition
+}
+
+func newParquetExporter(dir, name string) *parquetExporter {
+	return &parquetExporter{dir: dir, name: name, partitions: map[string]*parquetPartition{}}
+}
+
+func (e *parquetExporter) partitionDir(p parquetProbe) string {
+	date := time.Unix(0, p.Ts).UTC().Format("2006-01-02")
+	target := strings.NewReplacer(":", "_", "[", "", "]", "", "/", "_").Replace(p.Target)
+	return filepath.Join(e.dir, "date="+date, "target="+target)
+}
+
+func (e *parquetExporter) write(p parquetProbe) error {
+	dir := e.partitionDir(p)
+	partition, ok := e.partitions[dir]
+	if !ok {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+		file, err := os.Create(filepath.Join(dir, e.name))
+		if err != nil {
+			return err
+		}
+		pw, err := writer.NewParquetWriterFromWriter(file, new(parquetProbe), 1)
+		if err != nil {
+			_ = file.Close()
+			return err
+		}
+		pw.CompressionType = parquet.CompressionCodec_SNAPPY
+		partition = &parquetPartition{file: file, writer: pw}
+		e.partitions[dir] = partition
+	}
+	partition.rows++
+	return partition.writer.Write(p)
+}
+
+// close 写入所有分区的footer，返回每个分区的行数
+func (e *parquetExporter) close() (map[string]int, error) {
+	rows := map[string]int{}
+	var firstErr error
+	for dir, partition := range e.partitions {
+		err := partition.writer.WriteStop()
+		if closeErr := partition.file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("%s: %w", dir, err)
+		}
+		rows[dir] = partition.rows
+	}
+	return rows, firstErr
+}
+
+// isSummaryCsvHeader 判断是否是 *_summary_*.csv 汇总文件的表头
+func isSummaryCsvHeader(record []string) bool {
+	if len(record) == 0 || record[0] != tcpPingSummaryCsvHeader[0] {
+		return false
+	}
+	for _, column := range record {
+		if column == "count" {
+			return true
+		}
+	}
+	return false
+}
+
+// readTcpPingCsv 读取tcp-ping、tcp-echo、grpc-ping的csv文件(可以是.gz)，按表头取列，跳过旧版本的空分隔行
+func readTcpPingCsv(filename string, fn func(p storedProbe) error) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	var r io.Reader = file
+	if strings.HasSuffix(filename, ".gz") {
+		zr, err := gzip.NewReader(file)
+		if err != nil {
+			return err
+		}
+		r = zr
+	}
+	kind := "tcp_ping"
+	switch base := filepath.Base(filename); {
+	case strings.Contains(base, "_tcp_echo"):
+		kind = "tcp_echo"
+	case strings.Contains(base, "_grpc_ping"):
+		kind = "grpc_ping"
+	}
+	//没有表头的旧文件按tcp-ping的列顺序读
+	cols, last := csvColumns(tcpPingCsvHeader)
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	for line := 1; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		//汇总文件也匹配 host_tcp_ping_*.csv，count、loss等列不是探测结果，跳过整个文件
+		if isSummaryCsvHeader(record) {
+			fmt.Println("skip summary csv", filename)
+			return nil
+		}
+		//按表头的列名取值，grpc-ping在port后面多了service和status两列
+		if len(record) > 0 && record[0] == tcpPingCsvHeader[0] {
+			if cols, last = csvColumns(record); last < 0 {
+				return fmt.Errorf("%s line %d: not a probe csv, header %v", filename, line, record)
+			}
+			if _, ok := cols["service"]; ok {
+				kind = "grpc_ping"
+			}
+			continue
+		}
+		if len(record) <= last {
+			continue
+		}
+		ms, errTs := strconv.ParseInt(record[cols["ts"]], 10, 64)
+		rtt, errRtt := strconv.ParseFloat(record[cols["rtt"]], 64)
+		loss, errLoss := strconv.ParseBool(record[cols["loss"]])
+		if errTs != nil || errRtt != nil || errLoss != nil {
+			return fmt.Errorf("%s line %d: invalid row %v", filename, line, record)
+		}
+		//和tcpInformation.target()一致，grpc-ping的target带/service
+		target := net.JoinHostPort(record[cols["ip"]], record[cols["port"]])
+		if i, ok := cols["service"]; ok && i < len(record) && record[i] != "" {
+			target += "/" + record[i]
+		}
+		err = fn(storedProbe{Ts: time.UnixMilli(ms), Host: record[cols["hostname"]], Target: target,
+			Kind: kind, Rtt: rtt, Loss: loss})
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// csvColumns 表头的列名到下标，last为必需列中最大的下标，缺少必需列时为-1
+func csvColumns(header []string) (map[string]int, int) {
+	cols := make(map[string]int, len(header))
+	for i, name := range header {
+		cols[name] = i
+	}
+	last := -1
+	for _, name := range tcpPingCsvHeader {
+		i, ok := cols[name]
+		if !ok {
+			return cols, -1
+		}
+		last = cf.Max(last, i)
+	}
+	return cols, last
+}
+
+var exportCmd = &cobra.Command{
+	Use:   "export [csv files...]",
+	Short: "export probe recordings to parquet",
+	Long: `export tcp-ping csv recordings (.csv or .csv.gz) or the --store database to parquet files,
+partitioned as <out>/date=YYYY-MM-DD/target=IP_PORT/<name>.parquet with the date in UTC.
+Schema: ts (timestamp ns, utc), host, target, ip, port, kind, rtt_ms, loss.
+The ts of csv recordings only has millisecond precision, grpc-ping recordings have kind grpc_ping and
+target IP:PORT/SERVICE. Summary csv files are skipped.
+For example:
+qbt export --parquet --out /data/parquet host_tcp_ping_*.csv.gz
+qbt export --parquet --out /data/parquet --store qbt.db --from -24h`,
+	Args: func(cmd *cobra.Command, args []string) error {
+		if p, _ := cmd.Flags().GetBool("parquet"); !p {
+			return fmt.Errorf("only --parquet is supported")
+		}
+		storePath, _ := cmd.Flags().GetString("store")
+		if storePath == "" && len(args) == 0 {
+			return fmt.Errorf("no csv files or --store to export")
+		}
+		return nil
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		out, _ := cmd.Flags().GetString("out")
+		name, _ := cmd.Flags().GetString("name")
+		storePath, _ := cmd.Flags().GetString("store")
+		fromStr, _ := cmd.Flags().GetString("from")
+		toStr, _ := cmd.Flags().GetString("to")
+		targets, _ := cmd.Flags().GetStringSlice("target")
+		if name == "" {
+			hostname, _ := os.Hostname()
+			name = hostname + "_" + time.Now().Format("20060102150405")
+		}
+		exporter := newParquetExporter(out, name+".parquet")
+		write := func(p storedProbe) error {
+			row, err := newParquetProbe(p)
+			if err != nil {
+				return err
+			}
+			return exporter.write(row)
+		}
+
+		var err error
+		if storePath != "" {
+			now := time.Now()
+			from, errFrom := parseQueryTime(fromStr, now)
+			to, errTo := parseQueryTime(toStr, now)
+			if errFrom != nil || errTo != nil {
+				fmt.Println("parse time error:", errFrom, errTo)
+				return
+			}
+			err = storeScan(storePath, storeProbesBucket, targetMatcher(targets), from, to,
+				func(target string, value []byte) error {
+					var p storedProbe
+					if err := json.Unmarshal(value, &p); err != nil {
+						return err
+					}
+					return write(p)
+				})
+		}
+		for _, filename := range args {
+			if err != nil {
+				break
+			}
+			err = readTcpPingCsv(filename, write)
+		}
+		rows, errClose := exporter.close()
+		if err != nil || errClose != nil {
+			fmt.Println("export error:", err, errClose)
+			return
+		}
+		dirs := make([]string, 0, len(rows))
+		for dir := range rows {
+			dirs = append(dirs, dir)
+		}
+		sort.Strings(dirs)
+		for _, dir := range dirs {
+			fmt.Printf("%s/%s: %d rows\n", dir, name+".parquet", rows[dir])
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(exportCmd)
+	exportCmd.Flags().Bool("parquet", false, "export to parquet files")
+	exportCmd.Flags().String("out", ".", "output directory")
+	exportCmd.Flags().String("name", "", "file name inside each partition (default hostname_timestamp)")
+	exportCmd.Flags().String("store", "", "export from this database written by tcp-ping --store")
+	exportCmd.Flags().String("from", "-24h", "start time when exporting from --store")
+	exportCmd.Flags().String("to", "now", "end time when exporting from --store")
+	exportCmd.Flags().StringSlice("target", nil, "only these targets when exporting from --store (wildcards allowed)")
+}
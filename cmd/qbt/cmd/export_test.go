@@ -0,0 +1,108 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/xitongsys/parquet-go-source/buffer"
+	"github.com/xitongsys/parquet-go/reader"
+)
+
+func TestParquetExport(t *testing.T) {
+	dir := t.TempDir()
+	csvFile := filepath.Join(dir, "host_tcp_echo_2026101908.csv")
+	content := "ts,hostname,ip,port,rtt,loss\n" +
+		"1792368000123,host,10.0.0.1,22,0.5000,false\n" +
+		"\n" +
+		"1792368001123,host,10.0.0.1,22,2000.0000,true\n" +
+		"1792454400000,host,10.0.0.2,80,1.2500,false\n"
+	assert.Nil(t, os.WriteFile(csvFile, []byte(content), 0644))
+	assert.Nil(t, gzipFile(csvFile))
+
+	out := filepath.Join(dir, "parquet")
+	exporter := newParquetExporter(out, "part.parquet")
+	err := readTcpPingCsv(csvFile+".gz", func(p storedProbe) error {
+		row, err := newParquetProbe(p)
+		if err != nil {
+			return err
+		}
+		return exporter.write(row)
+	})
+	assert.Nil(t, err)
+	rows, err := exporter.close()
+	assert.Nil(t, err)
+	first := filepath.Join(out, "date=2026-10-19", "target=10.0.0.1_22")
+	assert.Equal(t, map[string]int{first: 2, filepath.Join(out, "date=2026-10-20", "target=10.0.0.2_80"): 1}, rows)
+
+	data, err := os.ReadFile(filepath.Join(first, "part.parquet"))
+	assert.Nil(t, err)
+	pf, err := buffer.NewBufferFile(data)
+	assert.Nil(t, err)
+	pr, err := reader.NewParquetReader(pf, new(parquetProbe), 1)
+	assert.Nil(t, err)
+	defer pr.ReadStop()
+	assert.Equal(t, int64(2), pr.GetNumRows())
+	probes := make([]parquetProbe, 2)
+	assert.Nil(t, pr.Read(&probes))
+	assert.Equal(t, time.UnixMilli(1792368000123).UnixNano(), probes[0].Ts)
+	assert.Equal(t, "tcp_echo", probes[0].Kind)
+	assert.Equal(t, int32(22), probes[0].Port)
+	assert.Equal(t, 0.5, probes[0].Rtt)
+	assert.True(t, probes[1].Loss)
+}
+
+func TestReadTcpPingCsvSkipsSummary(t *testing.T) {
+	dir := t.TempDir()
+	//汇总文件也匹配 host_tcp_ping_*.csv
+	summary := filepath.Join(dir, "host_tcp_ping_summary_2026101908.csv")
+	content := strings.Join(tcpPingSummaryCsvHeader, ",") + "\n" +
+		"1792368000123,host,10.0.0.1,22,100,1,0.5,0.1,0.4,0.9,1.2,0.2,0.1,0.3\n"
+	assert.Nil(t, os.WriteFile(summary, []byte(content), 0644))
+	var probes []storedProbe
+	err := readTcpPingCsv(summary, func(p storedProbe) error {
+		probes = append(probes, p)
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Empty(t, probes)
+	assert.False(t, isSummaryCsvHeader(tcpPingCsvHeader))
+	assert.False(t, isSummaryCsvHeader(nil))
+}
+
+func TestReadGrpcPingCsv(t *testing.T) {
+	dir := t.TempDir()
+	csvFile := filepath.Join(dir, "host_grpc_ping_2026101908.csv")
+	content := strings.Join(grpcPingCsvHeader, ",") + "\n" +
+		"1792368000123,host,10.0.0.1,50051,health,SERVING,0.7500,false\n" +
+		"1792368001123,host,10.0.0.1,50051,,UNKNOWN,0.0000,true\n"
+	assert.Nil(t, os.WriteFile(csvFile, []byte(content), 0644))
+	var probes []storedProbe
+	err := readTcpPingCsv(csvFile, func(p storedProbe) error {
+		probes = append(probes, p)
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(probes))
+	assert.Equal(t, "grpc_ping", probes[0].Kind)
+	assert.Equal(t, "10.0.0.1:50051/health", probes[0].Target)
+	assert.Equal(t, "host", probes[0].Host)
+	assert.Equal(t, 0.75, probes[0].Rtt)
+	assert.Equal(t, "10.0.0.1:50051", probes[1].Target)
+	assert.True(t, probes[1].Loss)
+
+	row, err := newParquetProbe(probes[0])
+	assert.Nil(t, err)
+	assert.Equal(t, "10.0.0.1", row.Ip)
+	assert.Equal(t, int32(50051), row.Port)
+	assert.Equal(t, "10.0.0.1:50051/health", row.Target)
+
+	//不是探测结果的csv
+	other := filepath.Join(dir, "host_grpc_ping_other.csv")
+	assert.Nil(t, os.WriteFile(other, []byte("ts,hostname,ip\n1,host,10.0.0.1\n"), 0644))
+	err = readTcpPingCsv(other, func(p storedProbe) error { return nil })
+	assert.NotNil(t, err)
+}
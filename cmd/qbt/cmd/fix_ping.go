@@ -0,0 +1,454 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"time"
+
+	"github.com/qbtrade/qbt/cmd/qbt/cf"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+const fixSOH = '\x01'
+
+// fixField 一个FIX字段 tag=value
+type fixField struct {
+	tag   int
+	value string
+}
+
+// fixMessage 按顺序保存的字段，不包含BeginString(8)、BodyLength(9)和CheckSum(10)
+type fixMessage []fixField
+
+func (m fixMessage) get(tag int) string {
+	for _, f := range m {
+		if f.tag == tag {
+			return f.value
+		}
+	}
+	return ""
+}
+
+func (m fixMessage) msgType() string {
+	return m.get(35)
+}
+
+// encodeFix 加上BeginString、BodyLength和CheckSum
+func encodeFix(beginString string, body fixMessage) []byte {
+	var b bytes.Buffer
+	for _, f := range body {
+		b.WriteString(strconv.Itoa(f.tag))
+		b.WriteByte('=')
+		b.WriteString(f.value)
+		b.WriteByte(fixSOH)
+	}
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "8=%s%c9=%d%c", beginString, fixSOH, b.Len(), fixSOH)
+	msg.Write(b.Bytes())
+	sum := 0
+	for _, c := range msg.Bytes() {
+		sum += int(c)
+	}
+	fmt.Fprintf(&msg, "10=%03d%c", sum%256, fixSOH)
+	return msg.Bytes()
+}
+
+// readFix 读取一条完整的消息并校验BodyLength和CheckSum
+func readFix(r *bufio.Reader) (fixMessage, error) {
+	var raw bytes.Buffer
+	readField := func(tag string) (string, error) {
+		field, err := r.ReadString(fixSOH)
+		if err != nil {
+			return "", err
+		}
+		raw.WriteString(field)
+		if len(field) < len(tag)+2 || field[:len(tag)+1] != tag+"=" {
+			return "", fmt.Errorf("fix: want tag %s, got %q", tag, field)
+		}
+		return field[len(tag)+1 : len(field)-1], nil
+	}
+	if _, err := readField("8"); err != nil {
+		return nil, err
+	}
+	lengthStr, err := readField("9")
+	if err != nil {
+		return nil, err
+	}
+	length, err := strconv.Atoi(lengthStr)
+	if err != nil || length <= 0 || length > 1<<20 {
+		return nil, fmt.Errorf("fix: bad body length %q", lengthStr)
+	}
+	body := make([]byte, length)
+	if _, err = io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	raw.Write(body)
+	sum := 0
+	for _, c := range raw.Bytes() {
+		sum += int(c)
+	}
+	checksum, err := readField("10")
+	if err != nil {
+		return nil, err
+	}
+	if checksum != fmt.Sprintf("%03d", sum%256) {
+		return nil, fmt.Errorf("fix: bad checksum %s", checksum)
+	}
+	var m fixMessage
+	for _, field := range bytes.Split(bytes.TrimSuffix(body, []byte{fixSOH}), []byte{fixSOH}) {
+		i := bytes.IndexByte(field, '=')
+		tag, err := strconv.Atoi(string(field[:cf.Max(i, 0)]))
+		if i < 0 || err != nil {
+			return nil, fmt.Errorf("fix: bad field %q", field)
+		}
+		m = append(m, fixField{tag, string(field[i+1:])})
+	}
+	return m, nil
+}
+
+// fixConfig 会话参数，命令行参数优先，否则读取配置文件中的 fix.*
+type fixConfig struct {
+	BeginString  string
+	SenderCompID string
+	TargetCompID string
+	Username     string
+	Password     string
+	HeartBtInt   int
+	ResetSeqNum  bool // Logon带141=Y，双方序号从1开始
+	SeqNum       int  // 不重置序号时下一个发出的序号
+	TLS          bool
+}
+
+func fixConfigFromFlags(cmd *cobra.Command) fixConfig {
+	str := func(flag, key string) string {
+		v, _ := cmd.Flags().GetString(flag)
+		if v == "" {
+			v = viper.GetString(key)
+		}
+		return v
+	}
+	c := fixConfig{
+		BeginString:  str("begin-string", "fix.begin_string"),
+		SenderCompID: str("sender", "fix.sender_comp_id"),
+		TargetCompID: str("target", "fix.target_comp_id"),
+		Username:     str("username", "fix.username"),
+		Password:     str("password", "fix.password"),
+		ResetSeqNum:  true,
+		SeqNum:       1,
+	}
+	c.HeartBtInt, _ = cmd.Flags().GetInt("heartbeat")
+	c.TLS, _ = cmd.Flags().GetBool("tls")
+	if viper.IsSet("fix.reset_seq_num") {
+		c.ResetSeqNum = viper.GetBool("fix.reset_seq_num")
+	}
+	if viper.IsSet("fix.seq_num") {
+		c.SeqNum = viper.GetInt("fix.seq_num")
+	}
+	if cmd.Flags().Changed("seq-num") {
+		c.SeqNum, _ = cmd.Flags().GetInt("seq-num")
+		c.ResetSeqNum = false
+	}
+	if c.BeginString == "" {
+		c.BeginString = "FIX.4.4"
+	}
+	return c
+}
+
+// errFixSession 对端拒绝或登出，需要重新登录
+var errFixSession = errors.New("fix session closed by peer")
+
+// fixSession 发起方的FIX会话，只处理会话层消息
+type fixSession struct {
+	cfg     fixConfig
+	conn    net.Conn
+	reader  *bufio.Reader
+	timeout time.Duration
+	seq     int // 下一个发出的序号
+	testReq int
+}
+
+func dialFix(address string, cfg fixConfig, timeout time.Duration) (*fixSession, error) {
+	dialer := &net.Dialer{Timeout: timeout}
+	var conn net.Conn
+	var err error
+	if cfg.TLS {
+		host, _, _ := net.SplitHostPort(address)
+		conn, err = tls.DialWithDialer(dialer, "tcp", address, &tls.Config{ServerName: host})
+	} else {
+		conn, err = dialer.Dial("tcp", address)
+	}
+	if err != nil {
+		return nil, err
+	}
+	seq := cfg.SeqNum
+	if cfg.ResetSeqNum {
+		seq = 1
+	}
+	return &fixSession{cfg: cfg, conn: conn, reader: bufio.NewReader(conn), timeout: timeout, seq: seq}, nil
+}
+
+// sendSeq 用指定的序号发送，seq为0时使用下一个序号
+func (s *fixSession) sendSeq(seq int, msgType string, fields ...fixField) error {
+	if seq == 0 {
+		seq = s.seq
+		s.seq++
+	}
+	body := fixMessage{
+		{35, msgType},
+		{49, s.cfg.SenderCompID},
+		{56, s.cfg.TargetCompID},
+		{34, strconv.Itoa(seq)},
+		{52, time.Now().UTC().Format("20060102-15:04:05.000")},
+	}
+	_ = s.conn.SetWriteDeadline(time.Now().Add(s.timeout))
+	_, err := s.conn.Write(encodeFix(s.cfg.BeginString, append(body, fields...)))
+	return err
+}
+
+func (s *fixSession) send(msgType string, fields ...fixField) error {
+	return s.sendSeq(0, msgType, fields...)
+}
+
+// await 等待满足条件的消息，期间回应对端的TestRequest和ResendRequest
+func (s *fixSession) await(match func(fixMessage) bool) (fixMessage, error) {
+	_ = s.conn.SetReadDeadline(time.Now().Add(s.timeout))
+	for {
+		m, err := readFix(s.reader)
+		if err != nil {
+			return nil, err
+		}
+		if match(m) {
+			return m, nil
+		}
+		switch m.msgType() {
+		case "1": // TestRequest
+			err = s.send("0", fixField{112, m.get(112)})
+		case "2": // ResendRequest，不重发业务消息，用GapFill跳过
+			begin, _ := strconv.Atoi(m.get(7))
+			err = s.sendSeq(cf.Max(begin, 1), "4", fixField{43, "Y"}, fixField{123, "Y"},
+				fixField{36, strconv.Itoa(s.seq)})
+		case "3": // Reject
+			return m, fmt.Errorf("fix reject: %s", m.get(58))
+		case "5": // Logout
+			return m, fmt.Errorf("%w: logout %s", errFixSession, m.get(58))
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// resume 关闭连接，返回重连用的配置，不重置序号时从当前序号继续，否则对端会因序号过小而登出
+func (s *fixSession) resume() fixConfig {
+	_ = s.conn.Close()
+	cfg := s.cfg
+	cfg.SeqNum = s.seq
+	return cfg
+}
+
+// logon 发送Logon并等待对端的Logon
+func (s *fixSession) logon() (time.Duration, error) {
+	fields := []fixField{{98, "0"}, {108, strconv.Itoa(s.cfg.HeartBtInt)}}
+	if s.cfg.ResetSeqNum {
+		fields = append(fields, fixField{141, "Y"})
+	}
+	if s.cfg.Username != "" {
+		fields = append(fields, fixField{553, s.cfg.Username})
+	}
+	if s.cfg.Password != "" {
+		fields = append(fields, fixField{554, s.cfg.Password})
+	}
+	start := time.Now()
+	if err := s.send("A", fields...); err != nil {
+		return 0, err
+	}
+	if _, err := s.await(func(m fixMessage) bool { return m.msgType() == "A" }); err != nil {
+		return 0, err
+	}
+	return time.Since(start), nil
+}
+
+// testRequest 发送TestRequest并等待带相同TestReqID的Heartbeat
+func (s *fixSession) testRequest() (time.Duration, error) {
+	s.testReq++
+	id := fmt.Sprintf("qbt-%d-%d", s.testReq, time.Now().UnixNano())
+	start := time.Now()
+	if err := s.send("1", fixField{112, id}); err != nil {
+		return 0, err
+	}
+	_, err := s.await(func(m fixMessage) bool { return m.msgType() == "0" && m.get(112) == id })
+	return time.Since(start), err
+}
+
+// logout 发送Logout并等待对端确认，然后关闭连接
+func (s *fixSession) logout() error {
+	defer s.conn.Close()
+	if err := s.send("5"); err != nil {
+		return err
+	}
+	_, err := s.await(func(m fixMessage) bool { return m.msgType() == "5" })
+	if errors.Is(err, errFixSession) {
+		return nil
+	}
+	return err
+}
+
+func fixPoint(hostName, address, kind string, ts time.Time, rtt float64, loss bool) cf.InfluxdbPoint {
+	ip, port, _ := net.SplitHostPort(address)
+	return cf.InfluxdbPoint{
+		Measurement: "fix_ping",
+		Tags: map[string]string{
+			"host": hostName,
+			"ip":   ip,
+			"port": port,
+			"type": kind,
+		},
+		Fields: map[string]float64{
+			"rtt":  rtt,
+			"loss": map[bool]float64{true: 1, false: 0}[loss],
+		},
+		Time: ts,
+	}
+}
+
+var fixPingCmd = &cobra.Command{
+	Use:   "fix-ping",
+	Short: "measure FIX logon and heartbeat round trips",
+	Long: `log on to a FIX acceptor (35=A) and measure the logon round trip, then send a TestRequest (35=1)
+every --interval seconds and measure the round trip of the matching Heartbeat (35=0), log out (35=5)
+cleanly at the end or on Ctrl+C. The session reconnects and logs on again after errors.
+Session settings default to the config keys fix.begin_string, fix.sender_comp_id, fix.target_comp_id,
+fix.username, fix.password, fix.reset_seq_num (default true) and fix.seq_num.
+For example:
+qbt fix-ping -a 10.110.1.86:9880 --sender QBT --target GATEWAY -i 1 -c 100
+qbt fix-ping -a fix.example.com:443 --tls --username u --password p --seq-num 1024`,
+	Args: func(cmd *cobra.Command, args []string) error {
+		if address, _ := cmd.Flags().GetString("address"); address == "" {
+			return fmt.Errorf("no address to connect")
+		}
+		return nil
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		address, _ := cmd.Flags().GetString("address")
+		interval, _ := cmd.Flags().GetFloat64("interval")
+		count, _ := cmd.Flags().GetInt("count")
+		timeout, _ := cmd.Flags().GetFloat64("timeout")
+		onlySummary, _ := cmd.Flags().GetBool("only-summary")
+		cfg := fixConfigFromFlags(cmd)
+		if cfg.SenderCompID == "" || cfg.TargetCompID == "" {
+			fmt.Println("--sender and --target (or fix.sender_comp_id and fix.target_comp_id) are required")
+			return
+		}
+		if collector := setupCollector(cmd); collector != nil {
+			defer collector.close()
+		}
+		setupStore(cmd)
+		hostname, _ := os.Hostname()
+		interrupt := make(chan os.Signal, 1)
+		signal.Notify(interrupt, os.Interrupt)
+
+		var (
+			session *fixSession
+			points  []cf.InfluxdbPoint
+			rtts    = newStaticsMsg() // 只统计心跳，-c默认不限次数，不保存每次的耗时
+			lost    int
+		)
+		record := func(kind string, start time.Time, rtt time.Duration, err error) {
+			ms := float64(rtt.Nanoseconds()) / 1e6
+			if err != nil {
+				lost++
+				ms = 0
+				fmt.Printf("fix-ping (%s) %s error: %v\n", address, kind, err)
+			} else if !onlySummary {
+				fmt.Printf("fix-ping (%s) %s rtt=%.3fms\n", address, kind, ms)
+			}
+			if err == nil && kind == "test_request" {
+				rtts.add(address, ms)
+			}
+			points = append(points, fixPoint(hostname, address, kind, start, ms, err != nil))
+			if probeStore != nil {
+				probeStore.addProbe(storedProbe{Ts: start, Host: hostname, Target: address, Kind: "fix_" + kind,
+					Rtt: ms, Loss: err != nil})
+			}
+			if len(points) >= 100 {
+				points = flushInfluxPoints(points)
+				flushStore()
+			}
+		}
+
+	loop:
+		for seq := 1; seq <= count; seq++ {
+			start := time.Now()
+			if session == nil {
+				s, err := dialFix(address, cfg, time.Duration(timeout*1000)*time.Millisecond)
+				var rtt time.Duration
+				if err == nil {
+					if rtt, err = s.logon(); err != nil {
+						cfg = s.resume()
+					}
+				}
+				record("logon", start, rtt, err)
+				if err == nil {
+					session = s
+				}
+			} else {
+				rtt, err := session.testRequest()
+				record("test_request", start, rtt, err)
+				if err != nil {
+					cfg = session.resume()
+					session = nil
+				}
+			}
+			select {
+			case <-interrupt:
+				break loop
+			case <-time.After(time.Duration(interval*1000)*time.Millisecond - time.Since(start)):
+			}
+		}
+		if session != nil {
+			if err := session.logout(); err != nil {
+				fmt.Println("fix logout error:", err)
+			}
+			if !cfg.ResetSeqNum {
+				fmt.Println("next outgoing seq num:", session.seq)
+			}
+		}
+		if len(points) > 0 {
+			flushInfluxPoints(points)
+		}
+		flushStore()
+		if rtts.SuccessLength > 0 {
+			fmt.Printf("fix-ping (%s) heartbeats:%d, errors:%d, mean:%.3fms, p50:%.3fms, p99:%.3fms, max:%.3fms\n",
+				address, rtts.SuccessLength, lost, rtts.MeanCost, rtts.Percentile(50), rtts.Percentile(99), rtts.MaxCost)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(fixPingCmd)
+	fixPingCmd.Flags().StringP("address", "a", "", "HOST:PORT of the FIX acceptor")
+	fixPingCmd.Flags().Float64P("interval", "i", 1, "seconds between TestRequests")
+	fixPingCmd.Flags().IntP("count", "c", math.MaxInt, "max probes including the logon")
+	fixPingCmd.Flags().Float64P("timeout", "t", 5, "timeout in seconds of connect, logon and each TestRequest")
+	fixPingCmd.Flags().Bool("only-summary", false, "display only errors and the summary")
+	fixPingCmd.Flags().String("begin-string", "", "BeginString, default FIX.4.4 (config key fix.begin_string)")
+	fixPingCmd.Flags().String("sender", "", "SenderCompID (config key fix.sender_comp_id)")
+	fixPingCmd.Flags().String("target", "", "TargetCompID (config key fix.target_comp_id)")
+	fixPingCmd.Flags().String("username", "", "Username(553) of the Logon (config key fix.username)")
+	fixPingCmd.Flags().String("password", "", "Password(554) of the Logon (config key fix.password)")
+	fixPingCmd.Flags().Int("heartbeat", 30, "HeartBtInt(108) of the Logon in seconds")
+	fixPingCmd.Flags().Int("seq-num", 1, "next outgoing MsgSeqNum, setting it disables ResetSeqNumFlag(141) (config key fix.seq_num)")
+	fixPingCmd.Flags().Bool("tls", false, "connect with TLS")
+	addCollectorFlags(fixPingCmd)
+	addStoreFlags(fixPingCmd)
+}
@@ -0,0 +1,159 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fixAcceptorStub 测试用的FIX acceptor，只实现会话层：Logon、TestRequest、Logout，
+// 登录后先发一个TestRequest和ResendRequest检查发起方的应答
+type fixAcceptorStub struct {
+	ln       net.Listener
+	password string
+	received chan fixMessage
+}
+
+func newFixAcceptorStub(t *testing.T, password string) *fixAcceptorStub {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	stub := &fixAcceptorStub{ln: ln, password: password, received: make(chan fixMessage, 100)}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go stub.serve(conn)
+		}
+	}()
+	return stub
+}
+
+func (a *fixAcceptorStub) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	seq := 1
+	send := func(msgType string, fields ...fixField) {
+		body := append(fixMessage{{35, msgType}, {49, "STUB"}, {56, "QBT"}, {34, strconv.Itoa(seq)}}, fields...)
+		seq++
+		_, _ = conn.Write(encodeFix("FIX.4.4", body))
+	}
+	for {
+		m, err := readFix(reader)
+		if err != nil {
+			return
+		}
+		a.received <- m
+		switch m.msgType() {
+		case "A":
+			if m.get(554) != a.password {
+				send("5", fixField{58, "bad password"})
+				return
+			}
+			send("A", fixField{98, "0"}, fixField{108, m.get(108)})
+			send("1", fixField{112, "stub-test"})
+			send("2", fixField{7, "2"}, fixField{16, "0"})
+		case "1":
+			send("0", fixField{112, m.get(112)})
+		case "5":
+			send("5")
+			return
+		}
+	}
+}
+
+func TestFixCodec(t *testing.T) {
+	data := encodeFix("FIX.4.4", fixMessage{{35, "0"}, {49, "A"}, {56, "B"}, {34, "1"}})
+	assert.Equal(t, "8=FIX.4.4\x019=20\x0135=0\x0149=A\x0156=B\x0134=1\x0110=", string(data[:len(data)-4]))
+	m, err := readFix(bufio.NewReader(bytes.NewReader(data)))
+	assert.Nil(t, err)
+	assert.Equal(t, "0", m.msgType())
+	assert.Equal(t, "B", m.get(56))
+
+	data[len(data)-2]++
+	_, err = readFix(bufio.NewReader(bytes.NewReader(data)))
+	assert.NotNil(t, err)
+}
+
+func TestFixSession(t *testing.T) {
+	stub := newFixAcceptorStub(t, "secret")
+	defer stub.ln.Close()
+	cfg := fixConfig{BeginString: "FIX.4.4", SenderCompID: "QBT", TargetCompID: "STUB", Password: "secret",
+		HeartBtInt: 30, ResetSeqNum: true}
+
+	s, err := dialFix(stub.ln.Addr().String(), cfg, time.Second)
+	assert.Nil(t, err)
+	_, err = s.logon()
+	assert.Nil(t, err)
+	logon := <-stub.received
+	assert.Equal(t, "Y", logon.get(141))
+	assert.Equal(t, "1", logon.get(34))
+
+	rtt, err := s.testRequest()
+	assert.Nil(t, err)
+	assert.Greater(t, rtt, time.Duration(0))
+	assert.Equal(t, "1", (<-stub.received).msgType())
+	//回应对端的TestRequest，ResendRequest用GapFill跳过
+	heartbeat := <-stub.received
+	assert.Equal(t, "0", heartbeat.msgType())
+	assert.Equal(t, "stub-test", heartbeat.get(112))
+	gapFill := <-stub.received
+	assert.Equal(t, "4", gapFill.msgType())
+	assert.Equal(t, "2", gapFill.get(34))
+	assert.Equal(t, "Y", gapFill.get(123))
+	assert.Equal(t, "4", gapFill.get(36))
+
+	assert.Nil(t, s.logout())
+	assert.Equal(t, "5", (<-stub.received).msgType())
+
+	//密码错误时对端登出
+	cfg.Password = "wrong"
+	s, err = dialFix(stub.ln.Addr().String(), cfg, time.Second)
+	assert.Nil(t, err)
+	_, err = s.logon()
+	assert.ErrorIs(t, err, errFixSession)
+	assert.Contains(t, err.Error(), "bad password")
+}
+
+func TestFixReconnectSeqNum(t *testing.T) {
+	stub := newFixAcceptorStub(t, "")
+	defer stub.ln.Close()
+	cfg := fixConfig{BeginString: "FIX.4.4", SenderCompID: "QBT", TargetCompID: "STUB", HeartBtInt: 30, SeqNum: 5}
+
+	s, err := dialFix(stub.ln.Addr().String(), cfg, time.Second)
+	assert.Nil(t, err)
+	_, err = s.logon()
+	assert.Nil(t, err)
+	logon := <-stub.received
+	assert.Equal(t, "", logon.get(141))
+	assert.Equal(t, "5", logon.get(34))
+	_, err = s.testRequest()
+	assert.Nil(t, err)
+	//Logon、TestRequest、Heartbeat用了5、6、7，GapFill不占序号
+	for i := 0; i < 3; i++ {
+		<-stub.received
+	}
+
+	//断线重连后从上一个会话的序号继续
+	cfg = s.resume()
+	s, err = dialFix(stub.ln.Addr().String(), cfg, time.Second)
+	assert.Nil(t, err)
+	_, err = s.logon()
+	assert.Nil(t, err)
+	logon = <-stub.received
+	assert.Equal(t, "A", logon.msgType())
+	assert.Equal(t, "8", logon.get(34))
+	assert.Nil(t, s.logout())
+
+	//重置序号时重连仍从1开始
+	cfg.ResetSeqNum = true
+	s, err = dialFix(stub.ln.Addr().String(), cfg, time.Second)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, s.resume().SeqNum)
+}
@@ -0,0 +1,354 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/net/http2"
+)
+
+// grpcHealthPath 标准的健康检查接口 grpc.health.v1.Health/Check
+const grpcHealthPath = "/grpc.health.v1.Health/Check"
+
+// grpcServingStatus HealthCheckResponse.ServingStatus 的取值
+var grpcServingStatus = map[uint64]string{
+	0: "UNKNOWN",
+	1: "SERVING",
+	2: "NOT_SERVING",
+	3: "SERVICE_UNKNOWN",
+}
+
+// grpcHealthRequest 带5字节前缀的 HealthCheckRequest{service = 1}
+func grpcHealthRequest(service string) []byte {
+	var msg []byte
+	if service != "" {
+		msg = make([]byte, 1+binary.MaxVarintLen64)
+		msg[0] = 0x0a
+		msg = append(msg[:1+binary.PutUvarint(msg[1:], uint64(len(service)))], service...)
+	}
+	frame := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(msg)))
+	return append(frame, msg...)
+}
+
+// parseGrpcHealthResponse 解析带5字节前缀的 HealthCheckResponse{status = 1}，未知字段跳过
+func parseGrpcHealthResponse(frame []byte) (string, error) {
+	if len(frame) < 5 {
+		return "", fmt.Errorf("short grpc message: %d bytes", len(frame))
+	}
+	if frame[0] != 0 {
+		return "", errors.New("compressed grpc message is not supported")
+	}
+	msg := frame[5:]
+	if n := binary.BigEndian.Uint32(frame[1:5]); int(n) != len(msg) {
+		return "", fmt.Errorf("grpc message length %d, got %d bytes", n, len(msg))
+	}
+	status := uint64(0)
+	for len(msg) > 0 {
+		key, n := binary.Uvarint(msg)
+		if n <= 0 {
+			return "", errors.New("bad protobuf field key")
+		}
+		msg = msg[n:]
+		switch key & 7 {
+		case 0:
+			v, n := binary.Uvarint(msg)
+			if n <= 0 {
+				return "", errors.New("bad protobuf varint")
+			}
+			msg = msg[n:]
+			if key>>3 == 1 {
+				status = v
+			}
+		case 2:
+			l, n := binary.Uvarint(msg)
+			if n <= 0 || uint64(len(msg)-n) < l {
+				return "", errors.New("bad protobuf length")
+			}
+			msg = msg[n+int(l):]
+		default:
+			return "", fmt.Errorf("unexpected protobuf wire type %d", key&7)
+		}
+	}
+	if name, ok := grpcServingStatus[status]; ok {
+		return name, nil
+	}
+	return strconv.FormatUint(status, 10), nil
+}
+
+// grpcError 非0的grpc-status
+type grpcError struct {
+	code    string
+	message string
+}
+
+func (e *grpcError) Error() string {
+	return fmt.Sprintf("grpc-status %s: %s", e.code, e.message)
+}
+
+// grpcHealthClient 每个地址一个http2连接，复用连接做健康检查
+type grpcHealthClient struct {
+	baseURL   string
+	authority string
+	metadata  http.Header
+	timeout   time.Duration
+	client    *http.Client
+}
+
+// newGrpcHealthClient tlsConfig为nil时使用h2c(明文http2)
+func newGrpcHealthClient(address string, tlsConfig *tls.Config, metadata http.Header, authority string,
+	timeout time.Duration) *grpcHealthClient {
+	transport := &http2.Transport{TLSClientConfig: tlsConfig}
+	scheme := "https"
+	if tlsConfig == nil {
+		scheme = "http"
+		transport.AllowHTTP = true
+		transport.DialTLS = func(network, addr string, _ *tls.Config) (net.Conn, error) {
+			return net.DialTimeout(network, addr, timeout)
+		}
+	}
+	return &grpcHealthClient{
+		baseURL:   scheme + "://" + address,
+		authority: authority,
+		metadata:  metadata,
+		timeout:   timeout,
+		client:    &http.Client{Transport: transport, Timeout: timeout},
+	}
+}
+
+// check 调用一次Health/Check，返回服务状态
+func (c *grpcHealthClient) check(service string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+grpcHealthPath,
+		bytes.NewReader(grpcHealthRequest(service)))
+	if err != nil {
+		return "", err
+	}
+	for key, values := range c.metadata {
+		req.Header[key] = values
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+	req.Header.Set("Grpc-Timeout", strconv.FormatInt(c.timeout.Milliseconds(), 10)+"m")
+	if c.authority != "" {
+		req.Host = c.authority
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<16))
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("http status %s", resp.Status)
+	}
+	//出错时服务端可能只返回header(Trailers-Only)
+	code, message := resp.Trailer.Get("Grpc-Status"), resp.Trailer.Get("Grpc-Message")
+	if code == "" {
+		code, message = resp.Header.Get("Grpc-Status"), resp.Header.Get("Grpc-Message")
+	}
+	if code != "0" {
+		return "", &grpcError{code: code, message: message}
+	}
+	return parseGrpcHealthResponse(body)
+}
+
+func (c *grpcHealthClient) close() {
+	c.client.CloseIdleConnections()
+}
+
+// grpcMetadata 把 key=value 转成请求头，key转成小写
+func grpcMetadata(pairs []string) (http.Header, error) {
+	metadata := http.Header{}
+	for _, pair := range pairs {
+		key, value, ok := strings.Cut(pair, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid metadata %q, want key=value", pair)
+		}
+		metadata[strings.ToLower(key)] = append(metadata[strings.ToLower(key)], value)
+	}
+	return metadata, nil
+}
+
+// CheckGrpcPing 定期检查一个服务，状态不是SERVING或调用失败算丢包，状态变化时输出
+func CheckGrpcPing(client *grpcHealthClient, address, service, hostName string, interval float64,
+	timeout time.Duration, count int, csvWriteChan chan tcpInformation, wg *sync.WaitGroup) {
+	defer wg.Done()
+	ip, port, _ := net.SplitHostPort(address)
+	name := address
+	if service != "" {
+		name += "/" + service
+	}
+	last := ""
+	for seq := 1; seq <= count; seq++ {
+		start := time.Now()
+		status, err := client.check(service)
+		rtt := time.Since(start)
+		if err != nil {
+			status = "ERROR"
+			rtt = timeout * time.Second
+			printEvent(fmt.Sprint("\ngrpc-ping ", name, " error: ", err))
+		}
+		if status != last {
+			if last != "" || status != "SERVING" {
+				printEvent(fmt.Sprintf("\n%s grpc-ping %s status %s", start.Format(time.RFC3339), name, status))
+			}
+			last = status
+		}
+		csvWriteChan <- tcpInformation{
+			start:    start,
+			kind:     "grpc_ping",
+			hostName: hostName,
+			ip:       ip,
+			port:     port,
+			service:  service,
+			status:   status,
+			rtt:      rtt,
+			loss:     status != "SERVING",
+		}
+		if !sleepOrQuit(time.Duration(interval*1000)*time.Millisecond - time.Since(start)) {
+			return
+		}
+	}
+}
+
+// grpcPingCsvHeader grpc-ping csv文件的表头
+var grpcPingCsvHeader = []string{"ts", "hostname", "ip", "port", "service", "status", "rtt", "loss"}
+
+var grpcPingCmd = &cobra.Command{
+	Use:   "grpc-ping",
+	Short: "ping grpc services with the standard health check",
+	Long: `call grpc.health.v1.Health/Check of each service on each address over one http2 connection per address
+and record the latency and serving status. A call that fails or a status other than SERVING counts as a loss.
+The service "" checks the whole server. Results go to csv files, summaries, influxdb, --store,
+--detect-changes, slo and --tui like tcp-ping, targets are named IP:PORT/service.
+For example:
+qbt grpc-ping -a 10.11.1.20:50051 --service order.OrderService,risk.RiskService
+qbt grpc-ping -a gateway.internal:443 --tls --metadata authorization="Bearer xxx" -i 5`,
+	Args: func(cmd *cobra.Command, args []string) error {
+		addresses, err := cmd.Flags().GetStringSlice("address")
+		if err != nil || len(addresses) == 0 {
+			return fmt.Errorf("no address to check")
+		}
+		for _, address := range addresses {
+			if _, _, err := net.SplitHostPort(address); err != nil {
+				return fmt.Errorf("invalid address %s: %v", address, err)
+			}
+		}
+		return nil
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		addresses, _ := cmd.Flags().GetStringSlice("address")
+		services, _ := cmd.Flags().GetStringSlice("service")
+		onlySummary, _ := cmd.Flags().GetBool("only-summary")
+		timeout, _ := cmd.Flags().GetInt("timeout")
+		interval, _ := cmd.Flags().GetFloat64("interval")
+		count, _ := cmd.Flags().GetInt("count")
+		useTLS, _ := cmd.Flags().GetBool("tls")
+		insecure, _ := cmd.Flags().GetBool("insecure")
+		serverName, _ := cmd.Flags().GetString("server-name")
+		authority, _ := cmd.Flags().GetString("authority")
+		pairs, _ := cmd.Flags().GetStringArray("metadata")
+		metadata, err := grpcMetadata(pairs)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		if len(services) == 0 {
+			services = []string{""}
+		}
+		var tlsConfig *tls.Config
+		if useTLS {
+			tlsConfig = &tls.Config{ServerName: serverName, InsecureSkipVerify: insecure, NextProtos: []string{"h2"}}
+		}
+		hostname, _ := os.Hostname()
+		if collector := setupCollector(cmd); collector != nil {
+			defer collector.close()
+		}
+		setupStore(cmd)
+		setupChanges(cmd)
+		setupSlo()
+		defer setupTUI(cmd)()
+		writer, err := newCsvRotator(hostname+"_grpc_ping", grpcPingCsvHeader, csvOptionsFromFlags(cmd))
+		if err != nil {
+			fmt.Println("open csv file error:", err)
+			return
+		}
+		summaryHeader := append(append([]string{}, tcpPingSummaryCsvHeader[:4]...), "service")
+		summaryHeader = append(summaryHeader, tcpPingSummaryCsvHeader[4:]...)
+		summaryWriter, err := newCsvRotator(hostname+"_grpc_ping_summary", summaryHeader, csvOptionsFromFlags(cmd))
+		if err != nil {
+			fmt.Println("open csv file error:", err)
+			return
+		}
+		defer func() {
+			for _, w := range []*csvRotator{writer, summaryWriter} {
+				if err := w.Close(); err != nil {
+					fmt.Println("close file error", err)
+				}
+			}
+		}()
+
+		csvWriteChan := make(chan tcpInformation, 1000)
+		writeDone := make(chan struct{})
+		go func() {
+			writeCSVRow(csvWriteChan, writer, summaryWriter, onlySummary, time.Duration(timeout))
+			close(writeDone)
+		}()
+		var wg sync.WaitGroup
+		for _, address := range addresses {
+			client := newGrpcHealthClient(address, tlsConfig, metadata, authority, time.Duration(timeout)*time.Second)
+			defer client.close()
+			for _, service := range services {
+				wg.Add(1)
+				go CheckGrpcPing(client, address, service, hostname, interval, time.Duration(timeout), count,
+					csvWriteChan, &wg)
+			}
+		}
+		wg.Wait()
+		close(csvWriteChan)
+		<-writeDone
+		if liveTUI == nil && tpv.cnt > 0 {
+			tcpSummary(time.Duration(timeout))
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(grpcPingCmd)
+	grpcPingCmd.Flags().StringSliceP("address", "a", nil, "HOST:PORT of grpc servers")
+	grpcPingCmd.Flags().StringSlice("service", nil, "services to check, default \"\" (the whole server)")
+	grpcPingCmd.Flags().Bool("only-summary", false, "display only errors, status changes and summaries")
+	grpcPingCmd.Flags().IntP("timeout", "t", 2, "timeout in seconds of each check")
+	grpcPingCmd.Flags().Float64P("interval", "i", 1, "seconds between checks")
+	grpcPingCmd.Flags().IntP("count", "c", math.MaxInt, "max checks per service")
+	grpcPingCmd.Flags().Bool("tls", false, "use tls instead of plaintext http2 (h2c)")
+	grpcPingCmd.Flags().Bool("insecure", false, "skip verifying the server certificate with --tls")
+	grpcPingCmd.Flags().String("server-name", "", "server name to verify with --tls, default the address host")
+	grpcPingCmd.Flags().String("authority", "", "override the :authority header")
+	grpcPingCmd.Flags().StringArray("metadata", nil, "request metadata key=value, repeatable")
+	addCollectorFlags(grpcPingCmd)
+	addCsvFlags(grpcPingCmd)
+	addStoreFlags(grpcPingCmd)
+	grpcPingCmd.Flags().Bool("detect-changes", false, "detect latency baseline changes per service and write them as events")
+	addChangeFlags(grpcPingCmd)
+	addTUIFlags(grpcPingCmd)
+}
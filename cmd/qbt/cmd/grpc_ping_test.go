@@ -0,0 +1,90 @@
+package cmd
+
+import (
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// grpcHealthStub 测试用的h2c健康检查服务，按服务名返回状态，未知服务返回NOT_FOUND(5)
+func grpcHealthStub(t *testing.T, statuses map[string]byte) *httptest.Server {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, grpcHealthPath, r.URL.Path)
+		assert.Equal(t, "application/grpc", r.Header.Get("Content-Type"))
+		assert.Equal(t, "Bearer token", r.Header.Get("Authorization"))
+		body, _ := io.ReadAll(r.Body)
+		service := ""
+		if len(body) > 5 {
+			n := body[6]
+			service = string(body[7 : 7+n])
+		}
+		w.Header().Set("Content-Type", "application/grpc")
+		status, ok := statuses[service]
+		if !ok {
+			w.Header().Set("Grpc-Status", "5")
+			w.Header().Set("Grpc-Message", "unknown service")
+			return
+		}
+		w.Header().Set("Trailer", "Grpc-Status")
+		frame := []byte{0, 0, 0, 0, 2, 0x08, status}
+		_, _ = w.Write(frame)
+		w.Header().Set("Grpc-Status", "0")
+	})
+	return httptest.NewServer(h2c.NewHandler(handler, &http2.Server{}))
+}
+
+func TestGrpcHealthMessages(t *testing.T) {
+	frame := grpcHealthRequest("order.OrderService")
+	assert.Equal(t, byte(0), frame[0])
+	assert.Equal(t, uint32(len(frame)-5), binary.BigEndian.Uint32(frame[1:5]))
+	assert.Equal(t, []byte{0x0a, 18}, frame[5:7])
+	assert.Equal(t, "order.OrderService", string(frame[7:]))
+	assert.Equal(t, []byte{0, 0, 0, 0, 0}, grpcHealthRequest(""))
+
+	status, err := parseGrpcHealthResponse([]byte{0, 0, 0, 0, 2, 0x08, 1})
+	assert.Nil(t, err)
+	assert.Equal(t, "SERVING", status)
+	//空消息是默认值UNKNOWN，未知字段跳过
+	status, err = parseGrpcHealthResponse([]byte{0, 0, 0, 0, 0})
+	assert.Nil(t, err)
+	assert.Equal(t, "UNKNOWN", status)
+	status, err = parseGrpcHealthResponse([]byte{0, 0, 0, 0, 5, 0x12, 1, 'x', 0x08, 2})
+	assert.Nil(t, err)
+	assert.Equal(t, "NOT_SERVING", status)
+	_, err = parseGrpcHealthResponse([]byte{0, 0, 0, 0, 3, 0x08, 1})
+	assert.NotNil(t, err)
+
+	metadata, err := grpcMetadata([]string{"Authorization=Bearer a=b", "x-id=1", "x-id=2"})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"Bearer a=b"}, metadata["authorization"])
+	assert.Equal(t, []string{"1", "2"}, metadata["x-id"])
+	_, err = grpcMetadata([]string{"novalue"})
+	assert.NotNil(t, err)
+}
+
+func TestGrpcHealthClient(t *testing.T) {
+	server := grpcHealthStub(t, map[string]byte{"": 1, "risk.RiskService": 2})
+	defer server.Close()
+	metadata, _ := grpcMetadata([]string{"authorization=Bearer token"})
+	client := newGrpcHealthClient(strings.TrimPrefix(server.URL, "http://"), nil, metadata, "", time.Second)
+	defer client.close()
+
+	status, err := client.check("")
+	assert.Nil(t, err)
+	assert.Equal(t, "SERVING", status)
+	status, err = client.check("risk.RiskService")
+	assert.Nil(t, err)
+	assert.Equal(t, "NOT_SERVING", status)
+	_, err = client.check("order.OrderService")
+	if assert.NotNil(t, err) {
+		assert.Equal(t, "5", err.(*grpcError).code)
+	}
+}
@@ -0,0 +1,171 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/qbtrade/qbt/cmd/qbt/cf"
+	"github.com/spf13/cobra"
+)
+
+// ipFamily ipv4、ipv6，不是IP(主机名)时为空
+func ipFamily(ip string) string {
+	parsed := net.ParseIP(ip)
+	switch {
+	case parsed == nil:
+		return ""
+	case parsed.To4() != nil:
+		return "ipv4"
+	default:
+		return "ipv6"
+	}
+}
+
+// checkFamilyFlag --family只能是4或6，并且只在 --each-ip 时生效
+func checkFamilyFlag(cmd *cobra.Command) error {
+	family, _ := cmd.Flags().GetString("family")
+	if family != "" && family != "4" && family != "6" {
+		return fmt.Errorf("invalid --family %q, want 4 or 6", family)
+	}
+	if eachIP, _ := cmd.Flags().GetBool("each-ip"); family != "" && !eachIP {
+		return fmt.Errorf("--family only applies with --each-ip")
+	}
+	return nil
+}
+
+// lookupIPs 解析主机名的A和AAAA记录，family为4或6时只解析对应的记录
+func lookupIPs(host, family string) ([]net.IP, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return net.DefaultResolver.LookupIP(ctx, "ip"+family, host)
+}
+
+// expandEachIP 把 HOST:PORT 展开成每个解析到的 IP:PORT，IPv6写成[v6]:port，去重并保持顺序
+func expandEachIP(addresses []string, family string, lookup func(host, family string) ([]net.IP, error)) (
+	[]string, error) {
+	var expanded []string
+	seen := map[string]bool{}
+	add := func(address string) {
+		if !seen[address] {
+			seen[address] = true
+			expanded = append(expanded, address)
+		}
+	}
+	for _, address := range addresses {
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+		if f := ipFamily(host); f != "" {
+			if family == "" || f == "ipv"+family {
+				add(net.JoinHostPort(host, port))
+			}
+			continue
+		}
+		ips, err := lookup(host, family)
+		if err != nil {
+			return nil, fmt.Errorf("resolve %s: %w", host, err)
+		}
+		if len(ips) == 0 {
+			return nil, fmt.Errorf("resolve %s: no ipv%s address", host, family)
+		}
+		for _, ip := range ips {
+			add(net.JoinHostPort(ip.String(), port))
+		}
+	}
+	return expanded, nil
+}
+
+// groupStats 按地址族和按IP的统计，用来发现某一个地址族(比如AAAA)的路径异常，
+// 抖动按target统计，不同target的rtt相减没有意义
+type groupStats struct {
+	mu       sync.Mutex
+	families map[string]*tcpPingVar
+	ips      map[string]*tcpPingVar
+	jitters  map[string]*cf.Jitter
+}
+
+var tpg = newGroupStats()
+
+func newGroupStats() *groupStats {
+	return &groupStats{families: map[string]*tcpPingVar{}, ips: map[string]*tcpPingVar{},
+		jitters: map[string]*cf.Jitter{}}
+}
+
+// add 记录target的一次探测，ip是target中的IP
+func (g *groupStats) add(ip, target string, rtt time.Duration, loss bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	//丢包跳过，相邻关系接到下一次成功
+	if !loss {
+		j, ok := g.jitters[target]
+		if !ok {
+			j = cf.NewJitter()
+			g.jitters[target] = j
+		}
+		j.Add(float64(rtt))
+	}
+	update := func(vars map[string]*tcpPingVar, key string) {
+		v, ok := vars[key]
+		if !ok {
+			v = newTcpPingVar()
+			vars[key] = v
+		}
+		v.cnt++
+		if loss {
+			v.lossCnt++
+		}
+		v.sumRtt += rtt
+		v.rtts1000.pushAndMaintain(rtt)
+	}
+	if family := ipFamily(ip); family != "" {
+		update(g.families, family)
+	}
+	update(g.ips, ip)
+}
+
+// lines 多于一个地址族或IP时输出各自最近1000次的统计
+func (g *groupStats) lines(timeout time.Duration) []string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	var lines []string
+	for _, vars := range []map[string]*tcpPingVar{g.families, g.ips} {
+		if len(vars) < 2 {
+			continue
+		}
+		keys := make([]string, 0, len(vars))
+		for key := range vars {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			v := vars[key]
+			lines = append(lines, fmt.Sprintf("%s 共%d次 %d次连接失败，最近1000次中%d次连接失败 平均RTT为 %v 最大rtt是 %v",
+				key, v.cnt, v.lossCnt, v.rtts1000.LossCount(timeout), v.rtts1000.mean, v.rtts1000.max))
+		}
+	}
+	return lines
+}
+
+// jitterLines 每个target的抖动
+func (g *groupStats) jitterLines() []string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	targets := make([]string, 0, len(g.jitters))
+	for target := range g.jitters {
+		targets = append(targets, target)
+	}
+	sort.Strings(targets)
+	lines := make([]string, 0, len(targets))
+	for _, target := range targets {
+		j := g.jitters[target]
+		stats := jitterStats{jitter: time.Duration(j.Jitter()), masd: time.Duration(j.MASD()),
+			ipdv50: time.Duration(j.IPDV(50)), ipdv99: time.Duration(j.IPDV(99))}
+		lines = append(lines, fmt.Sprintf("%s 的抖动 %v", target, stats))
+	}
+	return lines
+}
@@ -0,0 +1,90 @@
+package cmd
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExpandEachIP(t *testing.T) {
+	lookup := func(host, family string) ([]net.IP, error) {
+		if host != "dual.example" {
+			return nil, fmt.Errorf("no such host")
+		}
+		ips := map[string][]net.IP{
+			"":  {net.ParseIP("192.0.2.1"), net.ParseIP("2001:db8::1")},
+			"4": {net.ParseIP("192.0.2.1")},
+			"6": {net.ParseIP("2001:db8::1")},
+		}
+		return ips[family], nil
+	}
+	expanded, err := expandEachIP([]string{"dual.example:443", "[2001:db8::2]:80", "192.0.2.1:443"}, "", lookup)
+	assert.Nil(t, err)
+	//重复的192.0.2.1:443去掉
+	assert.Equal(t, []string{"192.0.2.1:443", "[2001:db8::1]:443", "[2001:db8::2]:80"}, expanded)
+
+	expanded, err = expandEachIP([]string{"dual.example:443", "[2001:db8::2]:80", "192.0.2.9:22"}, "6", lookup)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"[2001:db8::1]:443", "[2001:db8::2]:80"}, expanded)
+
+	_, err = expandEachIP([]string{"2001:db8::1:80"}, "", lookup)
+	assert.NotNil(t, err)
+	_, err = expandEachIP([]string{"missing.example:80"}, "", lookup)
+	assert.NotNil(t, err)
+}
+
+func TestGroupStats(t *testing.T) {
+	assert.Equal(t, "ipv4", ipFamily("10.0.0.1"))
+	assert.Equal(t, "ipv6", ipFamily("fd00::1"))
+	assert.Equal(t, "", ipFamily("example.com"))
+
+	g := newGroupStats()
+	g.add("192.0.2.1", "192.0.2.1:80", time.Millisecond, false)
+	assert.Empty(t, g.lines(time.Second))
+	g.add("2001:db8::1", "[2001:db8::1]:80", 2*time.Second, true)
+	g.add("2001:db8::1", "[2001:db8::1]:80", 3*time.Millisecond, false)
+	lines := g.lines(time.Second)
+	//两个地址族和两个IP
+	assert.Len(t, lines, 4)
+	assert.Contains(t, lines[1], "ipv6 共2次 1次连接失败")
+	assert.Contains(t, lines[3], "2001:db8::1 共2次")
+}
+
+func TestTcpPingIPv6(t *testing.T) {
+	ln, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skip("no ipv6 loopback:", err)
+	}
+	defer ln.Close()
+	csvWrite := make(chan tcpInformation, 1)
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	establishTcp("::1", port, "h", 1, make(chan int, 1), csvWrite)
+	info := <-csvWrite
+	assert.False(t, info.loss)
+	assert.Equal(t, "[::1]:"+port, info.target())
+	assert.Equal(t, "ipv6", info.point(1).Tags["family"])
+}
+
+func TestCheckFamilyFlag(t *testing.T) {
+	for _, c := range []struct {
+		args []string
+		ok   bool
+	}{
+		{nil, true},
+		{[]string{"--each-ip"}, true},
+		{[]string{"--each-ip", "--family", "4"}, true},
+		{[]string{"--each-ip", "--family", "6"}, true},
+		{[]string{"--each-ip", "--family", "ipv6"}, false},
+		{[]string{"--family", "4"}, false},
+	} {
+		cmd := &cobra.Command{}
+		cmd.Flags().Bool("each-ip", false, "")
+		cmd.Flags().String("family", "", "")
+		assert.Nil(t, cmd.ParseFlags(c.args))
+		assert.Equal(t, c.ok, checkFamilyFlag(cmd) == nil, c.args)
+	}
+}
@@ -0,0 +1,534 @@
+package cmd
+
+import (
+	"crypto/hmac"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/qbtrade/qbt/cmd/qbt/cf"
+	"github.com/spf13/cobra"
+)
+
+const (
+	//重新向已知节点获取节点列表的间隔，失败时较快重试
+	meshDiscoverInterval = 30 * time.Second
+	meshDiscoverRetry    = 5 * time.Second
+	meshHTTPTimeout      = 2 * time.Second
+	//自动发现的节点超过这个时间没有应答就移除，--peer 指定的节点不移除
+	meshPeerExpiry = 5 * time.Minute
+	//节点注册请求的时间戳和本机相差超过这个时间视为重放
+	meshRegisterSkew = time.Minute
+)
+
+// meshInfo GET /mesh/info 返回的节点信息，peers用于其他节点发现更多节点
+type meshInfo struct {
+	Name          string   `json:"name"`
+	ReflectorPort string   `json:"reflector_port"`
+	Peers         []string `json:"peers"`
+}
+
+// meshCell 矩阵中一个源到目的的统计，时延单位ms
+type meshCell struct {
+	Sent    int       `json:"sent"`
+	Lost    int       `json:"lost"`
+	Loss    float64   `json:"loss"` // 百分比
+	Last    float64   `json:"last"`
+	Min     float64   `json:"min"`
+	P50     float64   `json:"p50"`
+	P90     float64   `json:"p90"`
+	P99     float64   `json:"p99"`
+	Max     float64   `json:"max"`
+	Updated time.Time `json:"updated"`
+}
+
+// meshRow 一个节点到所有其他节点的统计，GET /mesh/row
+type meshRow struct {
+	Agent   string              `json:"agent"`
+	Updated time.Time           `json:"updated"`
+	Cells   map[string]meshCell `json:"cells"`
+}
+
+// meshMatrix GET /matrix 返回的 N×N 矩阵，rows[src].cells[dst]
+type meshMatrix struct {
+	Agents []string           `json:"agents"`
+	Rows   map[string]meshRow `json:"rows"`
+	Errors map[string]string  `json:"errors,omitempty"`
+}
+
+// meshPeer 本节点探测的一个对端
+type meshPeer struct {
+	api       string // 对端HTTP接口地址
+	name      string
+	reflector string
+	conn      net.Conn
+	seq       uint64
+	static    bool // 来自 --peer，不会过期
+	//下一次获取节点信息的时间
+	nextDiscover time.Time
+	//最近一次获取信息或探测成功的时间，用于过期自动发现的节点
+	lastSeen time.Time
+
+	//最近window次探测的结果，lost为true时rtt无效
+	rtts    []float64
+	lost    []bool
+	last    float64
+	updated time.Time
+}
+
+func (p *meshPeer) record(rtt float64, lost bool, window int) {
+	p.rtts = append(p.rtts, rtt)
+	p.lost = append(p.lost, lost)
+	if len(p.rtts) > window {
+		p.rtts = p.rtts[1:]
+		p.lost = p.lost[1:]
+	}
+	if !lost {
+		p.last = rtt
+	}
+	p.updated = time.Now()
+}
+
+func (p *meshPeer) cell() meshCell {
+	c := meshCell{Sent: len(p.rtts), Last: p.last, Updated: p.updated}
+	ok := make([]float64, 0, len(p.rtts))
+	for i, rtt := range p.rtts {
+		if p.lost[i] {
+			c.Lost++
+		} else {
+			ok = append(ok, rtt)
+		}
+	}
+	if c.Sent > 0 {
+		c.Loss = 100 * float64(c.Lost) / float64(c.Sent)
+	}
+	if len(ok) > 0 {
+		c.Min = cf.Percentile(ok, 0)
+		c.P50 = cf.Percentile(ok, 50)
+		c.P90 = cf.Percentile(ok, 90)
+		c.P99 = cf.Percentile(ok, 99)
+		c.Max = cf.Percentile(ok, 100)
+	}
+	return c
+}
+
+// meshAgent 按计划探测所有已知节点，并通过HTTP接口提供本节点的一行和整个矩阵
+type meshAgent struct {
+	name          string
+	reflectorPort string
+	apiPort       string
+	secret        string
+	interval      time.Duration
+	window        int
+	timeout       time.Duration
+	client        *http.Client
+
+	mu    sync.Mutex
+	peers map[string]*meshPeer // key为对端HTTP接口地址
+}
+
+func newMeshAgent(name, reflector, api, secret string, interval time.Duration, window int) *meshAgent {
+	_, reflectorPort, _ := net.SplitHostPort(reflector)
+	_, apiPort, _ := net.SplitHostPort(api)
+	return &meshAgent{
+		name:          name,
+		reflectorPort: reflectorPort,
+		apiPort:       apiPort,
+		secret:        secret,
+		interval:      interval,
+		window:        window,
+		timeout:       cf.Min(interval, 2*time.Second),
+		client:        &http.Client{Timeout: meshHTTPTimeout},
+		peers:         make(map[string]*meshPeer),
+	}
+}
+
+// addPeer 加入一个对端，static为true表示来自 --peer
+func (m *meshAgent) addPeer(api string, static bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if p, ok := m.peers[api]; ok {
+		p.static = p.static || static
+		return
+	}
+	m.peers[api] = &meshPeer{api: api, static: static, lastSeen: time.Now()}
+}
+
+// expire 移除长时间没有应答的自动发现节点
+func (m *meshAgent) expire(now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for api, p := range m.peers {
+		if p.static || now.Sub(p.lastSeen) < meshPeerExpiry {
+			continue
+		}
+		if p.conn != nil {
+			_ = p.conn.Close()
+		}
+		delete(m.peers, api)
+		fmt.Println("mesh peer", api, "expired")
+	}
+}
+
+// meshRegisterMac 节点注册请求的签名，覆盖端口和时间戳
+func meshRegisterMac(secret, port, ts string) string {
+	return hex.EncodeToString(authMac(secret, []byte("mesh|"+port+"|"+ts)))
+}
+
+// registerFrom 请求方带上自己的接口端口和签名，这样对端也能发现请求方。
+// 没有配置密钥时不接受注册，节点只能来自 --peer 和已知节点的列表
+func (m *meshAgent) registerFrom(r *http.Request) {
+	q := r.URL.Query()
+	port, ts := q.Get("from_port"), q.Get("ts")
+	if port == "" || m.secret == "" {
+		return
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return
+	}
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return
+	}
+	if skew := time.Since(time.Unix(sec, 0)); skew > meshRegisterSkew || skew < -meshRegisterSkew {
+		return
+	}
+	if !hmac.Equal([]byte(r.Header.Get(collectorMacHeader)), []byte(meshRegisterMac(m.secret, port, ts))) {
+		return
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		m.addPeer(net.JoinHostPort(host, port), false)
+	}
+}
+
+func (m *meshAgent) register(mux *http.ServeMux) {
+	mux.HandleFunc("/mesh/info", func(w http.ResponseWriter, r *http.Request) {
+		m.registerFrom(r)
+		writeJSON(w, m.info())
+	})
+	mux.HandleFunc("/mesh/row", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, m.row())
+	})
+	mux.HandleFunc("/matrix", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, m.matrix())
+	})
+}
+
+func (m *meshAgent) info() meshInfo {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	info := meshInfo{Name: m.name, ReflectorPort: m.reflectorPort}
+	for api := range m.peers {
+		info.Peers = append(info.Peers, api)
+	}
+	sort.Strings(info.Peers)
+	return info
+}
+
+func (m *meshAgent) row() meshRow {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	row := meshRow{Agent: m.name, Updated: time.Now(), Cells: make(map[string]meshCell)}
+	for _, p := range m.peers {
+		if p.name != "" && p.name != m.name {
+			row.Cells[p.name] = p.cell()
+		}
+	}
+	return row
+}
+
+func (m *meshAgent) getJSON(api, path string, v any) error {
+	return m.getJSONWithMac(api, path, "", v)
+}
+
+// getJSONWithMac mac不为空时放在请求头中
+func (m *meshAgent) getJSONWithMac(api, path, mac string, v any) error {
+	req, err := http.NewRequest("GET", "http://"+api+path, nil)
+	if err != nil {
+		return err
+	}
+	if mac != "" {
+		req.Header.Set(collectorMacHeader, mac)
+	}
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s%s: %s", api, path, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// matrix 汇总本节点和所有对端的行
+func (m *meshAgent) matrix() meshMatrix {
+	matrix := meshMatrix{Rows: map[string]meshRow{m.name: m.row()}, Errors: make(map[string]string)}
+	m.mu.Lock()
+	apis := make([]string, 0, len(m.peers))
+	for api, p := range m.peers {
+		if p.name != m.name {
+			apis = append(apis, api)
+		}
+	}
+	m.mu.Unlock()
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, api := range apis {
+		wg.Add(1)
+		go func(api string) {
+			defer wg.Done()
+			var row meshRow
+			err := m.getJSON(api, "/mesh/row", &row)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				matrix.Errors[api] = err.Error()
+				return
+			}
+			matrix.Rows[row.Agent] = row
+		}(api)
+	}
+	wg.Wait()
+
+	agents := make(map[string]bool)
+	for src, row := range matrix.Rows {
+		agents[src] = true
+		for dst := range row.Cells {
+			agents[dst] = true
+		}
+	}
+	for agent := range agents {
+		matrix.Agents = append(matrix.Agents, agent)
+	}
+	sort.Strings(matrix.Agents)
+	return matrix
+}
+
+// discover 向到期的节点获取信息，记录它的名字和反射端口，并把它知道的节点加入列表
+func (m *meshAgent) discover() {
+	now := time.Now()
+	m.mu.Lock()
+	apis := make([]string, 0, len(m.peers))
+	for api, p := range m.peers {
+		if !now.Before(p.nextDiscover) {
+			apis = append(apis, api)
+		}
+	}
+	m.mu.Unlock()
+	for _, api := range apis {
+		var info meshInfo
+		path, mac := "/mesh/info", ""
+		if m.secret != "" {
+			ts := strconv.FormatInt(time.Now().Unix(), 10)
+			path += "?from_port=" + m.apiPort + "&ts=" + ts
+			mac = meshRegisterMac(m.secret, m.apiPort, ts)
+		}
+		err := m.getJSONWithMac(api, path, mac, &info)
+		m.mu.Lock()
+		p, ok := m.peers[api]
+		if !ok {
+			m.mu.Unlock()
+			continue
+		}
+		if err != nil {
+			p.nextDiscover = now.Add(meshDiscoverRetry)
+			m.mu.Unlock()
+			fmt.Println("mesh discover", api, "error:", err)
+			continue
+		}
+		host, _, _ := net.SplitHostPort(api)
+		p.nextDiscover = now.Add(meshDiscoverInterval)
+		p.lastSeen = now
+		p.name = info.Name
+		reflector := ""
+		if info.ReflectorPort != "" {
+			reflector = net.JoinHostPort(host, info.ReflectorPort)
+		}
+		if reflector != p.reflector && p.conn != nil {
+			_ = p.conn.Close()
+			p.conn = nil
+		}
+		p.reflector = reflector
+		m.mu.Unlock()
+		for _, peer := range info.Peers {
+			m.addPeer(peer, false)
+		}
+	}
+}
+
+// probe 对一个对端做一次反射探测
+func (m *meshAgent) probe(p *meshPeer) {
+	m.mu.Lock()
+	if p.reflector == "" || p.name == m.name {
+		m.mu.Unlock()
+		return
+	}
+	if p.conn == nil {
+		conn, err := net.Dial("udp", p.reflector)
+		if err != nil {
+			p.record(0, true, m.window)
+			m.mu.Unlock()
+			return
+		}
+		p.conn = conn
+	}
+	p.seq++
+	conn, seq := p.conn, p.seq
+	m.mu.Unlock()
+
+	p2, t4, err := reflectorProbe(conn, seq, 0, m.secret, m.timeout)
+	rtt := 0.0
+	if err == nil {
+		//扣除对端的处理时间
+		rtt = float64(t4.UnixNano()-p2.t1-(p2.t3-p2.t2)) / 1e6
+	}
+	m.mu.Lock()
+	p.record(rtt, err != nil, m.window)
+	if err == nil {
+		p.lastSeen = time.Now()
+	}
+	m.mu.Unlock()
+}
+
+func (m *meshAgent) run() {
+	for {
+		start := time.Now()
+		m.discover()
+		m.expire(start)
+		m.mu.Lock()
+		peers := make([]*meshPeer, 0, len(m.peers))
+		for _, p := range m.peers {
+			peers = append(peers, p)
+		}
+		m.mu.Unlock()
+		var wg sync.WaitGroup
+		for _, p := range peers {
+			wg.Add(1)
+			go func(p *meshPeer) {
+				defer wg.Done()
+				m.probe(p)
+			}(p)
+		}
+		wg.Wait()
+		time.Sleep(m.interval - time.Since(start))
+	}
+}
+
+// meshDegraded 判断一个单元格是否劣化
+func meshDegraded(c meshCell, maxLoss, maxP99 float64) bool {
+	return c.Sent > 0 && (c.Loss > maxLoss || (maxP99 > 0 && c.P99 > maxP99))
+}
+
+// renderMatrix 渲染矩阵，行为源节点，列为目的节点，劣化的单元格标红并加*
+func renderMatrix(matrix meshMatrix, metric string, maxLoss, maxP99 float64) string {
+	width := 10
+	for _, agent := range matrix.Agents {
+		width = cf.Max(width, len(agent)+2)
+	}
+	var b strings.Builder
+	unit := " (ms)"
+	if metric == "loss" {
+		unit = " (%)"
+	}
+	fmt.Fprintf(&b, "%-*s", width, metric+unit)
+	for _, dst := range matrix.Agents {
+		fmt.Fprintf(&b, "%*s", width, dst)
+	}
+	b.WriteString("\n")
+	var degraded []string
+	for _, src := range matrix.Agents {
+		fmt.Fprintf(&b, "%-*s", width, src)
+		for _, dst := range matrix.Agents {
+			c, ok := matrix.Rows[src].Cells[dst]
+			text := "-"
+			if ok && c.Sent > 0 {
+				text = meshMetric(c, metric)
+			}
+			if ok && meshDegraded(c, maxLoss, maxP99) {
+				degraded = append(degraded, fmt.Sprintf("%s -> %s: loss %.1f%%, p50 %.2fms, p99 %.2fms",
+					src, dst, c.Loss, c.P50, c.P99))
+				fmt.Fprintf(&b, "\033[31m%*s\033[0m", width, text+"*")
+				continue
+			}
+			fmt.Fprintf(&b, "%*s", width, text)
+		}
+		b.WriteString("\n")
+	}
+	if len(degraded) > 0 {
+		b.WriteString("\ndegraded pairs:\n")
+		for _, d := range degraded {
+			b.WriteString("  " + d + "\n")
+		}
+	}
+	for api, err := range matrix.Errors {
+		fmt.Fprintf(&b, "agent %s unreachable: %s\n", api, err)
+	}
+	return b.String()
+}
+
+func meshMetric(c meshCell, metric string) string {
+	switch metric {
+	case "loss":
+		return fmt.Sprintf("%.1f", c.Loss)
+	case "min":
+		return fmt.Sprintf("%.2f", c.Min)
+	case "p90":
+		return fmt.Sprintf("%.2f", c.P90)
+	case "p99":
+		return fmt.Sprintf("%.2f", c.P99)
+	case "max":
+		return fmt.Sprintf("%.2f", c.Max)
+	}
+	return fmt.Sprintf("%.2f", c.P50)
+}
+
+var meshCmd = &cobra.Command{
+	Use:   "mesh",
+	Short: "show the latency matrix between qbt serve agents",
+	Long: `fetch /matrix from a qbt serve --mesh agent and render the N×N latency matrix,
+rows are sources and columns are destinations, degraded pairs are highlighted.
+For example:
+qbt mesh --agent 10.110.1.86:7080 --metric p99 --max-p99 5`,
+	Run: func(cmd *cobra.Command, args []string) {
+		agent, _ := cmd.Flags().GetString("agent")
+		metric, _ := cmd.Flags().GetString("metric")
+		maxLoss, _ := cmd.Flags().GetFloat64("max-loss")
+		maxP99, _ := cmd.Flags().GetFloat64("max-p99")
+		watch, _ := cmd.Flags().GetFloat64("watch")
+		m := &meshAgent{client: &http.Client{Timeout: 10 * time.Second}}
+		for {
+			var matrix meshMatrix
+			if err := m.getJSON(agent, "/matrix", &matrix); err != nil {
+				fmt.Println("get matrix error:", err)
+			} else {
+				if watch > 0 {
+					fmt.Print("\033[H\033[2J")
+				}
+				fmt.Printf("%s latency matrix from %s\n\n", time.Now().Format(time.RFC3339), agent)
+				fmt.Print(renderMatrix(matrix, metric, maxLoss, maxP99))
+			}
+			if watch <= 0 {
+				return
+			}
+			time.Sleep(time.Duration(watch*1000) * time.Millisecond)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(meshCmd)
+	meshCmd.Flags().String("agent", "127.0.0.1:7080", "http address (qbt serve --stats) of any agent in the mesh")
+	meshCmd.Flags().String("metric", "p50", "cell value: min, p50, p90, p99, max or loss")
+	meshCmd.Flags().Float64("max-loss", 1, "highlight pairs with loss above this percentage")
+	meshCmd.Flags().Float64("max-p99", 0, "highlight pairs with p99 above this many ms, 0 disables")
+	meshCmd.Flags().Float64("watch", 0, "refresh every watch seconds, 0 shows once")
+}
@@ -0,0 +1,86 @@
+package cmd
+
+import (
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMeshPeerCell(t *testing.T) {
+	p := &meshPeer{}
+	for i := 1; i <= 12; i++ {
+		p.record(float64(i), i%4 == 0, 10)
+	}
+	c := p.cell()
+	//只保留最近10次：3~12，其中4、8、12丢失
+	assert.Equal(t, 10, c.Sent)
+	assert.Equal(t, 3, c.Lost)
+	assert.Equal(t, 30.0, c.Loss)
+	assert.Equal(t, 3.0, c.Min)
+	assert.Equal(t, 11.0, c.Max)
+	assert.Equal(t, 11.0, c.Last)
+}
+
+func TestRenderMatrix(t *testing.T) {
+	matrix := meshMatrix{
+		Agents: []string{"sh", "tk"},
+		Rows: map[string]meshRow{
+			"sh": {Agent: "sh", Cells: map[string]meshCell{"tk": {Sent: 100, P50: 30, P99: 32}}},
+			"tk": {Agent: "tk", Cells: map[string]meshCell{"sh": {Sent: 100, Lost: 5, Loss: 5, P50: 31, P99: 60}}},
+		},
+	}
+	out := renderMatrix(matrix, "p50", 1, 50)
+	assert.True(t, strings.Contains(out, "30.00"))
+	assert.True(t, strings.Contains(out, "31.00*"))
+	assert.True(t, strings.Contains(out, "tk -> sh: loss 5.0%"))
+	assert.False(t, strings.Contains(out, "sh -> tk"))
+}
+
+func TestMeshRegister(t *testing.T) {
+	m := newMeshAgent("sh", ":7008", ":7080", "s3cret", time.Second, 10)
+	register := func(port, ts, mac string) {
+		r := httptest.NewRequest("GET", "/mesh/info?from_port="+port+"&ts="+ts, nil)
+		r.RemoteAddr = "192.0.2.7:41000"
+		if mac != "" {
+			r.Header.Set(collectorMacHeader, mac)
+		}
+		m.registerFrom(r)
+	}
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	old := strconv.FormatInt(time.Now().Add(-2*meshRegisterSkew).Unix(), 10)
+	//没有签名、签名错误、时间戳过期、端口非法都不注册
+	register("7080", now, "")
+	register("7080", now, meshRegisterMac("wrong", "7080", now))
+	register("7080", old, meshRegisterMac("s3cret", "7080", old))
+	register("0", now, meshRegisterMac("s3cret", "0", now))
+	register("7081", now, meshRegisterMac("s3cret", "7080", now))
+	assert.Empty(t, m.peers)
+	register("7080", now, meshRegisterMac("s3cret", "7080", now))
+	assert.Contains(t, m.peers, "192.0.2.7:7080")
+
+	//没有配置密钥时不接受注册
+	open := newMeshAgent("tk", ":7008", ":7080", "", time.Second, 10)
+	r := httptest.NewRequest("GET", "/mesh/info?from_port=7080&ts="+now, nil)
+	open.registerFrom(r)
+	assert.Empty(t, open.peers)
+}
+
+func TestMeshExpire(t *testing.T) {
+	m := newMeshAgent("sh", ":7008", ":7080", "", time.Second, 10)
+	m.addPeer("192.0.2.1:7080", true)
+	m.addPeer("192.0.2.2:7080", false)
+	m.addPeer("192.0.2.3:7080", false)
+	now := time.Now()
+	m.peers["192.0.2.3:7080"].lastSeen = now.Add(time.Minute)
+	m.expire(now.Add(meshPeerExpiry - time.Minute))
+	assert.Len(t, m.peers, 3)
+	//--peer 指定的节点不过期，最近应答过的节点保留
+	m.expire(now.Add(meshPeerExpiry + 30*time.Second))
+	assert.Len(t, m.peers, 2)
+	assert.Contains(t, m.peers, "192.0.2.1:7080")
+	assert.Contains(t, m.peers, "192.0.2.3:7080")
+}
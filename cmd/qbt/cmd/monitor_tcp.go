@@ -28,9 +28,10 @@ import (
 	"math"
 	"net"
 	"os"
+	"sort"
+	"sync"
 	"time"
 
-	"github.com/DataDog/datadog-go/v5/statsd"
 	"github.com/qbtrade/qbt/cmd/qbt/cf"
 	"github.com/spf13/cobra"
 )
@@ -62,13 +63,16 @@ var monitorTCPCmd = &cobra.Command{
 		cc.Timeout, _ = cmd.Flags().GetInt("timeout")
 		cc.Interval, _ = cmd.Flags().GetFloat64("interval")
 		cc.Count, _ = cmd.Flags().GetInt("count")
-		cc.Addresses, _ = cmd.Flags().GetStringSlice("addresses")
 		cc.StatsdServer, _ = cmd.Flags().GetString("statsd")
-		if len(args) > 0 { // 支持放在其他参数中 e.g.  qbt monitor-tcp -i 10 -c 10 -a 1.2.3.4:80,2.3.4.5:22 3.4.5.6:8000 4.5.6.7:8001
-			cc.Addresses = append(cc.Addresses, args...)
+		// 支持放在其他参数中 e.g.  qbt monitor-tcp -i 10 -c 10 -a 1.2.3.4:80,2.3.4.5:22 3.4.5.6:8000 4.5.6.7:8001
+		addresses, err := addressesFromFlags(cmd, "addresses", "monitor_tcp.addresses", args...)
+		if err != nil {
+			fmt.Println(err)
+			return
 		}
+		cc.Addresses = addresses
 		fmt.Println("init args", Marshal(cc))
-		statsdClient, err := statsd.New(cc.StatsdServer)
+		statsdClient, err := newStatsdClient(cc.StatsdServer)
 		if err != nil {
 			fmt.Printf("new statsd client to %s error: %v", cc.StatsdServer, err)
 		}
@@ -81,32 +85,76 @@ var monitorTCPCmd = &cobra.Command{
 		cnt := 0
 		summary := newStaticsMsg()
 		stage := newStaticsMsg()
-		for cc.Count > cnt {
+		changes := setupChanges(cmd)
+		stopTUI := setupTUI(cmd)
+		defer stopTUI()
+		if liveTUI != nil {
+			cc.OnlySummary = true
+		}
+		//目标响应慢时上一轮的goroutine还没结束，统计需要加锁
+		var mu sync.Mutex
+		for {
+			mu.Lock()
+			done := cnt >= cc.Count
+			mu.Unlock()
+			if done {
+				break
+			}
 			go func() {
 				for _, address := range cc.Addresses {
+					mu.Lock()
 					cnt += 1
+					seq := cnt
+					mu.Unlock()
 					statsdTags := []string{fmt.Sprintf("host:%s", hostname), fmt.Sprintf("address:%s", address)}
-					d, err := connectTCP(address, time.Duration(cc.Timeout), cnt)
+					d, err := connectTCP(address, time.Duration(cc.Timeout), seq)
+					mu.Lock()
 					if err != nil {
 						stage.FailLength += 1
 					} else {
-						stage.SuccessLength += 1
-						stage.SuccessCost = append(stage.SuccessCost, d)
-						stage.MaxCost = cf.Max(stage.MaxCost, d)
-						stage.MinCost = cf.Min(stage.MinCost, d)
+						stage.add(address, d)
+						if changes != nil {
+							p := storedProbe{Ts: time.Now(), Host: hostname, Target: address, Kind: "monitor_tcp", Rtt: d}
+							if e, ok := changes.add(p); ok {
+								printEvent(e.String())
+								_ = statsdClient.Event(e.statsdEvent())
+							}
+						}
 					}
 					statsdTags = append(statsdTags, fmt.Sprintf("error:%v", err != nil))
 					_ = statsdClient.Histogram("qbt/tcp-monitor", d, statsdTags, 1)
-					if cnt%100 == 0 {
-						fmt.Printf("stage information: [%s]\n", stage.String())
+					if liveTUI != nil {
+						liveTUI.add(address, d, err != nil)
+					}
+					if seq%100 == 0 {
+						if liveTUI == nil {
+							fmt.Printf("stage information: [%s]\n", stage.String())
+						}
+						for address, j := range stage.jitter {
+							if j.Count() == 0 {
+								continue
+							}
+							stageTags := []string{fmt.Sprintf("host:%s", hostname), fmt.Sprintf("address:%s", address)}
+							_ = statsdClient.Gauge("qbt/tcp-monitor-jitter", j.Jitter(), stageTags, 1)
+							_ = statsdClient.Gauge("qbt/tcp-monitor-masd", j.MASD(), stageTags, 1)
+							_ = statsdClient.Gauge("qbt/tcp-monitor-ipdv-p99", j.IPDV(99), stageTags, 1)
+						}
 						mergeStaticMsg(summary, stage)
-						fmt.Printf("summary information: [%s]\n", summary.String())
-						stage = newStaticsMsg()
+						if liveTUI == nil {
+							fmt.Printf("summary information: [%s]\n", summary.String())
+						}
+						stage = summary.next()
 					}
+					mu.Unlock()
 				}
 			}()
-			time.Sleep(time.Duration(cc.Interval*1000) * time.Millisecond)
+			if !sleepOrQuit(time.Duration(cc.Interval*1000) * time.Millisecond) {
+				break
+			}
 		}
+		stopTUI()
+		mu.Lock()
+		defer mu.Unlock()
 		mergeStaticMsg(summary, stage)
 		fmt.Printf("summary information: [%s]\n", summary.String())
 	},
@@ -114,32 +162,96 @@ var monitorTCPCmd = &cobra.Command{
 
 func newStaticsMsg() *StaticsMsg {
 	return &StaticsMsg{
-		SuccessCost: make([]float64, 0, 0),
-		MinCost:     math.MaxInt64,
+		MinCost: math.MaxInt64,
+		sketch:  cf.NewQuantileSketch(staticsAccuracy),
+		jitter:  map[string]*cf.Jitter{},
 	}
 }
 
+// next 合并到s之后的下一段，抖动接着s的最后一次耗时算，段之间的差值不会丢
+func (s *StaticsMsg) next() *StaticsMsg {
+	n := newStaticsMsg()
+	for address, j := range s.jitter {
+		n.jitter[address] = j.Next()
+	}
+	return n
+}
+
+// staticsAccuracy 分位数的相对误差
+const staticsAccuracy = 0.01
+
+// StaticsMsg 连接耗时的流式统计，不保存每次的耗时，内存占用固定
 type StaticsMsg struct {
-	SuccessCost   []float64 // 成功耗时
-	SuccessLength int       // 成功的次数
-	FailLength    int       // 失败的次数
-	MaxCost       float64   // 成功最大耗时
-	MinCost       float64   // 成功最少耗时
-	MeanCost      float64   // 成功平均耗时
+	SuccessLength int     // 成功的次数
+	FailLength    int     // 失败的次数
+	MaxCost       float64 // 成功最大耗时
+	MinCost       float64 // 成功最少耗时
+	MeanCost      float64 // 成功平均耗时
+
+	cost   cf.Welford            // 成功耗时的均值和方差
+	sketch *cf.QuantileSketch    // 成功耗时的分位数
+	jitter map[string]*cf.Jitter // 每个地址相邻两次成功耗时的变化，不同地址的耗时相减没有意义
+}
+
+// add 记录address的一次成功的耗时
+func (s *StaticsMsg) add(address string, d float64) {
+	s.SuccessLength += 1
+	s.cost.Add(d)
+	s.sketch.Add(d)
+	s.jitterOf(address).Add(d)
+	s.MaxCost = cf.Max(s.MaxCost, d)
+	s.MinCost = cf.Min(s.MinCost, d)
+	s.MeanCost = s.cost.Mean()
+}
+
+func (s *StaticsMsg) jitterOf(address string) *cf.Jitter {
+	j, ok := s.jitter[address]
+	if !ok {
+		j = cf.NewJitter()
+		s.jitter[address] = j
+	}
+	return j
+}
+
+// Percentile 成功耗时的第p百分位，相对误差不超过staticsAccuracy
+func (s *StaticsMsg) Percentile(p float64) float64 {
+	return s.sketch.Quantile(p)
+}
+
+// StdDev 成功耗时的标准差
+func (s *StaticsMsg) StdDev() float64 {
+	return s.cost.StdDev()
 }
 
 // mergeStaticMsg 将100个ping信息合并到总的里
 func mergeStaticMsg(s1 *StaticsMsg, s2 *StaticsMsg) {
-	s1.SuccessCost = append(s1.SuccessCost, s2.SuccessCost...)
 	s1.SuccessLength += s2.SuccessLength
 	s1.FailLength += s2.FailLength
 	s1.MaxCost = cf.Max(s1.MaxCost, s2.MaxCost)
 	s1.MinCost = cf.Min(s1.MinCost, s2.MinCost)
+	s1.cost.Merge(s2.cost)
+	s1.sketch.Merge(s2.sketch)
+	for address, j := range s2.jitter {
+		s1.jitterOf(address).Merge(j)
+	}
+	s1.MeanCost = s1.cost.Mean()
 }
 
+// String 总的耗时统计，抖动按地址分别输出
 func (s *StaticsMsg) String() string {
-	s.MeanCost = cf.Mean(s.SuccessCost)
-	return fmt.Sprintf("susscess:%d, fail:%d, max cost:%.2f, min cost:%.2f, mean cost:%.2f", s.SuccessLength, s.FailLength, s.MaxCost, s.MinCost, s.MeanCost)
+	line := fmt.Sprintf("susscess:%d, fail:%d, max cost:%.2f, min cost:%.2f, mean cost:%.2f",
+		s.SuccessLength, s.FailLength, s.MaxCost, s.MinCost, s.MeanCost)
+	addresses := make([]string, 0, len(s.jitter))
+	for address := range s.jitter {
+		addresses = append(addresses, address)
+	}
+	sort.Strings(addresses)
+	for _, address := range addresses {
+		j := s.jitter[address]
+		line += fmt.Sprintf(", %s jitter:%.2f, masd:%.2f, ipdv p50/p99:%.2f/%.2f", address,
+			j.Jitter(), j.MASD(), j.IPDV(50), j.IPDV(99))
+	}
+	return line
 }
 
 type ConnConfig struct {
@@ -158,7 +270,7 @@ func connectTCP(address string, timeout time.Duration, cnt int) (float64, error)
 	start := time.Now()
 	conn, err := net.DialTimeout("tcp", address, timeout*time.Second)
 	if err != nil {
-		fmt.Println("connect address error", err)
+		printEvent(fmt.Sprint("connect address error ", err))
 		return 0, err
 	}
 	duration := time.Since(start) // tcp 连接的时间间隔
@@ -196,6 +308,10 @@ func init() {
 	monitorTCPCmd.Flags().Float64P("interval", "i", 2, "connect interval")
 	monitorTCPCmd.Flags().IntP("count", "c", math.MaxInt, "max count try to connect")
 	//monitorTCPCmd.Flags().IntP("loop", "l", math.MaxInt, "max count for loop")
-	monitorTCPCmd.Flags().StringSliceP("addresses", "a", []string{"10.11.0.1:80"}, "want to connect addresses slice such as a,b,c")
+	monitorTCPCmd.Flags().StringSliceP("addresses", "a", []string{"10.11.0.1:80"}, "want to connect addresses slice such as a,b,c, also CIDR:PORT, IP:PORT-PORT and @file (default from config key monitor_tcp.addresses)")
 	monitorTCPCmd.Flags().String("statsd", "10.11.1.33:8125", "send rtt to statsd")
+	monitorTCPCmd.Flags().Bool("detect-changes", false, "detect latency baseline changes per address and send them as statsd events")
+	addChangeFlags(monitorTCPCmd)
+	addTUIFlags(monitorTCPCmd)
+	addTargetFlags(monitorTCPCmd)
 }
@@ -0,0 +1,67 @@
+package cmd
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStaticsMsg(t *testing.T) {
+	summary, stage := newStaticsMsg(), newStaticsMsg()
+	for i := 1; i <= 100; i++ {
+		stage.add("a", float64(i))
+	}
+	stage.FailLength = 2
+	mergeStaticMsg(summary, stage)
+	stage = summary.next()
+	stage.add("a", 202)
+	mergeStaticMsg(summary, stage)
+
+	//相邻差值是99个1和段之间的102，ipdv是草图的估计值(相对误差1%)
+	j := 0.0
+	for i := 0; i < 99; i++ {
+		j += (1 - j) / 16
+	}
+	j += (102 - j) / 16
+	assert.InDelta(t, j, summary.jitter["a"].Jitter(), 1e-9)
+	assert.Equal(t, "susscess:101, fail:2, max cost:202.00, min cost:1.00, mean cost:52.00, "+
+		"a jitter:7.31, masd:2.01, ipdv p50/p99:0.99/0.99", summary.String())
+	assert.InEpsilon(t, 51.0, summary.Percentile(50), staticsAccuracy)
+	assert.InEpsilon(t, 100.0, summary.Percentile(99), staticsAccuracy)
+}
+
+func TestStaticsMsgJitterPerAddress(t *testing.T) {
+	//两个地址交替，耗时相差100，每个地址自己的耗时不变
+	summary := newStaticsMsg()
+	stage := summary.next()
+	for i := 0; i < 50; i++ {
+		stage.add("a", 1)
+		stage.add("b", 101)
+	}
+	mergeStaticMsg(summary, stage)
+	stage = summary.next()
+	stage.add("a", 3)
+	mergeStaticMsg(summary, stage)
+	assert.Equal(t, 0.0, summary.jitter["b"].Jitter())
+	assert.Equal(t, int64(49), summary.jitter["b"].Count())
+	assert.InDelta(t, 2.0/50, summary.jitter["a"].MASD(), 1e-9)
+	assert.InDelta(t, 2.0/16, summary.jitter["a"].Jitter(), 1e-9)
+	assert.Equal(t, int64(0), stage.jitter["b"].Count())
+}
+
+// BenchmarkStaticsMsg 模拟monitor-tcp每100次合并一次stage，summary的桶数量不随样本数增长
+func BenchmarkStaticsMsg(b *testing.B) {
+	summary := newStaticsMsg()
+	r := rand.New(rand.NewSource(1))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		stage := summary.next()
+		for j := 0; j < 100; j++ {
+			stage.add("a", 0.2+r.ExpFloat64())
+		}
+		mergeStaticMsg(summary, stage)
+	}
+	b.ReportMetric(float64(summary.sketch.Buckets()), "buckets")
+}
@@ -0,0 +1,234 @@
+package cmd
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/qbtrade/qbt/cmd/qbt/cf"
+	"github.com/spf13/cobra"
+)
+
+// owdSample 一次单向时延测量
+type owdSample struct {
+	ts         time.Time
+	forward    time.Duration // 本机到对端
+	reverse    time.Duration // 对端到本机
+	errBound   time.Duration // 时钟偏差带来的误差上界
+	referenced bool          // 两端都同步到参考时钟，否则按对称路径估计偏差
+}
+
+// owdEstimator 根据反射报文的四个时间戳计算去程和回程时延
+type owdEstimator struct {
+	local *clockTracker // 本机的参考时钟，为nil时只能按对称路径估计
+
+	//没有共同参考时钟时，用往返时延最小的样本估计两端时钟偏差(对端减本机)
+	minDelay time.Duration
+	theta    time.Duration
+}
+
+func (e *owdEstimator) estimate(p reflectorPacket, t4 time.Time) owdSample {
+	t1, t2, t3 := time.Unix(0, p.t1), time.Unix(0, p.t2), time.Unix(0, p.t3)
+	sample := owdSample{ts: t1}
+	if e.local != nil && p.flags&reflectorFlagSynced != 0 {
+		if localOffset, localErr, ok := e.local.current(); ok {
+			//两端都换算到参考时钟上再相减
+			remoteOffset := time.Duration(p.refOffset)
+			sample.forward = t2.Sub(t1) + remoteOffset - localOffset
+			sample.reverse = t4.Sub(t3) + localOffset - remoteOffset
+			sample.errBound = time.Duration(p.refError) + localErr
+			sample.referenced = true
+			return sample
+		}
+	}
+	theta, delay := clockOffset(t1, t2, t3, t4)
+	if e.minDelay == 0 || delay < e.minDelay {
+		e.minDelay, e.theta = delay, theta
+	}
+	sample.forward = t2.Sub(t1) - e.theta
+	sample.reverse = t4.Sub(t3) + e.theta
+	sample.errBound = e.minDelay / 2
+	return sample
+}
+
+// owdReport 一个统计窗口内的单向时延汇总
+type owdReport struct {
+	count      int
+	forward    []float64 // ms
+	reverse    []float64 // ms
+	errBound   float64   // 窗口内最大的误差上界，ms
+	referenced bool
+}
+
+func newOwdReport(samples []owdSample) owdReport {
+	r := owdReport{count: len(samples), referenced: true}
+	for _, s := range samples {
+		r.forward = append(r.forward, float64(s.forward.Nanoseconds())/1e6)
+		r.reverse = append(r.reverse, float64(s.reverse.Nanoseconds())/1e6)
+		r.errBound = cf.Max(r.errBound, float64(s.errBound.Nanoseconds())/1e6)
+		r.referenced = r.referenced && s.referenced
+	}
+	return r
+}
+
+// unreliable 判断时钟同步质量是否足以信任单向时延，返回原因
+func (r owdReport) unreliable(maxErrorRatio float64) []string {
+	var reasons []string
+	if !r.referenced {
+		reasons = append(reasons, "clocks not synced to a common reference, forward/reverse split assumes a symmetric path")
+	}
+	minForward, minReverse := cf.Percentile(r.forward, 0), cf.Percentile(r.reverse, 0)
+	if minForward < 0 || minReverse < 0 {
+		reasons = append(reasons, "negative one-way delay, clock offset is wrong")
+	}
+	if base := cf.Min(minForward, minReverse); base > 0 && r.errBound > maxErrorRatio*base {
+		reasons = append(reasons, fmt.Sprintf("clock error ±%.3fms exceeds %.0f%% of the one-way delay %.3fms",
+			r.errBound, maxErrorRatio*100, base))
+	}
+	return reasons
+}
+
+func (r owdReport) String() string {
+	return fmt.Sprintf("samples:%d, forward min/p50/p99: %.3f/%.3f/%.3fms, reverse min/p50/p99: %.3f/%.3f/%.3fms, "+
+		"asymmetry(p50 forward-reverse): %+.3fms, clock error: ±%.3fms",
+		r.count,
+		cf.Percentile(r.forward, 0), cf.Percentile(r.forward, 50), cf.Percentile(r.forward, 99),
+		cf.Percentile(r.reverse, 0), cf.Percentile(r.reverse, 50), cf.Percentile(r.reverse, 99),
+		cf.Percentile(r.forward, 50)-cf.Percentile(r.reverse, 50), r.errBound)
+}
+
+var owdCmd = &cobra.Command{
+	Use:   "owd",
+	Short: "measure one-way delay to a qbt serve reflector",
+	Long: `measure forward and reverse delay separately against qbt serve --reflector (twamp-light style).
+Both sides should sync to the same ntp reference (qbt serve --clock-ref and qbt owd --clock-ref),
+otherwise the clock offset is estimated from the lowest rtt sample and the path is assumed symmetric.
+Results are flagged unreliable when clock sync quality is not good enough.
+For example:
+qbt owd --clock-ref ntp.aliyun.com -i 0.1 10.110.1.86:7008`,
+	Args: func(cmd *cobra.Command, args []string) error {
+		address, _ := cmd.Flags().GetString("address")
+		if address == "" && len(args) == 0 {
+			return fmt.Errorf("no reflector address")
+		}
+		return nil
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		address, _ := cmd.Flags().GetString("address")
+		if len(args) > 0 {
+			address = args[0]
+		}
+		clockRef, _ := cmd.Flags().GetString("clock-ref")
+		interval, _ := cmd.Flags().GetFloat64("interval")
+		count, _ := cmd.Flags().GetInt("count")
+		reportEvery, _ := cmd.Flags().GetInt("report")
+		size, _ := cmd.Flags().GetInt("size")
+		timeout, _ := cmd.Flags().GetFloat64("timeout")
+		maxErrorRatio, _ := cmd.Flags().GetFloat64("max-error-ratio")
+		secret := secretFromFlags(cmd)
+		if collector := setupCollector(cmd); collector != nil {
+			defer collector.close()
+		}
+		hostname, _ := os.Hostname()
+		reportEvery = cf.Max(reportEvery, 1)
+		if secret != "" {
+			size = cf.Max(size, reflectorClockLen+authMacLen)
+		}
+		size = cf.Max(size, reflectorClockLen)
+
+		estimator := &owdEstimator{}
+		if clockRef != "" {
+			estimator.local = newClockTracker(clockRef, clockTrackInterval)
+			//先同步一次，保证第一批样本就能使用参考时钟
+			estimator.local.update()
+			go func() {
+				time.Sleep(clockTrackInterval)
+				estimator.local.run()
+			}()
+		}
+		conn, err := net.Dial("udp", address)
+		if err != nil {
+			fmt.Println("dial reflector error:", err)
+			return
+		}
+		defer conn.Close()
+
+		samples := make([]owdSample, 0, reportEvery)
+		lost := 0
+		for seq := 1; seq <= count; seq++ {
+			start := time.Now()
+			p, t4, err := reflectorProbe(conn, uint64(seq), size, secret, time.Duration(timeout*1000)*time.Millisecond)
+			if err != nil {
+				lost++
+			} else {
+				samples = append(samples, estimator.estimate(p, t4))
+			}
+			if seq%reportEvery == 0 || seq == count {
+				reportOwd(address, hostname, samples, lost, maxErrorRatio)
+				samples = samples[:0]
+				lost = 0
+			}
+			if seq < count {
+				time.Sleep(time.Duration(interval*1000)*time.Millisecond - time.Since(start))
+			}
+		}
+	},
+}
+
+// reportOwd 输出一个窗口的统计并写入influxdb
+func reportOwd(address, hostName string, samples []owdSample, lost int, maxErrorRatio float64) {
+	if len(samples) == 0 {
+		fmt.Printf("one-way delay to %s: all %d probes lost\n", address, lost)
+		return
+	}
+	report := newOwdReport(samples)
+	fmt.Printf("one-way delay to %s: %s, lost:%d\n", address, report.String(), lost)
+	reasons := report.unreliable(maxErrorRatio)
+	if len(reasons) > 0 {
+		fmt.Printf("[UNRELIABLE] %s\n", strings.Join(reasons, "; "))
+	}
+
+	mode := "symmetric"
+	if report.referenced {
+		mode = "reference"
+	}
+	reliable := map[bool]float64{true: 1, false: 0}[len(reasons) == 0]
+	points := make([]cf.InfluxdbPoint, 0, len(samples))
+	for _, s := range samples {
+		points = append(points, cf.InfluxdbPoint{
+			Measurement: "one_way_delay",
+			Tags: map[string]string{
+				"host": hostName,
+				"peer": address,
+				"sync": mode,
+			},
+			Fields: map[string]float64{
+				"forward":  float64(s.forward.Nanoseconds()) / 1e6,
+				"reverse":  float64(s.reverse.Nanoseconds()) / 1e6,
+				"error":    float64(s.errBound.Nanoseconds()) / 1e6,
+				"reliable": reliable,
+			},
+			Time: s.ts,
+		})
+	}
+	if errInfluxdb := cf.WritePoints(points); errInfluxdb != nil {
+		fmt.Println("write to influxdb error", errInfluxdb)
+	}
+}
+
+func init() {
+	rootCmd.AddCommand(owdCmd)
+	owdCmd.Flags().StringP("address", "a", "", "IP:PORT of qbt serve --reflector")
+	owdCmd.Flags().String("clock-ref", "", "ntp server to sync the local timestamps against, should match the reflector's --clock-ref")
+	owdCmd.Flags().Float64P("interval", "i", 0.1, "probe interval in seconds")
+	owdCmd.Flags().IntP("count", "c", math.MaxInt, "max probes")
+	owdCmd.Flags().Int("report", 100, "print a summary every report probes")
+	owdCmd.Flags().Int("size", 64, "probe packet size in bytes")
+	owdCmd.Flags().Float64P("timeout", "t", 2, "probe timeout in seconds")
+	owdCmd.Flags().Float64("max-error-ratio", 0.2, "flag results unreliable when the clock error exceeds this ratio of the one-way delay")
+	addCollectorFlags(owdCmd)
+	owdCmd.Flags().String("secret", "", "shared secret of qbt serve (default from config key secret)")
+}
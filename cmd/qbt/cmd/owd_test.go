@@ -0,0 +1,56 @@
+package cmd
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOwdEstimateSymmetric(t *testing.T) {
+	//对端时钟快10ms，去程3ms，回程1ms
+	t1 := time.Unix(100, 0)
+	p := reflectorPacket{
+		t1: t1.UnixNano(),
+		t2: t1.Add(13 * time.Millisecond).UnixNano(),
+		t3: t1.Add(14 * time.Millisecond).UnixNano(),
+	}
+	t4 := t1.Add(5 * time.Millisecond)
+	e := &owdEstimator{}
+	s := e.estimate(p, t4)
+	//没有参考时钟时只能把往返时延平分
+	assert.False(t, s.referenced)
+	assert.Equal(t, 2*time.Millisecond, s.forward)
+	assert.Equal(t, 2*time.Millisecond, s.reverse)
+	assert.Equal(t, 2*time.Millisecond, s.errBound)
+
+	reasons := newOwdReport([]owdSample{s}).unreliable(0.2)
+	assert.Len(t, reasons, 2)
+}
+
+func TestOwdEstimateReferenced(t *testing.T) {
+	ntp := fakeNtpServer(t, 0)
+	s := newQbtServer("s3cret", 0)
+	s.clock = newClockTracker(ntp, time.Minute)
+	s.clock.update()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer pc.Close()
+	go func() { _ = s.reflect(pc) }()
+
+	conn, err := net.Dial("udp", pc.LocalAddr().String())
+	assert.Nil(t, err)
+	defer conn.Close()
+	e := &owdEstimator{local: newClockTracker(ntp, time.Minute)}
+	e.local.update()
+
+	p, t4, err := reflectorProbe(conn, 1, reflectorClockLen+authMacLen, "s3cret", time.Second)
+	assert.Nil(t, err)
+	assert.Equal(t, uint8(reflectorFlagSynced), p.flags&reflectorFlagSynced)
+	sample := e.estimate(p, t4)
+	assert.True(t, sample.referenced)
+	assert.True(t, sample.errBound > 0)
+	assert.InDelta(t, 0, float64(sample.forward), float64(10*time.Millisecond))
+	assert.InDelta(t, 0, float64(sample.reverse), float64(10*time.Millisecond))
+}
@@ -0,0 +1,448 @@
+package cmd
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/qbtrade/qbt/cmd/qbt/cf"
+	"github.com/spf13/cobra"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+)
+
+const (
+	//IPv4头20字节，ICMP/UDP头各8字节
+	ipv4HeaderLen = 20
+	probeHeadLen  = 8
+	//IPv4要求所有链路至少支持68字节
+	minIPv4MTU = 68
+)
+
+// pmtuOptions 路径MTU探测参数
+type pmtuOptions struct {
+	minMTU  int
+	maxMTU  int
+	retries int
+	timeout time.Duration
+	secret  string
+}
+
+// pmtuResult 一次路径MTU探测的结果
+type pmtuResult struct {
+	Method     string `json:"method"`
+	Target     string `json:"target"`
+	PMTU       int    `json:"pmtu"`         // 探测到的路径MTU，IP报文总长度
+	KernelMTU  int    `json:"kernel_mtu"`   // 内核缓存的路径MTU，未知为0
+	NextHopMTU int    `json:"next_hop_mtu"` // 路由器在frag-needed中报告的MTU，未收到为0
+	MSS        int    `json:"mss"`          // tcp模式下协商的MSS
+	Probes     int    `json:"probes"`
+}
+
+// pmtuProber 发送DF置位、IP总长度为size的报文并判断是否能到达对端
+type pmtuProber interface {
+	probe(size int) (ok bool, nextHopMTU int, err error)
+	kernelMTU() int
+	close()
+}
+
+// icmpPMTUProber 用DF置位的ICMP echo探测，需要root或CAP_NET_RAW
+type icmpPMTUProber struct {
+	conn    *net.IPConn
+	dst     *net.IPAddr
+	id      int
+	seq     int
+	timeout time.Duration
+	buf     []byte
+}
+
+func newIcmpPMTUProber(host string, timeout time.Duration) (*icmpPMTUProber, error) {
+	dst, err := net.ResolveIPAddr("ip4", host)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenIP("ip4:icmp", nil)
+	if err != nil {
+		return nil, fmt.Errorf("open icmp socket (need root or CAP_NET_RAW): %w", err)
+	}
+	raw, err := conn.SyscallConn()
+	if err == nil {
+		err = setDontFragment(raw)
+	}
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return &icmpPMTUProber{
+		conn:    conn,
+		dst:     dst,
+		id:      (os.Getpid() + 1) & 0xffff,
+		timeout: timeout,
+		buf:     make([]byte, 65536),
+	}, nil
+}
+
+func (p *icmpPMTUProber) probe(size int) (bool, int, error) {
+	p.seq = (p.seq + 1) & 0xffff
+	msg := icmp.Message{
+		Type: ipv4.ICMPTypeEcho,
+		Body: &icmp.Echo{ID: p.id, Seq: p.seq, Data: make([]byte, size-ipv4HeaderLen-probeHeadLen)},
+	}
+	b, err := msg.Marshal(nil)
+	if err != nil {
+		return false, 0, err
+	}
+	if _, err = p.conn.WriteToIP(b, p.dst); err != nil {
+		//超过本机出口MTU时内核直接拒绝发送
+		if errors.Is(err, syscall.EMSGSIZE) {
+			return false, 0, nil
+		}
+		return false, 0, err
+	}
+	deadline := time.Now().Add(p.timeout)
+	_ = p.conn.SetReadDeadline(deadline)
+	for {
+		n, from, err := p.conn.ReadFromIP(p.buf)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				return false, 0, nil
+			}
+			return false, 0, err
+		}
+		b := p.buf[:n]
+		if len(b) < 8 {
+			continue
+		}
+		switch {
+		case b[0] == byte(ipv4.ICMPTypeEchoReply) && from.IP.Equal(p.dst.IP):
+			if int(binary.BigEndian.Uint16(b[4:6])) == p.id && int(binary.BigEndian.Uint16(b[6:8])) == p.seq {
+				return true, 0, nil
+			}
+		case b[0] == byte(ipv4.ICMPTypeDestinationUnreachable) && b[1] == 4:
+			//fragmentation needed，第6~8字节是下一跳MTU，之后是原始报文的IP头和前8字节
+			if p.matchOriginal(b[8:]) {
+				return false, int(binary.BigEndian.Uint16(b[6:8])), nil
+			}
+		}
+	}
+}
+
+func (p *icmpPMTUProber) matchOriginal(data []byte) bool {
+	if len(data) < ipv4HeaderLen {
+		return false
+	}
+	ihl := int(data[0]&0x0f) * 4
+	if len(data) < ihl+8 || data[9] != protocolICMP || !net.IP(data[16:20]).Equal(p.dst.IP) {
+		return false
+	}
+	echo := data[ihl:]
+	return int(binary.BigEndian.Uint16(echo[4:6])) == p.id && int(binary.BigEndian.Uint16(echo[6:8])) == p.seq
+}
+
+func (p *icmpPMTUProber) kernelMTU() int {
+	return 0
+}
+
+func (p *icmpPMTUProber) close() {
+	_ = p.conn.Close()
+}
+
+// udpPMTUProber 向 qbt serve --udp-echo 发送DF置位的UDP报文，收到回包说明该大小能通过
+type udpPMTUProber struct {
+	conn    *net.UDPConn
+	timeout time.Duration
+	secret  string
+	seq     uint64
+	buf     []byte
+}
+
+func newUdpPMTUProber(address string, timeout time.Duration, secret string) (*udpPMTUProber, error) {
+	raddr, err := net.ResolveUDPAddr("udp4", address)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.DialUDP("udp4", nil, raddr)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := conn.SyscallConn()
+	if err == nil {
+		err = setDontFragment(raw)
+	}
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return &udpPMTUProber{conn: conn, timeout: timeout, secret: secret, buf: make([]byte, 65536)}, nil
+}
+
+func (p *udpPMTUProber) probe(size int) (bool, int, error) {
+	out := make([]byte, size-ipv4HeaderLen-probeHeadLen)
+	if len(out) < 8+authMacLen {
+		return false, 0, fmt.Errorf("udp probe size %d too small", size)
+	}
+	p.seq++
+	binary.BigEndian.PutUint64(out[0:8], p.seq)
+	if p.secret != "" {
+		signDatagram(p.secret, out)
+	}
+	if _, err := p.conn.Write(out); err != nil {
+		if errors.Is(err, syscall.EMSGSIZE) {
+			return false, p.kernelMTU(), nil
+		}
+		return false, 0, err
+	}
+	_ = p.conn.SetReadDeadline(time.Now().Add(p.timeout))
+	for {
+		n, err := p.conn.Read(p.buf)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				return false, 0, nil
+			}
+			return false, 0, err
+		}
+		if n == len(out) && binary.BigEndian.Uint64(p.buf[0:8]) == p.seq {
+			return true, 0, nil
+		}
+	}
+}
+
+func (p *udpPMTUProber) kernelMTU() int {
+	raw, err := p.conn.SyscallConn()
+	if err != nil {
+		return 0
+	}
+	mtu, err := kernelPathMTU(raw)
+	if err != nil {
+		return 0
+	}
+	return mtu
+}
+
+func (p *udpPMTUProber) close() {
+	_ = p.conn.Close()
+}
+
+// searchPMTU 二分查找能通过的最大报文，每个大小最多尝试retries次以区分丢包和报文过大
+func searchPMTU(p pmtuProber, opts pmtuOptions) (pmtu, nextHop, probes int, err error) {
+	try := func(size int) (bool, error) {
+		for i := 0; i < opts.retries; i++ {
+			probes++
+			ok, hop, err := p.probe(size)
+			if err != nil {
+				return false, err
+			}
+			if hop > 0 {
+				nextHop = hop
+				return false, nil
+			}
+			if ok {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+	lo, hi := opts.minMTU, opts.maxMTU
+	ok, err := try(hi)
+	if err != nil || ok {
+		return hi, nextHop, probes, err
+	}
+	//路由器报告了下一跳MTU时直接缩小上界
+	if nextHop >= lo && nextHop < hi {
+		if ok, err = try(nextHop); err != nil || ok {
+			return nextHop, nextHop, probes, err
+		}
+		hi = nextHop
+	}
+	if ok, err = try(lo); err != nil {
+		return 0, nextHop, probes, err
+	}
+	if !ok {
+		return 0, nextHop, probes, fmt.Errorf("no reply even for %d bytes", lo)
+	}
+	for hi-lo > 1 {
+		mid := (lo + hi) / 2
+		if ok, err = try(mid); err != nil {
+			return 0, nextHop, probes, err
+		}
+		if ok {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	return lo, nextHop, probes, nil
+}
+
+// discoverPMTU 按method探测到address的路径MTU
+func discoverPMTU(method, address string, opts pmtuOptions) (result pmtuResult, err error) {
+	result = pmtuResult{Method: method, Target: address}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return result, err
+	}
+	var prober pmtuProber
+	switch method {
+	case "tcp":
+		return tcpMSSResult(result, address, opts.timeout)
+	case "icmp":
+		prober, err = newIcmpPMTUProber(host, opts.timeout)
+	case "udp":
+		prober, err = newUdpPMTUProber(address, opts.timeout, opts.secret)
+	default:
+		return result, fmt.Errorf("unknown pmtu method %q", method)
+	}
+	if err != nil {
+		return result, err
+	}
+	defer prober.close()
+	result.PMTU, result.NextHopMTU, result.Probes, err = searchPMTU(prober, opts)
+	result.KernelMTU = prober.kernelMTU()
+	return result, err
+}
+
+// tcpMSSResult 建立TCP连接读取MSS，MSS加上IP和TCP头即为两端接口MTU的估计
+func tcpMSSResult(result pmtuResult, address string, timeout time.Duration) (pmtuResult, error) {
+	conn, err := net.DialTimeout("tcp4", address, timeout)
+	if err != nil {
+		return result, err
+	}
+	defer conn.Close()
+	raw, err := conn.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		return result, err
+	}
+	result.Probes = 1
+	if result.MSS, err = tcpMaxSeg(raw); err != nil {
+		return result, err
+	}
+	result.PMTU = result.MSS + ipv4HeaderLen + 20
+	if result.KernelMTU, err = kernelPathMTU(raw); err != nil {
+		result.KernelMTU = 0
+	}
+	return result, nil
+}
+
+func (r pmtuResult) String() string {
+	s := fmt.Sprintf("path mtu to %s (%s): %d", r.Target, r.Method, r.PMTU)
+	if r.MSS > 0 {
+		s += fmt.Sprintf(", mss %d", r.MSS)
+	}
+	if r.NextHopMTU > 0 {
+		s += fmt.Sprintf(", next-hop mtu %d", r.NextHopMTU)
+	}
+	if r.KernelMTU > 0 {
+		s += fmt.Sprintf(", kernel mtu %d", r.KernelMTU)
+	}
+	return s + fmt.Sprintf(", %d probes", r.Probes)
+}
+
+// watchPMTU 定期探测路径MTU，发生变化时告警并写入influxdb
+func watchPMTU(method, address, hostName string, interval time.Duration, count int, opts pmtuOptions) {
+	last := 0
+	for n := 1; n <= count; n++ {
+		start := time.Now()
+		result, err := discoverPMTU(method, address, opts)
+		if err != nil {
+			fmt.Println("\npmtu", address, "error:", err)
+		} else {
+			changed := last != 0 && result.PMTU != last
+			if changed {
+				fmt.Printf("\n[ALERT] path mtu to %s changed %d -> %d\n", address, last, result.PMTU)
+			} else {
+				fmt.Println(result.String())
+			}
+			last = result.PMTU
+			errInfluxdb := cf.WritePoints([]cf.InfluxdbPoint{{
+				Measurement: "pmtu",
+				Tags: map[string]string{
+					"host":   hostName,
+					"target": address,
+					"method": method,
+				},
+				Fields: map[string]float64{
+					"mtu":     float64(result.PMTU),
+					"changed": map[bool]float64{true: 1, false: 0}[changed],
+				},
+				Time: start,
+			}})
+			if errInfluxdb != nil {
+				fmt.Println("write to influxdb error", errInfluxdb)
+			}
+		}
+		if n < count {
+			time.Sleep(interval - time.Since(start))
+		}
+	}
+}
+
+var pmtuCmd = &cobra.Command{
+	Use:   "pmtu",
+	Short: "discover path mtu to a target",
+	Long: `discover path mtu to IP:PORT.
+--mode icmp  binary search with DF set icmp echo (needs root or CAP_NET_RAW)
+--mode udp   binary search with DF set udp datagrams, peer runs qbt serve --udp-echo
+--mode tcp   read the negotiated tcp mss
+For example:
+qbt pmtu --mode icmp 10.110.1.86:22
+qbt pmtu --mode udp --interval 60 10.110.1.86:7007`,
+	Args: func(cmd *cobra.Command, args []string) error {
+		address, _ := cmd.Flags().GetString("address")
+		if address == "" && len(args) == 0 {
+			return fmt.Errorf("no address to probe")
+		}
+		return nil
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		address, _ := cmd.Flags().GetString("address")
+		if len(args) > 0 {
+			address = args[0]
+		}
+		method, _ := cmd.Flags().GetString("mode")
+		interval, _ := cmd.Flags().GetFloat64("interval")
+		count, _ := cmd.Flags().GetInt("count")
+		opts := pmtuOptionsFromFlags(cmd)
+		if interval <= 0 {
+			count = 1
+		}
+		hostname, _ := os.Hostname()
+		watchPMTU(method, address, hostname, time.Duration(interval*1000)*time.Millisecond, count, opts)
+	},
+}
+
+func pmtuOptionsFromFlags(cmd *cobra.Command) pmtuOptions {
+	opts := pmtuOptions{secret: secretFromFlags(cmd)}
+	opts.minMTU, _ = cmd.Flags().GetInt("min-mtu")
+	opts.maxMTU, _ = cmd.Flags().GetInt("max-mtu")
+	opts.retries, _ = cmd.Flags().GetInt("pmtu-retries")
+	timeout, _ := cmd.Flags().GetFloat64("pmtu-timeout")
+	opts.timeout = time.Duration(timeout*1000) * time.Millisecond
+	opts.minMTU = cf.Max(opts.minMTU, minIPv4MTU)
+	opts.retries = cf.Max(opts.retries, 1)
+	return opts
+}
+
+// addPMTUFlags 注册路径MTU探测的参数，pmtu和tcp-ping共用
+func addPMTUFlags(cmd *cobra.Command) {
+	cmd.Flags().Int("min-mtu", 576, "smallest mtu to probe")
+	cmd.Flags().Int("max-mtu", 1500, "largest mtu to probe")
+	cmd.Flags().Int("pmtu-retries", 2, "probes per size before treating it as too big")
+	cmd.Flags().Float64("pmtu-timeout", 1, "wait time for each pmtu probe in seconds")
+}
+
+func init() {
+	rootCmd.AddCommand(pmtuCmd)
+	pmtuCmd.Flags().StringP("address", "a", "", "IP:PORT to probe")
+	pmtuCmd.Flags().String("mode", "icmp", "probe mode: icmp, udp or tcp")
+	pmtuCmd.Flags().Float64P("interval", "i", 0, "re-check every interval seconds and alert on changes, 0 runs once")
+	pmtuCmd.Flags().IntP("count", "c", math.MaxInt, "max checks with --interval")
+	pmtuCmd.Flags().String("secret", "", "shared secret of qbt serve for --mode udp (default from config key secret)")
+	addPMTUFlags(pmtuCmd)
+}
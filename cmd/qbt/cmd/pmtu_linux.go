@@ -0,0 +1,41 @@
+package cmd
+
+import (
+	"syscall"
+)
+
+// setDontFragment 设置DF位并忽略内核缓存的PMTU，这样才能真正探测更大的报文
+func setDontFragment(c syscall.RawConn) error {
+	var opErr error
+	err := c.Control(func(fd uintptr) {
+		opErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, syscall.IP_PMTUDISC_PROBE)
+	})
+	if err != nil {
+		return err
+	}
+	return opErr
+}
+
+// kernelPathMTU 读取内核为已连接socket缓存的路径MTU
+func kernelPathMTU(c syscall.RawConn) (mtu int, err error) {
+	var opErr error
+	err = c.Control(func(fd uintptr) {
+		mtu, opErr = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_MTU)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return mtu, opErr
+}
+
+// tcpMaxSeg 读取已建立TCP连接协商后的MSS
+func tcpMaxSeg(c syscall.RawConn) (mss int, err error) {
+	var opErr error
+	err = c.Control(func(fd uintptr) {
+		mss, opErr = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_MAXSEG)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return mss, opErr
+}
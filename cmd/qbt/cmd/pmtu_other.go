@@ -0,0 +1,22 @@
+//go:build !linux
+
+package cmd
+
+import (
+	"errors"
+	"syscall"
+)
+
+var errPMTUUnsupported = errors.New("path mtu discovery is only supported on linux")
+
+func setDontFragment(c syscall.RawConn) error {
+	return errPMTUUnsupported
+}
+
+func kernelPathMTU(c syscall.RawConn) (int, error) {
+	return 0, errPMTUUnsupported
+}
+
+func tcpMaxSeg(c syscall.RawConn) (int, error) {
+	return 0, errPMTUUnsupported
+}
@@ -0,0 +1,50 @@
+package cmd
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakePMTUProber 模拟一条路径，大于mtu的报文会被丢弃，reportHop为true时像路由器一样回复frag-needed
+type fakePMTUProber struct {
+	mtu       int
+	reportHop bool
+}
+
+func (p *fakePMTUProber) probe(size int) (bool, int, error) {
+	if size <= p.mtu {
+		return true, 0, nil
+	}
+	if p.reportHop {
+		return false, p.mtu, nil
+	}
+	return false, 0, nil
+}
+
+func (p *fakePMTUProber) kernelMTU() int { return 0 }
+
+func (p *fakePMTUProber) close() {}
+
+func TestSearchPMTU(t *testing.T) {
+	opts := pmtuOptions{minMTU: 576, maxMTU: 1500, retries: 2}
+
+	pmtu, _, _, err := searchPMTU(&fakePMTUProber{mtu: 1500}, opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 1500, pmtu)
+
+	pmtu, nextHop, _, err := searchPMTU(&fakePMTUProber{mtu: 1400}, opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 1400, pmtu)
+	assert.Equal(t, 0, nextHop)
+
+	//收到frag-needed时两次探测即可确定
+	pmtu, nextHop, probes, err := searchPMTU(&fakePMTUProber{mtu: 1420, reportHop: true}, opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 1420, pmtu)
+	assert.Equal(t, 1420, nextHop)
+	assert.Equal(t, 2, probes)
+
+	_, _, _, err = searchPMTU(&fakePMTUProber{mtu: 100}, opts)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,314 @@
+package cmd
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/qbtrade/qbt/cmd/qbt/cf"
+	"github.com/spf13/cobra"
+)
+
+// protoProber 在已建立的连接上发一个协议层的请求并读回应，返回回应的简短描述
+type protoProber func(conn net.Conn, r *bufio.Reader) (string, error)
+
+// protoProbers 支持的协议和默认端口
+var protoProbers = map[string]struct {
+	port  string
+	probe protoProber
+}{
+	"redis":    {"6379", redisPing},
+	"postgres": {"5432", postgresSSLRequest},
+	"kafka":    {"9092", kafkaApiVersions},
+}
+
+// redisPing 发送 PING，回应 +PONG，需要认证时的错误回应(-NOAUTH)也说明服务在处理请求
+func redisPing(conn net.Conn, r *bufio.Reader) (string, error) {
+	if _, err := conn.Write([]byte("*1\r\n$4\r\nPING\r\n")); err != nil {
+		return "", err
+	}
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if !strings.HasPrefix(line, "+") && !strings.HasPrefix(line, "-") {
+		return "", fmt.Errorf("unexpected redis reply %q", line)
+	}
+	return line[1:], nil
+}
+
+// postgresSSLRequest 发送SSLRequest，服务端回一个字节 S 或 N，不需要账号密码
+func postgresSSLRequest(conn net.Conn, r *bufio.Reader) (string, error) {
+	req := make([]byte, 8)
+	binary.BigEndian.PutUint32(req[0:4], 8)
+	binary.BigEndian.PutUint32(req[4:8], 80877103)
+	if _, err := conn.Write(req); err != nil {
+		return "", err
+	}
+	b, err := r.ReadByte()
+	if err != nil {
+		return "", err
+	}
+	switch b {
+	case 'S':
+		return "ssl supported", nil
+	case 'N':
+		return "ssl not supported", nil
+	case 'E':
+		//很老的版本不认识SSLRequest，回ErrorResponse
+		return "error response", nil
+	}
+	return "", fmt.Errorf("unexpected postgres reply %q", b)
+}
+
+// kafkaApiVersions 发送 ApiVersions v0 请求，检查correlation id，返回支持的api数量
+func kafkaApiVersions(conn net.Conn, r *bufio.Reader) (string, error) {
+	const clientID = "qbt"
+	correlationID := uint32(time.Now().UnixNano())
+	req := make([]byte, 4+2+2+4+2+len(clientID))
+	binary.BigEndian.PutUint32(req[0:4], uint32(len(req)-4))
+	binary.BigEndian.PutUint16(req[4:6], 18) // api_key ApiVersions
+	binary.BigEndian.PutUint16(req[6:8], 0)  // api_version
+	binary.BigEndian.PutUint32(req[8:12], correlationID)
+	binary.BigEndian.PutUint16(req[12:14], uint16(len(clientID)))
+	copy(req[14:], clientID)
+	if _, err := conn.Write(req); err != nil {
+		return "", err
+	}
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return "", err
+	}
+	size := binary.BigEndian.Uint32(header)
+	if size < 10 || size > 1<<20 {
+		return "", fmt.Errorf("unexpected kafka response size %d", size)
+	}
+	resp := make([]byte, size)
+	if _, err := io.ReadFull(r, resp); err != nil {
+		return "", err
+	}
+	if id := binary.BigEndian.Uint32(resp[0:4]); id != correlationID {
+		return "", fmt.Errorf("kafka correlation id %d, want %d", id, correlationID)
+	}
+	if code := int16(binary.BigEndian.Uint16(resp[4:6])); code != 0 {
+		return fmt.Sprintf("error code %d", code), nil
+	}
+	return fmt.Sprintf("%d apis", binary.BigEndian.Uint32(resp[6:10])), nil
+}
+
+// parseProtoTarget 解析 redis://host[:port]，没有端口时用协议的默认端口
+func parseProtoTarget(target string) (proto, address string, err error) {
+	proto, hostPort, ok := strings.Cut(target, "://")
+	if !ok {
+		return "", "", fmt.Errorf("invalid target %q, want PROTO://HOST[:PORT]", target)
+	}
+	p, ok := protoProbers[proto]
+	if !ok {
+		return "", "", fmt.Errorf("unknown protocol %s in %s, want redis, postgres or kafka", proto, target)
+	}
+	if _, _, err := net.SplitHostPort(hostPort); err != nil {
+		hostPort = net.JoinHostPort(strings.Trim(hostPort, "[]"), p.port)
+	}
+	return proto, hostPort, nil
+}
+
+// protoResult 一次探测的结果，协议层超时时connect有值而err不为空
+type protoResult struct {
+	connect time.Duration
+	rtt     time.Duration // 从发送请求到读完回应
+	detail  string
+	stage   string // 出错的阶段：connect 或 protocol
+	err     error
+}
+
+// protoProbe 新建连接并做一次协议层的请求
+func protoProbe(proto, address string, timeout time.Duration) (res protoResult) {
+	start := time.Now()
+	conn, err := net.DialTimeout("tcp", address, timeout)
+	if err != nil {
+		res.stage, res.err = "connect", err
+		return res
+	}
+	defer conn.Close()
+	res.connect = time.Since(start)
+	_ = conn.SetDeadline(time.Now().Add(timeout))
+	start = time.Now()
+	res.detail, err = protoProbers[proto].probe(conn, bufio.NewReader(conn))
+	res.rtt = time.Since(start)
+	if err != nil {
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			err = fmt.Errorf("connected in %.3fms but no %s reply within %v", float64(res.connect.Nanoseconds())/1e6,
+				proto, timeout)
+		}
+		res.stage, res.err = "protocol", err
+	}
+	return res
+}
+
+func protoPoint(hostName, proto, address string, ts time.Time, res protoResult) cf.InfluxdbPoint {
+	ip, port, _ := net.SplitHostPort(address)
+	fields := map[string]float64{
+		"connect":        float64(res.connect.Nanoseconds()) / 1e6,
+		"loss":           0,
+		"protocol_error": 0,
+	}
+	if res.err == nil {
+		fields["rtt"] = float64(res.rtt.Nanoseconds()) / 1e6
+	} else if res.stage == "connect" {
+		fields["loss"] = 1
+	} else {
+		fields["protocol_error"] = 1
+	}
+	return cf.InfluxdbPoint{
+		Measurement: "proto_ping",
+		Tags: map[string]string{
+			"host":  hostName,
+			"ip":    ip,
+			"port":  port,
+			"proto": proto,
+		},
+		Fields: fields,
+		Time:   ts,
+	}
+}
+
+// protoStats 一个target的连接和协议往返时间，流式统计，-c默认不限次数时内存也不会增长
+type protoStats struct {
+	connects *StaticsMsg
+	rtts     *StaticsMsg
+	errors   map[string]int
+}
+
+var protoPingCmd = &cobra.Command{
+	Use:   "proto-ping",
+	Short: "probe redis, postgres and kafka at the protocol level",
+	Long: `open a new connection to each target every --interval seconds, send one protocol request and measure
+the connect time and the protocol round trip separately, so a server that accepts tcp but hangs is reported:
+redis PING, postgres SSLRequest (no credentials needed) and kafka ApiVersions.
+Targets are PROTO://HOST[:PORT], the port defaults to 6379, 5432 and 9092.
+For example:
+qbt proto-ping -a redis://10.11.1.30,postgres://10.11.1.31:5432,kafka://10.11.1.32:9092 -i 5
+qbt proto-ping -a kafka://10.11.1.32 -c 100 --only-summary`,
+	Args: func(cmd *cobra.Command, args []string) error {
+		targets, _ := cmd.Flags().GetStringSlice("address")
+		if len(targets) == 0 {
+			return fmt.Errorf("no address to probe")
+		}
+		for _, target := range targets {
+			if _, _, err := parseProtoTarget(target); err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		targets, _ := cmd.Flags().GetStringSlice("address")
+		interval, _ := cmd.Flags().GetFloat64("interval")
+		count, _ := cmd.Flags().GetInt("count")
+		timeout, _ := cmd.Flags().GetFloat64("timeout")
+		onlySummary, _ := cmd.Flags().GetBool("only-summary")
+		if collector := setupCollector(cmd); collector != nil {
+			defer collector.close()
+		}
+		setupStore(cmd)
+		hostname, _ := os.Hostname()
+		interrupt := make(chan os.Signal, 1)
+		signal.Notify(interrupt, os.Interrupt)
+		stop := make(chan struct{})
+		go func() {
+			<-interrupt
+			close(stop)
+		}()
+
+		var (
+			mu     sync.Mutex
+			points []cf.InfluxdbPoint
+			stats  = map[string]*protoStats{}
+			wg     sync.WaitGroup
+		)
+		record := func(target, proto, address string, start time.Time, res protoResult) {
+			connectMs, rttMs := float64(res.connect.Nanoseconds())/1e6, float64(res.rtt.Nanoseconds())/1e6
+			if res.err != nil {
+				fmt.Printf("proto-ping (%s) %s error: %v\n", target, res.stage, res.err)
+			} else if !onlySummary {
+				fmt.Printf("proto-ping (%s) connect=%.3fms rtt=%.3fms %s\n", target, connectMs, rttMs, res.detail)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			s := stats[target]
+			if res.err == nil {
+				s.connects.add(target, connectMs)
+				s.rtts.add(target, rttMs)
+			} else {
+				s.errors[res.stage]++
+			}
+			points = append(points, protoPoint(hostname, proto, address, start, res))
+			if probeStore != nil {
+				probeStore.addProbe(storedProbe{Ts: start, Host: hostname, Target: address, Kind: proto + "_ping",
+					Rtt: rttMs, Loss: res.err != nil})
+			}
+			if len(points) >= 100 {
+				points = flushInfluxPoints(points)
+				flushStore()
+			}
+		}
+		for _, target := range targets {
+			proto, address, _ := parseProtoTarget(target)
+			stats[target] = &protoStats{connects: newStaticsMsg(), rtts: newStaticsMsg(), errors: map[string]int{}}
+			wg.Add(1)
+			go func(target, proto, address string) {
+				defer wg.Done()
+				for seq := 1; seq <= count; seq++ {
+					start := time.Now()
+					record(target, proto, address, start, protoProbe(proto, address,
+						time.Duration(timeout*1000)*time.Millisecond))
+					select {
+					case <-stop:
+						return
+					case <-time.After(time.Duration(interval*1000)*time.Millisecond - time.Since(start)):
+					}
+				}
+			}(target, proto, address)
+		}
+		wg.Wait()
+		if len(points) > 0 {
+			flushInfluxPoints(points)
+		}
+		flushStore()
+		sort.Strings(targets)
+		for _, target := range targets {
+			s := stats[target]
+			line := fmt.Sprintf("proto-ping (%s) ok:%d, connect errors:%d, protocol errors:%d", target, s.rtts.SuccessLength,
+				s.errors["connect"], s.errors["protocol"])
+			if s.rtts.SuccessLength > 0 {
+				line += fmt.Sprintf(", connect mean:%.3fms p99:%.3fms, rtt mean:%.3fms p50:%.3fms p99:%.3fms, max:%.3fms",
+					s.connects.MeanCost, s.connects.Percentile(99), s.rtts.MeanCost, s.rtts.Percentile(50),
+					s.rtts.Percentile(99), s.rtts.MaxCost)
+			}
+			fmt.Println(line)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(protoPingCmd)
+	protoPingCmd.Flags().StringSliceP("address", "a", nil, "targets PROTO://HOST[:PORT], PROTO is redis, postgres or kafka")
+	protoPingCmd.Flags().Float64P("interval", "i", 1, "seconds between probes")
+	protoPingCmd.Flags().IntP("count", "c", math.MaxInt, "max probes per target")
+	protoPingCmd.Flags().Float64P("timeout", "t", 2, "timeout in seconds of the connect and of the protocol reply")
+	protoPingCmd.Flags().Bool("only-summary", false, "display only errors and the summary")
+	addCollectorFlags(protoPingCmd)
+	addStoreFlags(protoPingCmd)
+}
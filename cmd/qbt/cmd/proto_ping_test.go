@@ -0,0 +1,107 @@
+package cmd
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// protoStub 测试用的服务端，每个连接交给handle处理
+func protoStub(t *testing.T, handle func(conn net.Conn)) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	t.Cleanup(func() { _ = ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				handle(conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestParseProtoTarget(t *testing.T) {
+	proto, address, err := parseProtoTarget("redis://10.11.1.30")
+	assert.Nil(t, err)
+	assert.Equal(t, "redis", proto)
+	assert.Equal(t, "10.11.1.30:6379", address)
+	_, address, _ = parseProtoTarget("kafka://[fd00::1]")
+	assert.Equal(t, "[fd00::1]:9092", address)
+	_, address, _ = parseProtoTarget("postgres://db:6432")
+	assert.Equal(t, "db:6432", address)
+	_, _, err = parseProtoTarget("mysql://db")
+	assert.NotNil(t, err)
+	_, _, err = parseProtoTarget("db:5432")
+	assert.NotNil(t, err)
+}
+
+func TestProtoProbe(t *testing.T) {
+	redis := protoStub(t, func(conn net.Conn) {
+		line, _ := bufio.NewReader(conn).ReadString('\n')
+		if line == "*1\r\n" {
+			_, _ = conn.Write([]byte("+PONG\r\n"))
+		}
+	})
+	res := protoProbe("redis", redis, time.Second)
+	assert.Nil(t, res.err)
+	assert.Equal(t, "PONG", res.detail)
+	assert.True(t, res.connect > 0 && res.rtt > 0)
+
+	postgres := protoStub(t, func(conn net.Conn) {
+		req := make([]byte, 8)
+		_, _ = io.ReadFull(conn, req)
+		if binary.BigEndian.Uint32(req[4:]) == 80877103 {
+			_, _ = conn.Write([]byte("N"))
+		}
+	})
+	res = protoProbe("postgres", postgres, time.Second)
+	assert.Nil(t, res.err)
+	assert.Equal(t, "ssl not supported", res.detail)
+
+	kafka := protoStub(t, func(conn net.Conn) {
+		header := make([]byte, 4)
+		_, _ = io.ReadFull(conn, header)
+		req := make([]byte, binary.BigEndian.Uint32(header))
+		_, _ = io.ReadFull(conn, req)
+		assert.Equal(t, uint16(18), binary.BigEndian.Uint16(req[0:2]))
+		//correlation id、error code 0、2个api各6字节
+		resp := make([]byte, 4+4+2+4+12)
+		binary.BigEndian.PutUint32(resp[0:4], uint32(len(resp)-4))
+		copy(resp[4:8], req[4:8])
+		binary.BigEndian.PutUint32(resp[10:14], 2)
+		_, _ = conn.Write(resp)
+	})
+	res = protoProbe("kafka", kafka, time.Second)
+	assert.Nil(t, res.err)
+	assert.Equal(t, "2 apis", res.detail)
+
+	//接受连接但协议层不回应
+	hang := protoStub(t, func(conn net.Conn) {
+		time.Sleep(time.Second)
+	})
+	res = protoProbe("redis", hang, 200*time.Millisecond)
+	assert.NotNil(t, res.err)
+	assert.Equal(t, "protocol", res.stage)
+	assert.True(t, res.connect > 0)
+	assert.Contains(t, res.err.Error(), "no redis reply")
+	point := protoPoint("h", "redis", hang, time.Now(), res)
+	assert.Equal(t, 1.0, point.Fields["protocol_error"])
+	assert.Equal(t, 0.0, point.Fields["loss"])
+
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	closed := ln.Addr().String()
+	_ = ln.Close()
+	res = protoProbe("postgres", closed, 200*time.Millisecond)
+	assert.Equal(t, "connect", res.stage)
+}
@@ -0,0 +1,274 @@
+package cmd
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/qbtrade/qbt/cmd/qbt/cf"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// queryRow 一个target在一个时间区间内的聚合结果
+type queryRow struct {
+	Start       time.Time          `json:"start"`
+	Target      string             `json:"target"`
+	Count       int                `json:"count"`
+	Loss        int                `json:"loss"`
+	LossPct     float64            `json:"loss_pct"`
+	Min         float64            `json:"min"`
+	Mean        float64            `json:"mean"`
+	Max         float64            `json:"max"`
+	Percentiles map[string]float64 `json:"percentiles"`
+}
+
+// queryAggregator 按target和时间区间分组累计rtt
+type queryAggregator struct {
+	interval    time.Duration
+	percentiles []float64
+	groups      map[string]*queryGroup
+}
+
+type queryGroup struct {
+	start  time.Time
+	target string
+	rtts   []float64
+	loss   int
+}
+
+func newQueryAggregator(interval time.Duration, percentiles []float64) *queryAggregator {
+	return &queryAggregator{interval: interval, percentiles: percentiles, groups: map[string]*queryGroup{}}
+}
+
+func (a *queryAggregator) add(target string, ts time.Time, rtt float64, loss bool) {
+	start := time.Time{}
+	if a.interval > 0 {
+		start = ts.Truncate(a.interval).Local()
+	}
+	key := target + "|" + strconv.FormatInt(start.UnixNano(), 10)
+	g, ok := a.groups[key]
+	if !ok {
+		g = &queryGroup{start: start, target: target}
+		a.groups[key] = g
+	}
+	if loss {
+		g.loss++
+	} else {
+		g.rtts = append(g.rtts, rtt)
+	}
+}
+
+// rows 按target和时间排序输出
+func (a *queryAggregator) rows() []queryRow {
+	rows := make([]queryRow, 0, len(a.groups))
+	for _, g := range a.groups {
+		row := queryRow{Start: g.start, Target: g.target, Count: len(g.rtts) + g.loss, Loss: g.loss,
+			Percentiles: map[string]float64{}}
+		row.LossPct = float64(g.loss) / float64(row.Count) * 100
+		if len(g.rtts) > 0 {
+			row.Min = cf.Min(g.rtts[0], g.rtts...)
+			row.Mean = cf.Mean(g.rtts)
+			row.Max = cf.Max(g.rtts[0], g.rtts...)
+			for _, p := range a.percentiles {
+				row.Percentiles[percentileName(p)] = cf.Percentile(g.rtts, p)
+			}
+		}
+		rows = append(rows, row)
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		if rows[i].Target != rows[j].Target {
+			return rows[i].Target < rows[j].Target
+		}
+		return rows[i].Start.Before(rows[j].Start)
+	})
+	return rows
+}
+
+func percentileName(p float64) string {
+	return "p" + strconv.FormatFloat(p, 'f', -1, 64)
+}
+
+// parseQueryTime 支持RFC3339、2006-01-02 15:04:05、2006-01-02 15:04、2006-01-02 和相对现在的 -1h
+func parseQueryTime(s string, now time.Time) (time.Time, error) {
+	if s == "" || s == "now" {
+		return now, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(d), nil
+	}
+	if ts, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return ts, nil
+	}
+	for _, layout := range []string{"2006-01-02 15:04:05", "2006-01-02 15:04", "2006-01-02"} {
+		if ts, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return ts, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q", s)
+}
+
+// targetMatcher target支持path.Match的通配符，为空匹配全部
+func targetMatcher(patterns []string) func(string) bool {
+	return func(target string) bool {
+		if len(patterns) == 0 {
+			return true
+		}
+		for _, pattern := range patterns {
+			if ok, _ := path.Match(pattern, target); ok || pattern == target {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+var queryCmd = &cobra.Command{
+	Use:   "query",
+	Short: "query probe results recorded with --store",
+	Long: `query probe results recorded by tcp-ping --store, aggregated per target and interval.
+--from/--to accept 2006-01-02 15:04:05, RFC3339 or a duration relative to now such as -1h.
+--target accepts wildcards such as 10.110.1.*:22.
+--summaries lists the recorded window summaries instead of aggregating the probes.
+For example:
+qbt query --store qbt.db --from -24h --interval 1h --target 10.110.1.86:22 --percentiles 50,90,99,99.9`,
+	Run: func(cmd *cobra.Command, args []string) {
+		storePath, _ := cmd.Flags().GetString("store")
+		fromStr, _ := cmd.Flags().GetString("from")
+		toStr, _ := cmd.Flags().GetString("to")
+		targets, _ := cmd.Flags().GetStringSlice("target")
+		interval, _ := cmd.Flags().GetDuration("interval")
+		percentiles, _ := cmd.Flags().GetFloat64Slice("percentiles")
+		format, _ := cmd.Flags().GetString("format")
+		summaries, _ := cmd.Flags().GetBool("summaries")
+		if storePath == "" {
+			storePath = viper.GetString("store.path")
+		}
+		if storePath == "" {
+			fmt.Println("no store to query, use --store")
+			return
+		}
+		now := time.Now()
+		from, err := parseQueryTime(fromStr, now)
+		if err != nil {
+			fmt.Println("parse --from error:", err)
+			return
+		}
+		to, err := parseQueryTime(toStr, now)
+		if err != nil {
+			fmt.Println("parse --to error:", err)
+			return
+		}
+		match := targetMatcher(append(targets, args...))
+
+		if summaries {
+			var list []storedSummary
+			err = storeScan(storePath, storeSummariesBucket, match, from, to, func(target string, value []byte) error {
+				var s storedSummary
+				if err := json.Unmarshal(value, &s); err != nil {
+					return err
+				}
+				list = append(list, s)
+				return nil
+			})
+			if err != nil {
+				fmt.Println("query store error:", err)
+				return
+			}
+			printSummaries(list, format)
+			return
+		}
+
+		aggregator := newQueryAggregator(interval, percentiles)
+		err = storeScan(storePath, storeProbesBucket, match, from, to, func(target string, value []byte) error {
+			var p storedProbe
+			if err := json.Unmarshal(value, &p); err != nil {
+				return err
+			}
+			aggregator.add(target, p.Ts, p.Rtt, p.Loss)
+			return nil
+		})
+		if err != nil {
+			fmt.Println("query store error:", err)
+			return
+		}
+		printQueryRows(aggregator.rows(), percentiles, format)
+	},
+}
+
+func printQueryRows(rows []queryRow, percentiles []float64, format string) {
+	header := []string{"start", "target", "count", "loss", "loss%", "min", "mean"}
+	for _, p := range percentiles {
+		header = append(header, percentileName(p))
+	}
+	header = append(header, "max")
+	records := make([][]string, 0, len(rows))
+	for _, row := range rows {
+		start := ""
+		if !row.Start.IsZero() {
+			start = row.Start.Format("2006-01-02 15:04:05")
+		}
+		record := []string{start, row.Target, strconv.Itoa(row.Count), strconv.Itoa(row.Loss),
+			fmt.Sprintf("%.2f", row.LossPct), fmt.Sprintf("%.3f", row.Min), fmt.Sprintf("%.3f", row.Mean)}
+		for _, p := range percentiles {
+			record = append(record, fmt.Sprintf("%.3f", row.Percentiles[percentileName(p)]))
+		}
+		records = append(records, append(record, fmt.Sprintf("%.3f", row.Max)))
+	}
+	printRecords(header, records, rows, format)
+}
+
+func printSummaries(list []storedSummary, format string) {
+	header := []string{"ts", "target", "kind", "count", "loss", "mean", "p50", "p90", "p99", "max",
+		"jitter", "masd", "ipdv_p99"}
+	records := make([][]string, 0, len(list))
+	for _, s := range list {
+		record := []string{s.Ts.Local().Format("2006-01-02 15:04:05"), s.Target, s.Kind,
+			strconv.Itoa(s.Count), strconv.Itoa(s.Loss)}
+		for _, v := range []float64{s.Mean, s.P50, s.P90, s.P99, s.Max, s.Jitter, s.MASD, s.IPDV99} {
+			record = append(record, fmt.Sprintf("%.3f", v))
+		}
+		records = append(records, record)
+	}
+	printRecords(header, records, list, format)
+}
+
+// printRecords 按 table、csv、json 输出，json直接输出原始结构
+func printRecords(header []string, records [][]string, raw any, format string) {
+	switch format {
+	case "json":
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		_ = encoder.Encode(raw)
+	case "csv":
+		writer := csv.NewWriter(os.Stdout)
+		_ = writer.Write(header)
+		_ = writer.WriteAll(records)
+	default:
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		_, _ = fmt.Fprintln(w, strings.Join(header, "\t"))
+		for _, record := range records {
+			_, _ = fmt.Fprintln(w, strings.Join(record, "\t"))
+		}
+		_ = w.Flush()
+	}
+}
+
+func init() {
+	rootCmd.AddCommand(queryCmd)
+	queryCmd.Flags().String("store", "", "database file written by tcp-ping --store (default from config key store.path)")
+	queryCmd.Flags().String("from", "-1h", "start time")
+	queryCmd.Flags().String("to", "now", "end time")
+	queryCmd.Flags().StringSlice("target", nil, "only these targets (IP:PORT, wildcards allowed)")
+	queryCmd.Flags().Duration("interval", time.Minute, "aggregation interval, 0 aggregates the whole range")
+	queryCmd.Flags().Float64Slice("percentiles", []float64{50, 90, 99}, "percentiles to compute")
+	queryCmd.Flags().String("format", "table", "output format: table, csv or json")
+	queryCmd.Flags().Bool("summaries", false, "list recorded window summaries instead of aggregating probes")
+}
@@ -0,0 +1,183 @@
+package cmd
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+const (
+	//反射报文的魔数和版本
+	reflectorMagic   = "QBTR"
+	reflectorVersion = 1
+	//magic(4) version(1) flags(1) reserved(2) seq(8) t1(8) t2(8) t3(8)
+	reflectorHeaderLen = 40
+	//报文足够长时反射端在头部之后填入自己相对参考时钟的偏差 refOffset(8) refError(8)
+	reflectorClockLen = 56
+	//反射端已同步到参考时钟，refOffset/refError有效
+	reflectorFlagSynced = 0x01
+	//带鉴权时报文尾部附加截断的HMAC-SHA256
+	authMacLen   = 16
+	authNonceLen = 16
+)
+
+var (
+	errAuthFailed      = errors.New("authentication failed")
+	errInvalidReflect  = errors.New("invalid reflector packet")
+	errReflectMismatch = errors.New("reflector reply does not match request")
+)
+
+// reflectorPacket 时间戳反射报文，t1为发送方发出时间，t2/t3为反射端收到和发回的时间，单位均为unix纳秒
+type reflectorPacket struct {
+	flags uint8
+	seq   uint64
+	t1    int64
+	t2    int64
+	t3    int64
+	//反射端时钟相对参考时钟的偏差(参考时钟减本机)和误差上界，纳秒
+	refOffset int64
+	refError  int64
+}
+
+func (p *reflectorPacket) marshal(buf []byte) {
+	copy(buf[0:4], reflectorMagic)
+	buf[4] = reflectorVersion
+	buf[5] = p.flags
+	buf[6], buf[7] = 0, 0
+	binary.BigEndian.PutUint64(buf[8:16], p.seq)
+	binary.BigEndian.PutUint64(buf[16:24], uint64(p.t1))
+	binary.BigEndian.PutUint64(buf[24:32], uint64(p.t2))
+	binary.BigEndian.PutUint64(buf[32:40], uint64(p.t3))
+	if len(buf) >= reflectorClockLen {
+		binary.BigEndian.PutUint64(buf[40:48], uint64(p.refOffset))
+		binary.BigEndian.PutUint64(buf[48:56], uint64(p.refError))
+	}
+}
+
+func (p *reflectorPacket) unmarshal(buf []byte) error {
+	if len(buf) < reflectorHeaderLen || string(buf[0:4]) != reflectorMagic || buf[4] != reflectorVersion {
+		return errInvalidReflect
+	}
+	p.flags = buf[5]
+	p.seq = binary.BigEndian.Uint64(buf[8:16])
+	p.t1 = int64(binary.BigEndian.Uint64(buf[16:24]))
+	p.t2 = int64(binary.BigEndian.Uint64(buf[24:32]))
+	p.t3 = int64(binary.BigEndian.Uint64(buf[32:40]))
+	if len(buf) >= reflectorClockLen {
+		p.refOffset = int64(binary.BigEndian.Uint64(buf[40:48]))
+		p.refError = int64(binary.BigEndian.Uint64(buf[48:56]))
+	}
+	return nil
+}
+
+// authMac 计算共享密钥下的HMAC
+func authMac(secret string, data []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// signDatagram 在报文末尾authMacLen字节处写入签名，buf需要预留出这部分空间
+func signDatagram(secret string, buf []byte) {
+	body := buf[:len(buf)-authMacLen]
+	copy(buf[len(body):], authMac(secret, body))
+}
+
+// verifyDatagram 校验报文末尾的签名
+func verifyDatagram(secret string, buf []byte) bool {
+	if len(buf) <= authMacLen {
+		return false
+	}
+	body := buf[:len(buf)-authMacLen]
+	return hmac.Equal(buf[len(body):], authMac(secret, body)[:authMacLen])
+}
+
+// authChallenge 服务端发起TCP鉴权：发送随机nonce，要求对端回复HMAC(secret, nonce)
+func authChallenge(conn net.Conn, secret string, timeout time.Duration) error {
+	nonce := make([]byte, authNonceLen)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	_ = conn.SetDeadline(time.Now().Add(timeout))
+	defer func() {
+		_ = conn.SetDeadline(time.Time{})
+	}()
+	if _, err := conn.Write(nonce); err != nil {
+		return err
+	}
+	answer := make([]byte, sha256.Size)
+	if _, err := io.ReadFull(conn, answer); err != nil {
+		return err
+	}
+	if !hmac.Equal(answer, authMac(secret, nonce)) {
+		return errAuthFailed
+	}
+	return nil
+}
+
+// authRespond 客户端应答服务端的鉴权nonce
+func authRespond(conn net.Conn, secret string, timeout time.Duration) error {
+	_ = conn.SetDeadline(time.Now().Add(timeout))
+	defer func() {
+		_ = conn.SetDeadline(time.Time{})
+	}()
+	nonce := make([]byte, authNonceLen)
+	if _, err := io.ReadFull(conn, nonce); err != nil {
+		return err
+	}
+	_, err := conn.Write(authMac(secret, nonce))
+	return err
+}
+
+// reflectorProbe 向 qbt serve --reflector 发送一个时间戳报文并等待反射，返回填好t1~t3的报文和收到回包的时间t4
+func reflectorProbe(conn net.Conn, seq uint64, size int, secret string, timeout time.Duration) (
+	p reflectorPacket, t4 time.Time, err error) {
+	macLen := 0
+	if secret != "" {
+		macLen = authMacLen
+	}
+	if size < reflectorHeaderLen+macLen {
+		size = reflectorHeaderLen + macLen
+	}
+	buf := make([]byte, size)
+	t1 := time.Now()
+	req := reflectorPacket{seq: seq, t1: t1.UnixNano()}
+	req.marshal(buf[:size-macLen])
+	if secret != "" {
+		signDatagram(secret, buf)
+	}
+	_ = conn.SetDeadline(t1.Add(timeout))
+	if _, err = conn.Write(buf); err != nil {
+		return p, t4, err
+	}
+	in := make([]byte, size+64)
+	for {
+		n, err := conn.Read(in)
+		t4 = time.Now()
+		if err != nil {
+			return p, t4, err
+		}
+		if secret != "" && !verifyDatagram(secret, in[:n]) {
+			return p, t4, errAuthFailed
+		}
+		if n < macLen {
+			return p, t4, errInvalidReflect
+		}
+		if err = p.unmarshal(in[:n-macLen]); err != nil {
+			return p, t4, err
+		}
+		//丢弃之前超时的旧回包
+		if p.seq < seq {
+			continue
+		}
+		if p.seq != seq || p.t1 != req.t1 {
+			return p, t4, errReflectMismatch
+		}
+		return p, t4, nil
+	}
+}
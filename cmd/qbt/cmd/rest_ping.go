@@ -0,0 +1,315 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptrace"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/qbtrade/qbt/cmd/qbt/cf"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// restPreset 交易所公开的ping和服务器时间接口
+type restPreset struct {
+	baseURL   string
+	pingPath  string        // 为空时只请求时间接口
+	timePath  string        // 返回服务器时间的接口
+	timeField string        // 服务器时间在json中的路径，用.分隔，数组用下标
+	timeUnit  time.Duration // 时间戳的单位
+}
+
+// restPresets 内置的交易所预设，base url可以用 --base-url 或配置文件 rest.base_urls.<name> 覆盖
+var restPresets = map[string]restPreset{
+	"binance-spot":  {"https://api.binance.com", "/api/v3/ping", "/api/v3/time", "serverTime", time.Millisecond},
+	"binance-usdm":  {"https://fapi.binance.com", "/fapi/v1/ping", "/fapi/v1/time", "serverTime", time.Millisecond},
+	"binance-coinm": {"https://dapi.binance.com", "/dapi/v1/ping", "/dapi/v1/time", "serverTime", time.Millisecond},
+	"okx":           {"https://www.okx.com", "", "/api/v5/public/time", "data.0.ts", time.Millisecond},
+	"bybit":         {"https://api.bybit.com", "", "/v5/market/time", "result.timeNano", time.Nanosecond},
+	"deribit":       {"https://www.deribit.com", "/api/v2/public/test", "/api/v2/public/get_time", "result", time.Millisecond},
+	"gate":          {"https://api.gateio.ws", "", "/api/v4/spot/time", "server_time", time.Millisecond},
+	"htx":           {"https://api.huobi.pro", "", "/v1/common/timestamp", "data", time.Millisecond},
+}
+
+// jsonPath 按 a.b.0.c 的路径取值
+func jsonPath(v any, path string) (any, bool) {
+	for _, key := range strings.Split(path, ".") {
+		switch node := v.(type) {
+		case map[string]any:
+			var ok bool
+			if v, ok = node[key]; !ok {
+				return nil, false
+			}
+		case []any:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(node) {
+				return nil, false
+			}
+			v = node[i]
+		default:
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+// parseServerTime 从响应中取出服务器时间，时间戳可以是数字或数字字符串
+func parseServerTime(body []byte, field string, unit time.Duration) (time.Time, error) {
+	decoder := json.NewDecoder(strings.NewReader(string(body)))
+	decoder.UseNumber()
+	var v any
+	if err := decoder.Decode(&v); err != nil {
+		return time.Time{}, err
+	}
+	value, ok := jsonPath(v, field)
+	if !ok {
+		return time.Time{}, fmt.Errorf("no %s in response", field)
+	}
+	var s string
+	switch value := value.(type) {
+	case json.Number:
+		s = value.String()
+	case string:
+		s = value
+	default:
+		return time.Time{}, fmt.Errorf("%s is not a timestamp: %v", field, value)
+	}
+	ts, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%s is not a timestamp: %v", field, s)
+	}
+	return time.Unix(0, ts*int64(unit)), nil
+}
+
+// restSample 一次http请求的结果，offset为服务器时钟减本机时钟
+type restSample struct {
+	rtt    time.Duration // 写完请求到收到第一个字节
+	offset time.Duration
+}
+
+// restGet 复用连接发送GET，用httptrace记录写完请求和收到首字节的时间，排除建连的耗时
+func restGet(client *http.Client, url string) ([]byte, time.Time, time.Time, error) {
+	var wrote, firstByte time.Time
+	trace := &httptrace.ClientTrace{
+		WroteRequest:         func(httptrace.WroteRequestInfo) { wrote = time.Now() },
+		GotFirstResponseByte: func() { firstByte = time.Now() },
+	}
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, wrote, firstByte, err
+	}
+	resp, err := client.Do(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+	if err != nil {
+		return nil, wrote, firstByte, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err == nil && resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return body, wrote, firstByte, err
+}
+
+// restProbe 请求ping接口(如果有)和时间接口
+func restProbe(client *http.Client, baseURL string, p restPreset) (ping, clock restSample, err error) {
+	if p.pingPath != "" {
+		_, wrote, firstByte, err := restGet(client, baseURL+p.pingPath)
+		if err != nil {
+			return ping, clock, err
+		}
+		ping.rtt = firstByte.Sub(wrote)
+	}
+	body, wrote, firstByte, err := restGet(client, baseURL+p.timePath)
+	if err != nil {
+		return ping, clock, err
+	}
+	serverTime, err := parseServerTime(body, p.timeField, p.timeUnit)
+	if err != nil {
+		return ping, clock, err
+	}
+	//服务器只有一个时间戳，当作t2=t3
+	clock.offset, clock.rtt = clockOffset(wrote, serverTime, serverTime, firstByte)
+	if p.pingPath == "" {
+		ping.rtt = clock.rtt
+	}
+	return ping, clock, nil
+}
+
+// restBaseURL 优先 --base-url name=URL，其次配置文件中的 rest.base_urls.<name>
+func restBaseURL(name string, overrides map[string]string) string {
+	if url, ok := overrides[name]; ok {
+		return strings.TrimSuffix(url, "/")
+	}
+	if url := viper.GetString("rest.base_urls." + name); url != "" {
+		return strings.TrimSuffix(url, "/")
+	}
+	return restPresets[name].baseURL
+}
+
+func restPresetNames() []string {
+	names := make([]string, 0, len(restPresets))
+	for name := range restPresets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// offsetSketch 时钟偏差的分位数，偏差可正可负而QuantileSketch只统计正数，正负分开记录
+type offsetSketch struct {
+	pos *cf.QuantileSketch
+	neg *cf.QuantileSketch // 负偏差的绝对值
+}
+
+func newOffsetSketch() offsetSketch {
+	return offsetSketch{pos: cf.NewQuantileSketch(staticsAccuracy), neg: cf.NewQuantileSketch(staticsAccuracy)}
+}
+
+func (o offsetSketch) add(x float64) {
+	if x < 0 {
+		o.neg.Add(-x)
+	} else {
+		o.pos.Add(x)
+	}
+}
+
+// quantile 第p百分位(0~100)，先换算成名次再到正数或负数部分里找
+func (o offsetSketch) quantile(p float64) float64 {
+	neg, pos := o.neg.Count(), o.pos.Count()
+	if neg+pos == 0 {
+		return 0
+	}
+	rank := cf.Max(uint64(math.Ceil(p/100*float64(neg+pos))), 1)
+	//名次k换算成百分位时减0.5，避免浮点误差进到下一名
+	if rank <= neg {
+		//负数部分按绝对值从大到小排
+		return -o.neg.Quantile((float64(neg-rank+1) - 0.5) / float64(neg) * 100)
+	}
+	return o.pos.Quantile((float64(rank-neg) - 0.5) / float64(pos) * 100)
+}
+
+var restPingCmd = &cobra.Command{
+	Use:   "rest-ping",
+	Short: "measure exchange REST api latency and clock offset",
+	Long: `measure the http latency of the public ping and server-time endpoints of exchanges and the clock offset
+computed from the server time they return (server clock minus local clock, the server time has millisecond
+precision on most exchanges). Connections are kept alive, rtt is from writing the request to the first
+response byte, so dns, connect and tls are excluded.
+--list shows the presets, --base-url overrides the base url of a preset, e.g. to test against a local stub.
+For example:
+qbt rest-ping --preset binance-spot,okx,bybit -i 5
+qbt rest-ping --preset binance-usdm --base-url binance-usdm=http://127.0.0.1:8080 -c 10`,
+	Args: func(cmd *cobra.Command, args []string) error {
+		if list, _ := cmd.Flags().GetBool("list"); list {
+			return nil
+		}
+		presets, _ := cmd.Flags().GetStringSlice("preset")
+		if len(presets) == 0 {
+			return fmt.Errorf("no --preset, available: %s", strings.Join(restPresetNames(), ", "))
+		}
+		for _, name := range presets {
+			if _, ok := restPresets[name]; !ok {
+				return fmt.Errorf("unknown preset %s, available: %s", name, strings.Join(restPresetNames(), ", "))
+			}
+		}
+		return nil
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		presets, _ := cmd.Flags().GetStringSlice("preset")
+		overrides, _ := cmd.Flags().GetStringToString("base-url")
+		interval, _ := cmd.Flags().GetFloat64("interval")
+		count, _ := cmd.Flags().GetInt("count")
+		timeout, _ := cmd.Flags().GetFloat64("timeout")
+		if list, _ := cmd.Flags().GetBool("list"); list {
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			_, _ = fmt.Fprintln(w, "preset\tbase url\tping\ttime")
+			for _, name := range restPresetNames() {
+				p := restPresets[name]
+				_, _ = fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", name, restBaseURL(name, overrides), p.pingPath, p.timePath)
+			}
+			_ = w.Flush()
+			return
+		}
+		if collector := setupCollector(cmd); collector != nil {
+			defer collector.close()
+		}
+		hostname, _ := os.Hostname()
+		client := &http.Client{Timeout: time.Duration(timeout*1000) * time.Millisecond}
+		//-c默认不限次数，流式统计，不保存每次的耗时
+		rtts := map[string]*StaticsMsg{}
+		offsets := map[string]offsetSketch{}
+		for _, name := range presets {
+			rtts[name] = newStaticsMsg()
+			offsets[name] = newOffsetSketch()
+		}
+		errCount := map[string]int{}
+		points := make([]cf.InfluxdbPoint, 0, 1000)
+		for n := 1; n <= count; n++ {
+			start := time.Now()
+			for _, name := range presets {
+				ping, clock, err := restProbe(client, restBaseURL(name, overrides), restPresets[name])
+				if err != nil {
+					errCount[name]++
+					fmt.Printf("%s %s error: %v\n", time.Now().Format(time.RFC3339), name, err)
+					continue
+				}
+				pingMs := float64(ping.rtt.Nanoseconds()) / 1e6
+				timeMs := float64(clock.rtt.Nanoseconds()) / 1e6
+				offsetMs := float64(clock.offset.Nanoseconds()) / 1e6
+				//第一次请求包含建连，不计入统计
+				if n > 1 || count == 1 {
+					rtts[name].add(name, pingMs)
+					offsets[name].add(offsetMs)
+				}
+				fmt.Printf("%s %s rtt=%.3fms time rtt=%.3fms offset=%+.3fms\n", time.Now().Format(time.RFC3339),
+					name, pingMs, timeMs, offsetMs)
+				points = append(points, cf.InfluxdbPoint{
+					Measurement: "rest_ping",
+					Tags: map[string]string{
+						"host":   hostname,
+						"preset": name,
+					},
+					Fields: map[string]float64{
+						"rtt":      pingMs,
+						"time_rtt": timeMs,
+						"offset":   offsetMs,
+					},
+					Time: start,
+				})
+			}
+			if len(points) > 0 {
+				points = flushInfluxPoints(points)
+			}
+			if n < count {
+				time.Sleep(time.Duration(interval*1000)*time.Millisecond - time.Since(start))
+			}
+		}
+		for _, name := range presets {
+			if s := rtts[name]; s.SuccessLength > 0 {
+				fmt.Printf("%s: requests:%d, errors:%d, rtt mean:%.3fms p50:%.3fms p99:%.3fms, offset median:%+.3fms\n",
+					name, s.SuccessLength, errCount[name], s.MeanCost, s.Percentile(50), s.Percentile(99),
+					offsets[name].quantile(50))
+			}
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(restPingCmd)
+	restPingCmd.Flags().StringSlice("preset", nil, "exchange presets to probe, see --list")
+	restPingCmd.Flags().StringToString("base-url", nil, "override the base url of presets, e.g. binance-spot=http://127.0.0.1:8080 (config key rest.base_urls.<preset>)")
+	restPingCmd.Flags().Bool("list", false, "list the presets")
+	restPingCmd.Flags().Float64P("interval", "i", 1, "seconds between rounds")
+	restPingCmd.Flags().IntP("count", "c", math.MaxInt, "max rounds")
+	restPingCmd.Flags().Float64P("timeout", "t", 5, "http timeout in seconds")
+	addCollectorFlags(restPingCmd)
+}
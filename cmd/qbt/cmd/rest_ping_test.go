@@ -0,0 +1,81 @@
+package cmd
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseServerTime(t *testing.T) {
+	ms := int64(1700000000123)
+	want := time.UnixMilli(ms)
+	//各交易所时间接口的响应格式
+	bodies := map[string]string{
+		"binance-spot": `{"serverTime":1700000000123}`,
+		"okx":          `{"code":"0","msg":"","data":[{"ts":"1700000000123"}]}`,
+		"bybit":        `{"retCode":0,"retMsg":"OK","result":{"timeSecond":"1700000000","timeNano":"1700000000123000000"},"time":1700000000123}`,
+		"deribit":      `{"jsonrpc":"2.0","result":1700000000123,"usIn":1,"usOut":2}`,
+		"gate":         `{"server_time":1700000000123}`,
+		"htx":          `{"status":"ok","data":1700000000123}`,
+	}
+	for name, body := range bodies {
+		p := restPresets[name]
+		ts, err := parseServerTime([]byte(body), p.timeField, p.timeUnit)
+		assert.Nil(t, err, name)
+		assert.True(t, ts.Equal(want), name)
+	}
+	_, err := parseServerTime([]byte(`{"data":[]}`), "data.0.ts", time.Millisecond)
+	assert.NotNil(t, err)
+	_, err = parseServerTime([]byte(`{"serverTime":true}`), "serverTime", time.Millisecond)
+	assert.NotNil(t, err)
+}
+
+func TestRestProbe(t *testing.T) {
+	//模拟服务器时钟快500ms
+	skew := 500 * time.Millisecond
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v3/ping", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprint(w, "{}")
+	})
+	mux.HandleFunc("/api/v3/time", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprintf(w, `{"serverTime":%d}`, time.Now().Add(skew).UnixMilli())
+	})
+	mux.HandleFunc("/api/v5/public/time", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "maintenance", http.StatusServiceUnavailable)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	overrides := map[string]string{"binance-spot": server.URL + "/", "okx": server.URL}
+	assert.Equal(t, server.URL, restBaseURL("binance-spot", overrides))
+	assert.Equal(t, "https://api.bybit.com", restBaseURL("bybit", overrides))
+
+	client := &http.Client{Timeout: time.Second}
+	ping, clock, err := restProbe(client, restBaseURL("binance-spot", overrides), restPresets["binance-spot"])
+	assert.Nil(t, err)
+	assert.True(t, ping.rtt > 0 && ping.rtt < 100*time.Millisecond)
+	assert.True(t, clock.rtt > 0 && clock.rtt < 100*time.Millisecond)
+	//服务器时间只有毫秒精度
+	assert.InDelta(t, skew.Seconds(), clock.offset.Seconds(), 0.01)
+
+	_, _, err = restProbe(client, restBaseURL("okx", overrides), restPresets["okx"])
+	assert.NotNil(t, err)
+}
+
+func TestOffsetSketch(t *testing.T) {
+	o := newOffsetSketch()
+	assert.Equal(t, 0.0, o.quantile(50))
+	for _, v := range []float64{-30, -20, -10, 5, 40} {
+		o.add(v)
+	}
+	assert.InDelta(t, -10, o.quantile(50), 0.2)
+	assert.InDelta(t, -30, o.quantile(1), 0.6)
+	assert.InDelta(t, 40, o.quantile(100), 0.8)
+	o.add(50)
+	o.add(60)
+	assert.InDelta(t, 5, o.quantile(50), 0.1)
+}
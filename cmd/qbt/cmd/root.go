@@ -64,6 +64,10 @@ func init() {
 	// will be global for your application.
 
 	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/.qbt.yaml)")
+	rootCmd.PersistentFlags().StringVar(&spoolDir, "spool-dir", "",
+		"keep unsent influxdb/statsd/collector batches in this directory and replay them later, "+
+			"use one directory per process (default from config key spool.dir)")
+	rootCmd.PersistentFlags().IntVar(&spoolMaxMB, "spool-max-mb", 512, "disk cap per sink in MB, oldest batches are evicted first")
 
 	// Cobra also supports local flags, which will only run
 	// when this action is called directly.
@@ -92,4 +96,5 @@ func initConfig() {
 	if err := viper.ReadInConfig(); err == nil {
 		fmt.Fprintln(os.Stderr, "Using config file:", viper.ConfigFileUsed())
 	}
+	setupSpool()
 }
@@ -23,35 +23,151 @@ package cmd
 
 import (
 	"fmt"
+	"os"
+	"time"
 
 	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
 )
 
-// serveCmd represents the serve command
+// serveCmd 在本机运行qbt的应答服务，供其他机器上的qbt探测
 var serveCmd = &cobra.Command{
 	Use:   "serve",
-	Short: "A brief description of your command",
-	Long: `A longer description that spans multiple lines and likely contains examples
-and usage of using your command. For example:
-
-Cobra is a CLI library for Go that empowers applications.
-This application is a tool to generate the needed files
-to quickly create a Cobra application.`,
+	Short: "run qbt responders for remote probes",
+	Long: `run qbt responders for remote probes.
+--tcp-echo   echo bytes back over tcp, used by tcp-ping --persistent
+--udp-echo   echo udp datagrams back
+--reflector  udp timestamping reflector, used for clock offset and one-way delay
+--throughput far end of qbt throughput, tcp and udp on the same port
+--stats      http stats endpoint, GET /stats
+--clock-ref  ntp server the reflector measures its own clock against, needed by qbt owd
+--mesh       probe the reflector of every peer agent and serve the latency matrix on GET /matrix,
+             needs --reflector and --stats, peers are discovered from the agents given by --peer,
+             agents announce themselves to each other only when --secret is set
+--collector  accept results pushed by tcp-ping --collector on POST /collect, deduplicate them,
+             archive to --collector-dir and write to influxdb, needs --stats
+--dashboard  web ui on the --stats address with live charts of --dashboard-target, target management
+             and history from --store, changing targets needs the secret
+For example:
+qbt serve --tcp-echo :7007 --udp-echo :7007 --reflector :7008 --throughput :7009 --stats :7080 --secret xxx`,
+	Args: func(cmd *cobra.Command, args []string) error {
+		for _, name := range []string{"tcp-echo", "udp-echo", "reflector", "throughput", "stats"} {
+			if address, _ := cmd.Flags().GetString(name); address != "" {
+				return nil
+			}
+		}
+		return fmt.Errorf("nothing to serve, use --tcp-echo, --udp-echo, --reflector, --throughput or --stats")
+	},
+	PreRunE: func(cmd *cobra.Command, args []string) error {
+		mesh, _ := cmd.Flags().GetBool("mesh")
+		reflector, _ := cmd.Flags().GetString("reflector")
+		stats, _ := cmd.Flags().GetString("stats")
+		if mesh && (reflector == "" || stats == "") {
+			return fmt.Errorf("--mesh needs --reflector and --stats")
+		}
+		if collector, _ := cmd.Flags().GetBool("collector"); collector && stats == "" {
+			return fmt.Errorf("--collector needs --stats")
+		}
+		if dashboard, _ := cmd.Flags().GetBool("dashboard"); dashboard && stats == "" {
+			return fmt.Errorf("--dashboard needs --stats")
+		}
+		return nil
+	},
 	Run: func(cmd *cobra.Command, args []string) {
-		fmt.Println("serve called")
+		tcpEcho, _ := cmd.Flags().GetString("tcp-echo")
+		udpEcho, _ := cmd.Flags().GetString("udp-echo")
+		reflector, _ := cmd.Flags().GetString("reflector")
+		throughput, _ := cmd.Flags().GetString("throughput")
+		stats, _ := cmd.Flags().GetString("stats")
+		maxConns, _ := cmd.Flags().GetInt("max-conns")
+		secret := secretFromFlags(cmd)
+
+		clockRef, _ := cmd.Flags().GetString("clock-ref")
+
+		server := newQbtServer(secret, maxConns)
+		if clockRef != "" {
+			server.clock = newClockTracker(clockRef, clockTrackInterval)
+			go server.clock.run()
+		}
+		errChan := make(chan error)
+		run := func(name, address string, serve func(string) error) {
+			if address == "" {
+				return
+			}
+			go func() {
+				errChan <- fmt.Errorf("%s: %w", name, serve(address))
+			}()
+		}
+		if mesh, _ := cmd.Flags().GetBool("mesh"); mesh {
+			startMeshAgent(cmd, server, reflector, stats, secret)
+		}
+		if collector, _ := cmd.Flags().GetBool("collector"); collector {
+			dir, _ := cmd.Flags().GetString("collector-dir")
+			newCollector(secret, dir).register(server.mux)
+		}
+		if dashboard, _ := cmd.Flags().GetBool("dashboard"); dashboard {
+			startDashboard(cmd, server, secret)
+		}
+		run("tcp echo", tcpEcho, server.serveTcpEcho)
+		run("udp echo", udpEcho, server.serveUdpEcho)
+		run("reflector", reflector, server.serveReflector)
+		run("throughput", throughput, server.serveThroughput)
+		run("stats", stats, server.serveStats)
+		//任何一个服务退出都结束进程
+		fmt.Println("serve error:", <-errChan)
 	},
 }
 
-func init() {
-	rootCmd.AddCommand(serveCmd)
+// startMeshAgent 启动网格探测，节点列表来自 --peer 或配置文件中的 mesh.peers
+func startMeshAgent(cmd *cobra.Command, server *qbtServer, reflector, api, secret string) {
+	name, _ := cmd.Flags().GetString("name")
+	peers, _ := cmd.Flags().GetStringSlice("peer")
+	interval, _ := cmd.Flags().GetFloat64("mesh-interval")
+	window, _ := cmd.Flags().GetInt("mesh-window")
+	if name == "" {
+		name, _ = os.Hostname()
+	}
+	if len(peers) == 0 {
+		peers = viper.GetStringSlice("mesh.peers")
+	}
+	agent := newMeshAgent(name, reflector, api, secret, time.Duration(interval*1000)*time.Millisecond, window)
+	for _, peer := range peers {
+		agent.addPeer(peer, true)
+	}
+	agent.register(server.mux)
+	go agent.run()
+}
 
-	// Here you will define your flags and configuration settings.
+// secretFromFlags 优先使用 --secret，否则读取配置文件中的 secret
+func secretFromFlags(cmd *cobra.Command) string {
+	secret, _ := cmd.Flags().GetString("secret")
+	if secret == "" {
+		secret = viper.GetString("secret")
+	}
+	return secret
+}
 
-	// Cobra supports Persistent Flags which will work for this command
-	// and all subcommands, e.g.:
-	// serveCmd.PersistentFlags().String("foo", "", "A help for foo")
+func init() {
+	rootCmd.AddCommand(serveCmd)
 
-	// Cobra supports local flags which will only run when this command
-	// is called directly, e.g.:
-	// serveCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
+	serveCmd.Flags().String("tcp-echo", "", "listen address of the tcp echo responder, e.g. :7007")
+	serveCmd.Flags().String("udp-echo", "", "listen address of the udp echo responder, e.g. :7007")
+	serveCmd.Flags().String("reflector", "", "listen address of the udp timestamping reflector, e.g. :7008")
+	serveCmd.Flags().String("throughput", "", "listen address (tcp and udp) of the far end of qbt throughput, e.g. :7009")
+	serveCmd.Flags().String("stats", "", "listen address of the http stats endpoint, e.g. :7080")
+	serveCmd.Flags().Int("max-conns", 1000, "maximum concurrent tcp connections, 0 means unlimited")
+	serveCmd.Flags().String("clock-ref", "", "ntp server to sync the reflector timestamps against, e.g. ntp.aliyun.com")
+	serveCmd.Flags().Bool("mesh", false, "probe peer agents and serve the latency matrix")
+	serveCmd.Flags().String("name", "", "agent name in the mesh (default hostname)")
+	serveCmd.Flags().StringSlice("peer", nil, "http address (--stats) of peer agents, default from config key mesh.peers")
+	serveCmd.Flags().Float64("mesh-interval", 1, "seconds between probes to each peer")
+	serveCmd.Flags().Int("mesh-window", 300, "recent probes per peer used for the matrix")
+	serveCmd.Flags().Bool("collector", false, "accept results pushed by remote agents and write them to influxdb")
+	serveCmd.Flags().String("collector-dir", "", "directory to archive collected batches as daily jsonl files, empty disables")
+	serveCmd.Flags().Bool("dashboard", false, "serve the web dashboard on the --stats address")
+	serveCmd.Flags().StringSlice("dashboard-target", nil, "IP:PORT probed by the dashboard, default from config key dashboard.targets")
+	serveCmd.Flags().Float64("dashboard-interval", 1, "seconds between dashboard probes of each target")
+	serveCmd.Flags().Float64("dashboard-timeout", 2, "connect timeout in seconds of dashboard probes")
+	addStoreFlags(serveCmd)
+	serveCmd.Flags().String("secret", "", "shared secret to authenticate probes (default from config key secret)")
 }
@@ -0,0 +1,418 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/qbtrade/qbt/cmd/qbt/cf"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// sloConfig 配置文件中slo列表的一项，例如
+//
+//	slo:
+//	  - name: binance-gateway
+//	    targets: ["10.110.1.*:443"]
+//	    threshold_ms: 5
+//	    objective: 99.9
+//
+// 表示99.9%的连接要在5ms内成功，丢包和超过阈值都算失败
+type sloConfig struct {
+	Name        string   `mapstructure:"name" json:"name"`
+	Targets     []string `mapstructure:"targets" json:"targets"` // IP:PORT，支持通配符
+	ThresholdMs float64  `mapstructure:"threshold_ms" json:"threshold_ms"`
+	Objective   float64  `mapstructure:"objective" json:"objective"` // 百分比
+}
+
+// loadSloConfigs 读取配置文件中的slo
+func loadSloConfigs() ([]sloConfig, error) {
+	var slos []sloConfig
+	if err := viper.UnmarshalKey("slo", &slos); err != nil {
+		return nil, err
+	}
+	for _, s := range slos {
+		if s.Name == "" || len(s.Targets) == 0 {
+			return nil, fmt.Errorf("slo %q: name and targets are required", s.Name)
+		}
+		if s.ThresholdMs <= 0 || s.Objective <= 0 || s.Objective >= 100 {
+			return nil, fmt.Errorf("slo %s: threshold_ms must be positive and objective in (0, 100)", s.Name)
+		}
+	}
+	return slos, nil
+}
+
+// sloWindows 滚动统计的窗口，最长的窗口用于计算剩余的错误预算
+var sloWindows = []struct {
+	name string
+	d    time.Duration
+}{
+	{"1h", time.Hour},
+	{"1d", 24 * time.Hour},
+	{"30d", 30 * 24 * time.Hour},
+}
+
+// sloBurnAlerts 燃烧率告警：1h窗口14.4倍(2%的30天预算在1小时内耗尽)，1d窗口3倍(10%在1天内耗尽)
+var sloBurnAlerts = []struct {
+	state  string
+	window string
+	rate   float64
+}{
+	{"fast-burn", "1h", 14.4},
+	{"slow-burn", "1d", 3},
+}
+
+// sloMinProbes 窗口内探测次数太少时不告警，避免刚启动时一次丢包就触发
+const sloMinProbes = 30
+
+// sloBucket 一分钟内的探测次数和失败次数
+type sloBucket struct {
+	minute int64
+	total  int64
+	bad    int64
+}
+
+// sloCounter 按分钟计数的环形缓冲，覆盖最长的窗口
+type sloCounter struct {
+	buckets []sloBucket
+}
+
+func newSloCounter() *sloCounter {
+	longest := sloWindows[len(sloWindows)-1].d
+	return &sloCounter{buckets: make([]sloBucket, int(longest/time.Minute))}
+}
+
+func (c *sloCounter) add(ts time.Time, bad bool) {
+	minute := ts.Unix() / 60
+	b := &c.buckets[minute%int64(len(c.buckets))]
+	if b.minute != minute {
+		*b = sloBucket{minute: minute}
+	}
+	b.total++
+	if bad {
+		b.bad++
+	}
+}
+
+// count 统计最近d内的探测，按分钟对齐，包含当前这一分钟。
+// span是窗口内从第一条数据到现在的分钟数，历史不足一个窗口时用来推算整个窗口的探测数
+func (c *sloCounter) count(now time.Time, d time.Duration) (total, bad, span int64) {
+	end := now.Unix() / 60
+	for minute := end - int64(d/time.Minute) + 1; minute <= end; minute++ {
+		if b := c.buckets[minute%int64(len(c.buckets))]; b.minute == minute {
+			if total == 0 {
+				span = end - minute + 1
+			}
+			total += b.total
+			bad += b.bad
+		}
+	}
+	return total, bad, span
+}
+
+// sloWindowStatus 一个窗口的达成情况，都是百分比
+type sloWindowStatus struct {
+	Window          string  `json:"window"`
+	Total           int64   `json:"total"`
+	Bad             int64   `json:"bad"`
+	Compliance      float64 `json:"compliance"`
+	BudgetRemaining float64 `json:"budget_remaining"`
+	BurnRate        float64 `json:"burn_rate"` // 1表示按这个速度正好在窗口结束时用完预算
+}
+
+// newSloWindowStatus 预算按整个窗口的探测数计算，历史不足一个窗口时按已有的探测频率推算，
+// 刚启动时的一次丢包不会用完30天的预算
+func newSloWindowStatus(window string, d time.Duration, total, bad, span int64, objective float64) sloWindowStatus {
+	s := sloWindowStatus{Window: window, Total: total, Bad: bad, Compliance: 100, BudgetRemaining: 100}
+	if total == 0 {
+		return s
+	}
+	errorRate := float64(bad) / float64(total)
+	budget := 1 - objective/100
+	expected := float64(total)
+	if minutes := int64(d / time.Minute); span > 0 && span < minutes {
+		expected = expected * float64(minutes) / float64(span)
+	}
+	s.Compliance = 100 * (1 - errorRate)
+	s.BudgetRemaining = 100 * (1 - float64(bad)/(budget*expected))
+	s.BurnRate = errorRate / budget
+	return s
+}
+
+// sloStatus 一个target在某个slo下的状态
+type sloStatus struct {
+	Name        string            `json:"name"`
+	Target      string            `json:"target"`
+	ThresholdMs float64           `json:"threshold_ms"`
+	Objective   float64           `json:"objective"`
+	Windows     []sloWindowStatus `json:"windows"`
+	State       string            `json:"state"` // ok、fast-burn、slow-burn、exhausted
+}
+
+func (s sloStatus) window(name string) sloWindowStatus {
+	for _, w := range s.Windows {
+		if w.Window == name {
+			return w
+		}
+	}
+	return sloWindowStatus{}
+}
+
+// state 预算用完优先，其次按告警的严重程度，探测次数太少时都不告警
+func (s sloStatus) state() string {
+	if w := s.Windows[len(s.Windows)-1]; w.Total >= sloMinProbes && w.BudgetRemaining <= 0 {
+		return "exhausted"
+	}
+	for _, alert := range sloBurnAlerts {
+		if w := s.window(alert.window); w.Total >= sloMinProbes && w.BurnRate >= alert.rate {
+			return alert.state
+		}
+	}
+	return "ok"
+}
+
+func (s sloStatus) String() string {
+	parts := make([]string, 0, len(s.Windows))
+	for _, w := range s.Windows {
+		parts = append(parts, fmt.Sprintf("%s %.3f%% burn %.1f", w.Window, w.Compliance, w.BurnRate))
+	}
+	return fmt.Sprintf("%s %s (%.3f%% < %gms): %s, budget remaining %.1f%%", s.Name, s.Target, s.Objective,
+		s.ThresholdMs, strings.Join(parts, ", "), s.Windows[len(s.Windows)-1].BudgetRemaining)
+}
+
+func (s sloStatus) point(host string, now time.Time) cf.InfluxdbPoint {
+	fields := map[string]float64{
+		"budget_remaining": s.Windows[len(s.Windows)-1].BudgetRemaining,
+		"alert":            0,
+	}
+	if s.State != "ok" {
+		fields["alert"] = 1
+	}
+	for _, w := range s.Windows {
+		fields["compliance_"+w.Window] = w.Compliance
+		fields["burn_rate_"+w.Window] = w.BurnRate
+	}
+	return cf.InfluxdbPoint{
+		Measurement: "slo",
+		Tags: map[string]string{
+			"host":   host,
+			"slo":    s.Name,
+			"target": s.Target,
+			"state":  s.State,
+		},
+		Fields: fields,
+		Time:   now,
+	}
+}
+
+// sloTracker 按slo和target累计探测结果
+type sloTracker struct {
+	slos []sloConfig
+
+	mu        sync.Mutex
+	counters  map[string]*sloCounter // slo名字|target
+	states    map[string]string
+	evaluated time.Time
+}
+
+// probeSlo tcp-ping的slo统计，为nil表示配置文件中没有slo
+var probeSlo *sloTracker
+
+func newSloTracker(slos []sloConfig) *sloTracker {
+	return &sloTracker{slos: slos, counters: map[string]*sloCounter{}, states: map[string]string{}}
+}
+
+// match 是否有slo包含这个target
+func (t *sloTracker) match(target string) bool {
+	for _, s := range t.slos {
+		if targetMatcher(s.Targets)(target) {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *sloTracker) add(p storedProbe) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, s := range t.slos {
+		if !targetMatcher(s.Targets)(p.Target) {
+			continue
+		}
+		key := s.Name + "|" + p.Target
+		counter, ok := t.counters[key]
+		if !ok {
+			counter = newSloCounter()
+			t.counters[key] = counter
+		}
+		counter.add(p.Ts, p.Loss || p.Rtt > s.ThresholdMs)
+	}
+}
+
+// status 所有slo和target的状态，按slo名字和target排序
+func (t *sloTracker) status(now time.Time) []sloStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.statusLocked(now)
+}
+
+func (t *sloTracker) statusLocked(now time.Time) []sloStatus {
+	var list []sloStatus
+	for _, s := range t.slos {
+		for key, counter := range t.counters {
+			if !strings.HasPrefix(key, s.Name+"|") {
+				continue
+			}
+			status := sloStatus{Name: s.Name, Target: strings.TrimPrefix(key, s.Name+"|"),
+				ThresholdMs: s.ThresholdMs, Objective: s.Objective}
+			for _, w := range sloWindows {
+				total, bad, span := counter.count(now, w.d)
+				status.Windows = append(status.Windows, newSloWindowStatus(w.name, w.d, total, bad, span, s.Objective))
+			}
+			status.State = status.state()
+			list = append(list, status)
+		}
+	}
+	sort.SliceStable(list, func(i, j int) bool {
+		if list[i].Name != list[j].Name {
+			return list[i].Name < list[j].Name
+		}
+		return list[i].Target < list[j].Target
+	})
+	return list
+}
+
+// evaluate 每分钟最多一次，状态变化时在控制台告警，返回写入influxdb的数据点
+func (t *sloTracker) evaluate(host string, now time.Time) []cf.InfluxdbPoint {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if now.Sub(t.evaluated) < time.Minute {
+		return nil
+	}
+	t.evaluated = now
+	var points []cf.InfluxdbPoint
+	for _, s := range t.statusLocked(now) {
+		key := s.Name + "|" + s.Target
+		prev := t.states[key]
+		if prev == "" {
+			prev = "ok"
+		}
+		if s.State != prev {
+			if s.State == "ok" {
+				printEvent(fmt.Sprintf("\n[slo] RESOLVED %s", s))
+			} else {
+				printEvent(fmt.Sprintf("\n[slo] FIRING %s %s", s.State, s))
+			}
+		}
+		t.states[key] = s.State
+		points = append(points, s.point(host, now))
+	}
+	return points
+}
+
+// load 从结果库中读取最长窗口内的探测
+func (t *sloTracker) load(path string, now time.Time) error {
+	longest := sloWindows[len(sloWindows)-1].d
+	return storeScan(path, storeProbesBucket, t.match, now.Add(-longest), now,
+		func(target string, value []byte) error {
+			var p storedProbe
+			if err := json.Unmarshal(value, &p); err != nil {
+				return err
+			}
+			t.add(p)
+			return nil
+		})
+}
+
+// setupSlo 配置文件中有slo时设置probeSlo，配置了 --store 时用历史数据初始化
+func setupSlo() *sloTracker {
+	slos, err := loadSloConfigs()
+	if err != nil {
+		fmt.Println("load slo config error:", err)
+		return nil
+	}
+	if len(slos) == 0 {
+		return nil
+	}
+	probeSlo = newSloTracker(slos)
+	if probeStore != nil {
+		if err := probeSlo.load(probeStore.path, time.Now()); err != nil {
+			fmt.Println("load slo history error:", err)
+		}
+	}
+	return probeSlo
+}
+
+var sloCmd = &cobra.Command{
+	Use:   "slo",
+	Short: "show slo compliance and error budget of all targets",
+	Long: `show the compliance, remaining error budget and burn rate of every target over the rolling
+1h/1d/30d windows, computed from the probes recorded with tcp-ping --store.
+SLOs are defined in the config file, a probe is bad when it is lost or slower than threshold_ms:
+slo:
+  - name: binance-gateway
+    targets: ["10.110.1.*:443"]
+    threshold_ms: 5
+    objective: 99.9
+State is fast-burn when the 1h burn rate >= 14.4, slow-burn when the 1d burn rate >= 3,
+and exhausted when the 30d error budget is used up.
+For example:
+qbt slo --store qbt.db
+qbt slo --store qbt.db --format json`,
+	Run: func(cmd *cobra.Command, args []string) {
+		storePath, _ := cmd.Flags().GetString("store")
+		format, _ := cmd.Flags().GetString("format")
+		if storePath == "" {
+			storePath = viper.GetString("store.path")
+		}
+		if storePath == "" {
+			fmt.Println("no store to read, use --store")
+			return
+		}
+		slos, err := loadSloConfigs()
+		if err != nil {
+			fmt.Println("load slo config error:", err)
+			return
+		}
+		if len(slos) == 0 {
+			fmt.Println("no slo in the config file")
+			return
+		}
+		now := time.Now()
+		tracker := newSloTracker(slos)
+		if err = tracker.load(storePath, now); err != nil {
+			fmt.Println("read store error:", err)
+			return
+		}
+		printSloStatus(tracker.status(now), format)
+	},
+}
+
+func printSloStatus(list []sloStatus, format string) {
+	header := []string{"slo", "target", "objective", "threshold"}
+	for _, w := range sloWindows {
+		header = append(header, w.name)
+	}
+	header = append(header, "budget", "burn_1h", "burn_1d", "state")
+	records := make([][]string, 0, len(list))
+	for _, s := range list {
+		record := []string{s.Name, s.Target, fmt.Sprintf("%g%%", s.Objective), fmt.Sprintf("%gms", s.ThresholdMs)}
+		for _, w := range s.Windows {
+			record = append(record, fmt.Sprintf("%.3f%%", w.Compliance))
+		}
+		record = append(record, fmt.Sprintf("%.1f%%", s.Windows[len(s.Windows)-1].BudgetRemaining),
+			fmt.Sprintf("%.2f", s.window("1h").BurnRate), fmt.Sprintf("%.2f", s.window("1d").BurnRate), s.State)
+		records = append(records, record)
+	}
+	printRecords(header, records, list, format)
+}
+
+func init() {
+	rootCmd.AddCommand(sloCmd)
+	sloCmd.Flags().String("store", "", "database file written by tcp-ping --store (default from config key store.path)")
+	sloCmd.Flags().String("format", "table", "output format: table, csv or json")
+}
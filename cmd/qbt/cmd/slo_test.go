@@ -0,0 +1,87 @@
+package cmd
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSloWindowStatus(t *testing.T) {
+	s := newSloWindowStatus("1h", time.Hour, 10000, 5, 60, 99.9)
+	assert.InDelta(t, 99.95, s.Compliance, 1e-9)
+	assert.InDelta(t, 50, s.BudgetRemaining, 1e-9)
+	assert.InDelta(t, 0.5, s.BurnRate, 1e-9)
+	assert.Equal(t, sloWindowStatus{Window: "1d", Compliance: 100, BudgetRemaining: 100},
+		newSloWindowStatus("1d", 24*time.Hour, 0, 0, 0, 99.9))
+	//刚启动10分钟时一次丢包，按探测频率推算30天的预算，不会直接用完
+	s = newSloWindowStatus("30d", 30*24*time.Hour, 600, 1, 10, 99.9)
+	assert.InDelta(t, 100-100*1/(0.001*600*4320), s.BudgetRemaining, 1e-9)
+	assert.InDelta(t, 100*(1-1.0/600), s.Compliance, 1e-9)
+
+	status := func(burn1h, burn1d, budget float64, total int64) string {
+		return sloStatus{Windows: []sloWindowStatus{{Window: "1h", Total: total, BurnRate: burn1h},
+			{Window: "1d", Total: total, BurnRate: burn1d}, {Window: "30d", Total: total, BudgetRemaining: budget}}}.state()
+	}
+	assert.Equal(t, "ok", status(2, 1, 90, 1000))
+	assert.Equal(t, "fast-burn", status(15, 3, 90, 1000))
+	assert.Equal(t, "slow-burn", status(5, 3, 90, 1000))
+	assert.Equal(t, "ok", status(100, 100, 90, 10))
+	assert.Equal(t, "exhausted", status(15, 3, 0, 1000))
+	//探测次数太少时预算用完也不告警
+	assert.Equal(t, "ok", status(0, 0, -500, 1))
+}
+
+func TestSloTracker(t *testing.T) {
+	viper.Set("slo", []map[string]any{
+		{"name": "gateway", "targets": []string{"10.0.0.*:443"}, "threshold_ms": 5, "objective": 99},
+	})
+	defer viper.Set("slo", nil)
+	slos, err := loadSloConfigs()
+	assert.Nil(t, err)
+	assert.Equal(t, []sloConfig{{Name: "gateway", Targets: []string{"10.0.0.*:443"}, ThresholdMs: 5, Objective: 99}}, slos)
+
+	path := filepath.Join(t.TempDir(), "qbt.db")
+	store := newResultStore(path)
+	now := time.Date(2026, 10, 19, 10, 0, 0, 0, time.Local)
+	//前两天每分钟一次，都达标
+	for ts := now.Add(-48 * time.Hour); ts.Before(now.Add(-time.Hour)); ts = ts.Add(time.Minute) {
+		store.addProbe(storedProbe{Ts: ts, Target: "10.0.0.1:443", Rtt: 1})
+		store.addProbe(storedProbe{Ts: ts, Target: "10.0.0.2:443", Rtt: 1})
+		store.addProbe(storedProbe{Ts: ts, Target: "10.0.0.1:22", Rtt: 100})
+	}
+	//最近一小时10.0.0.2每10次有3次超过阈值或丢包
+	for i := 0; i < 600; i++ {
+		ts := now.Add(-50*time.Minute + time.Duration(i)*5*time.Second)
+		store.addProbe(storedProbe{Ts: ts, Target: "10.0.0.1:443", Rtt: 1})
+		store.addProbe(storedProbe{Ts: ts, Target: "10.0.0.2:443", Rtt: 1 + float64(i%10/7)*10, Loss: i%10 == 9})
+	}
+	assert.Nil(t, store.flush())
+
+	tracker := newSloTracker(slos)
+	assert.Nil(t, tracker.load(path, now))
+	list := tracker.status(now)
+	assert.Equal(t, 2, len(list))
+	assert.Equal(t, "10.0.0.1:443", list[0].Target)
+	assert.Equal(t, "ok", list[0].State)
+	assert.Equal(t, int64(600), list[0].window("1h").Total)
+	assert.Equal(t, 100.0, list[0].window("30d").Compliance)
+
+	assert.Equal(t, "10.0.0.2:443", list[1].Target)
+	assert.Equal(t, int64(180), list[1].window("1h").Bad)
+	assert.InDelta(t, 30, list[1].window("1h").BurnRate, 1e-9)
+	//只有两天的数据，30天的预算按两天的探测频率推算，还没有用完，1h窗口快速燃烧
+	assert.Equal(t, "fast-burn", list[1].State)
+	span := int64(48*60 + 1)
+	assert.InDelta(t, 100-100*180.0/(0.01*(2820+600)*43200/float64(span)), list[1].window("30d").BudgetRemaining, 1e-9)
+
+	points := tracker.evaluate("host", now)
+	assert.Equal(t, 2, len(points))
+	assert.Equal(t, "fast-burn", points[1].Tags["state"])
+	assert.Equal(t, 1.0, points[1].Fields["alert"])
+	assert.Nil(t, tracker.evaluate("host", now.Add(time.Second)))
+	assert.True(t, strings.HasPrefix(list[1].String(), "gateway 10.0.0.2:443 (99.000% < 5ms): 1h 70.000% burn 30.0"))
+}
@@ -0,0 +1,94 @@
+package cmd
+
+import (
+	"fmt"
+	"net"
+	"path/filepath"
+
+	"github.com/DataDog/datadog-go/v5/statsd"
+	"github.com/qbtrade/qbt/cmd/qbt/cf"
+	"github.com/spf13/viper"
+)
+
+var (
+	spoolDir   string
+	spoolMaxMB int
+)
+
+// openSpool 配置了 --spool-dir 时为一个sink打开磁盘spool，每个sink使用单独的子目录，未配置返回nil
+func openSpool(sink string, send func(data []byte) error) *cf.Spool {
+	dir, maxMB := spoolDir, spoolMaxMB
+	if dir == "" {
+		dir = viper.GetString("spool.dir")
+	}
+	if dir == "" {
+		return nil
+	}
+	if viper.IsSet("spool.max_mb") && !rootCmd.PersistentFlags().Changed("spool-max-mb") {
+		maxMB = viper.GetInt("spool.max_mb")
+	}
+	spool, err := cf.NewSpool(filepath.Join(dir, sink), int64(maxMB)<<20, send)
+	if err != nil {
+		fmt.Println("open spool error:", err)
+		return nil
+	}
+	if files, size := spool.Pending(); files > 0 {
+		fmt.Printf("spool %s has %d batches (%d bytes) to replay\n", sink, files, size)
+	}
+	return spool
+}
+
+// setupSpool 为influxdb打开spool，其他sink在创建时各自打开
+func setupSpool() {
+	if spool := openSpool("influx", cf.PostInflux); spool != nil {
+		cf.InfluxSpool = spool
+	}
+}
+
+// spoolUdpWriter 给statsd client用的UDP writer，发送失败的报文写入spool。
+// UDP只有在收到ICMP不可达后下一次写才会报错，所以只能覆盖解析失败、网络不可达和端口不可达的情况
+type spoolUdpWriter struct {
+	addr  string
+	conn  net.Conn
+	spool *cf.Spool
+}
+
+func (w *spoolUdpWriter) send(data []byte) error {
+	if w.conn == nil {
+		conn, err := net.Dial("udp", w.addr)
+		if err != nil {
+			return err
+		}
+		w.conn = conn
+	}
+	if _, err := w.conn.Write(data); err != nil {
+		_ = w.conn.Close()
+		w.conn = nil
+		return err
+	}
+	return nil
+}
+
+func (w *spoolUdpWriter) Write(data []byte) (int, error) {
+	//statsd client会复用buffer，需要拷贝一份
+	if err := w.spool.Write(append([]byte(nil), data...)); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+func (w *spoolUdpWriter) Close() error {
+	if w.conn != nil {
+		return w.conn.Close()
+	}
+	return nil
+}
+
+// newStatsdClient 创建statsd client，配置了spool时发送失败的报文存到磁盘
+func newStatsdClient(addr string) (*statsd.Client, error) {
+	w := &spoolUdpWriter{addr: addr}
+	if w.spool = openSpool("statsd", w.send); w.spool == nil {
+		return statsd.New(addr)
+	}
+	return statsd.NewWithWriter(w, statsd.WithoutTelemetry())
+}
@@ -0,0 +1,241 @@
+package cmd
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/qbtrade/qbt/cmd/qbt/cf"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	storeProbesBucket    = []byte("probes")
+	storeSummariesBucket = []byte("summaries")
+)
+
+// storedProbe 一次探测的结果
+type storedProbe struct {
+	Ts     time.Time `json:"ts"`
+	Host   string    `json:"host"`
+	Target string    `json:"target"`
+	Kind   string    `json:"kind"` // tcp_ping、tcp_echo
+	Rtt    float64   `json:"rtt"`  // ms
+	Loss   bool      `json:"loss"`
+}
+
+// storedSummary 一个统计窗口的汇总
+type storedSummary struct {
+	Ts     time.Time `json:"ts"` // 窗口结束时间
+	Host   string    `json:"host"`
+	Target string    `json:"target"`
+	Kind   string    `json:"kind"`
+	Count  int       `json:"count"`
+	Loss   int       `json:"loss"`
+	Mean   float64   `json:"mean"`
+	StdDev float64   `json:"stddev"`
+	P50    float64   `json:"p50"`
+	P90    float64   `json:"p90"`
+	P99    float64   `json:"p99"`
+	Max    float64   `json:"max"`
+	Jitter float64   `json:"jitter"`   // RFC 3550 抖动
+	MASD   float64   `json:"masd"`     // 相邻rtt差值绝对值的均值
+	IPDV50 float64   `json:"ipdv_p50"` // 相邻rtt差值绝对值的中位数
+	IPDV99 float64   `json:"ipdv_p99"`
+}
+
+// resultStore 基于bbolt的本地结果库，按 bucket/target/时间 存储。
+// bbolt同一时间只允许一个进程打开，所以只在写入一批数据时打开，qbt query可以在间隙读取
+type resultStore struct {
+	path    string
+	timeout time.Duration
+
+	mu        sync.Mutex
+	probes    []storedProbe
+	summaries []storedSummary
+}
+
+// probeStore tcp-ping的结果库，为nil表示没有配置 --store
+var probeStore *resultStore
+
+func newResultStore(path string) *resultStore {
+	return &resultStore{path: path, timeout: time.Second}
+}
+
+func (s *resultStore) addProbe(p storedProbe) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.probes = append(s.probes, p)
+}
+
+func (s *resultStore) addSummary(summary storedSummary) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.summaries = append(s.summaries, summary)
+}
+
+// flush 把缓存的数据写入数据库，数据库被占用时保留到下次
+func (s *resultStore) flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.probes) == 0 && len(s.summaries) == 0 {
+		return nil
+	}
+	db, err := bolt.Open(s.path, 0644, &bolt.Options{Timeout: s.timeout})
+	if err != nil {
+		if len(s.probes) > maxBufferedPoints {
+			s.probes = s.probes[len(s.probes)-maxBufferedPoints:]
+		}
+		return err
+	}
+	defer db.Close()
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, p := range s.probes {
+			if err := storePut(tx, storeProbesBucket, p.Target, p.Ts, p); err != nil {
+				return err
+			}
+		}
+		for _, summary := range s.summaries {
+			if err := storePut(tx, storeSummariesBucket, summary.Target, summary.Ts, summary); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err == nil {
+		s.probes = s.probes[:0]
+		s.summaries = s.summaries[:0]
+	}
+	return err
+}
+
+// storeKey 时间戳加序号，保证同一纳秒的记录不覆盖且按时间排序
+func storeKey(ts time.Time, seq uint64) []byte {
+	key := make([]byte, 16)
+	binary.BigEndian.PutUint64(key, uint64(ts.UnixNano()))
+	binary.BigEndian.PutUint64(key[8:], seq)
+	return key
+}
+
+func storePut(tx *bolt.Tx, name []byte, target string, ts time.Time, v any) error {
+	root, err := tx.CreateBucketIfNotExists(name)
+	if err != nil {
+		return err
+	}
+	bucket, err := root.CreateBucketIfNotExists([]byte(target))
+	if err != nil {
+		return err
+	}
+	seq, err := bucket.NextSequence()
+	if err != nil {
+		return err
+	}
+	value, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return bucket.Put(storeKey(ts, seq), value)
+}
+
+// storeScan 只读打开数据库，按target和时间顺序遍历[from, to)内的记录
+func storeScan(path string, name []byte, match func(target string) bool, from, to time.Time,
+	fn func(target string, value []byte) error) error {
+	db, err := bolt.Open(path, 0644, &bolt.Options{ReadOnly: true, Timeout: 10 * time.Second})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.View(func(tx *bolt.Tx) error {
+		root := tx.Bucket(name)
+		if root == nil {
+			return nil
+		}
+		return root.ForEach(func(target, _ []byte) error {
+			if !match(string(target)) {
+				return nil
+			}
+			c := root.Bucket(target).Cursor()
+			end := storeKey(to, 0)
+			for k, v := c.Seek(storeKey(from, 0)); k != nil && string(k) < string(end); k, v = c.Next() {
+				if err := fn(string(target), v); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	})
+}
+
+// summaryWindow 按target累计探测结果，每满size次生成一条汇总
+type summaryWindow struct {
+	size int
+	rtts map[string][]float64
+	loss map[string]int
+}
+
+func newSummaryWindow(size int) *summaryWindow {
+	return &summaryWindow{size: size, rtts: map[string][]float64{}, loss: map[string]int{}}
+}
+
+func (w *summaryWindow) add(p storedProbe) (storedSummary, bool) {
+	if p.Loss {
+		w.loss[p.Target]++
+	} else {
+		w.rtts[p.Target] = append(w.rtts[p.Target], p.Rtt)
+	}
+	rtts, loss := w.rtts[p.Target], w.loss[p.Target]
+	if len(rtts)+loss < w.size {
+		return storedSummary{}, false
+	}
+	delete(w.rtts, p.Target)
+	delete(w.loss, p.Target)
+	summary := storedSummary{Ts: p.Ts, Host: p.Host, Target: p.Target, Kind: p.Kind, Count: len(rtts) + loss, Loss: loss}
+	if len(rtts) > 0 {
+		var cost cf.Welford
+		jitter := cf.NewJitter()
+		for _, rtt := range rtts {
+			cost.Add(rtt)
+			jitter.Add(rtt)
+		}
+		summary.Mean = cost.Mean()
+		summary.StdDev = cost.StdDev()
+		summary.P50 = cf.Percentile(rtts, 50)
+		summary.P90 = cf.Percentile(rtts, 90)
+		summary.P99 = cf.Percentile(rtts, 99)
+		summary.Max = cf.Max(rtts[0], rtts...)
+		summary.Jitter = jitter.Jitter()
+		summary.MASD = jitter.MASD()
+		summary.IPDV50 = jitter.IPDV(50)
+		summary.IPDV99 = jitter.IPDV(99)
+	}
+	return summary, true
+}
+
+// addStoreFlags 结果库相关的参数
+func addStoreFlags(cmd *cobra.Command) {
+	cmd.Flags().String("store", "", "record every probe and summary to this local database file, "+
+		"read it with qbt query (default from config key store.path)")
+}
+
+// setupStore 配置了结果库时打开probeStore，返回nil表示未配置
+func setupStore(cmd *cobra.Command) *resultStore {
+	path, _ := cmd.Flags().GetString("store")
+	if path == "" {
+		path = viper.GetString("store.path")
+	}
+	if path == "" {
+		return nil
+	}
+	probeStore = newResultStore(path)
+	//先试一次，路径有问题尽早报错
+	if db, err := bolt.Open(path, 0644, &bolt.Options{Timeout: 10 * time.Second}); err != nil {
+		fmt.Println("open store error:", err)
+	} else {
+		_ = db.Close()
+	}
+	return probeStore
+}
@@ -0,0 +1,69 @@
+package cmd
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResultStoreQuery(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "qbt.db")
+	store := newResultStore(path)
+	window := newSummaryWindow(10)
+	base := time.Date(2026, 10, 19, 10, 0, 0, 0, time.Local)
+	for i := 0; i < 120; i++ {
+		for _, target := range []string{"10.0.0.1:22", "10.0.0.2:22"} {
+			p := storedProbe{Ts: base.Add(time.Duration(i) * time.Second), Target: target, Kind: "tcp_ping",
+				Rtt: float64(i%60 + 1), Loss: i%60 == 59}
+			store.addProbe(p)
+			if summary, ok := window.add(p); ok {
+				store.addSummary(summary)
+			}
+		}
+	}
+	assert.Nil(t, store.flush())
+	assert.Equal(t, 0, len(store.probes))
+
+	aggregator := newQueryAggregator(time.Minute, []float64{50, 99})
+	err := storeScan(path, storeProbesBucket, targetMatcher([]string{"10.0.0.1:*"}), base, base.Add(time.Hour),
+		func(target string, value []byte) error {
+			var p storedProbe
+			assert.Nil(t, json.Unmarshal(value, &p))
+			aggregator.add(target, p.Ts, p.Rtt, p.Loss)
+			return nil
+		})
+	assert.Nil(t, err)
+	rows := aggregator.rows()
+	assert.Equal(t, 2, len(rows))
+	assert.Equal(t, "10.0.0.1:22", rows[0].Target)
+	assert.Equal(t, base, rows[0].Start)
+	assert.Equal(t, 60, rows[0].Count)
+	assert.Equal(t, 1, rows[0].Loss)
+	assert.Equal(t, 1.0, rows[0].Min)
+	assert.Equal(t, 59.0, rows[0].Max)
+	assert.Equal(t, 30.0, rows[0].Percentiles["p50"])
+
+	var summaries int
+	err = storeScan(path, storeSummariesBucket, targetMatcher(nil), base, base.Add(time.Hour),
+		func(target string, value []byte) error {
+			summaries++
+			return nil
+		})
+	assert.Nil(t, err)
+	assert.Equal(t, 24, summaries)
+}
+
+func TestParseQueryTime(t *testing.T) {
+	now := time.Date(2026, 10, 19, 10, 0, 0, 0, time.Local)
+	ts, err := parseQueryTime("-1h", now)
+	assert.Nil(t, err)
+	assert.Equal(t, now.Add(-time.Hour), ts)
+	ts, err = parseQueryTime("2026-10-18 09:30", now)
+	assert.Nil(t, err)
+	assert.Equal(t, time.Date(2026, 10, 18, 9, 30, 0, 0, time.Local), ts)
+	_, err = parseQueryTime("yesterday", now)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,174 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// parsePortRange 解析 8000 或 8000-8010
+func parsePortRange(s string) (from, to int, err error) {
+	lo, hi, isRange := strings.Cut(s, "-")
+	if from, err = strconv.Atoi(lo); err != nil || from < 1 || from > 65535 {
+		return 0, 0, fmt.Errorf("invalid port %q", s)
+	}
+	to = from
+	if isRange {
+		if to, err = strconv.Atoi(hi); err != nil || to < from || to > 65535 {
+			return 0, 0, fmt.Errorf("invalid port range %q", s)
+		}
+	}
+	return from, to, nil
+}
+
+// cidrHosts 网段内的地址，IPv4去掉网络地址和广播地址(/31、/32除外)，超过max个返回错误
+func cidrHosts(cidr string, max int) ([]string, error) {
+	ip, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+	ones, bits := network.Mask.Size()
+	if bits-ones > 24 || 1<<(bits-ones) > max+2 {
+		return nil, fmt.Errorf("%s has more than %d addresses, raise --max-targets if intended", cidr, max)
+	}
+	size := 1 << (bits - ones)
+	start := new(big.Int).SetBytes(network.IP)
+	skipEnds := ip.To4() != nil && bits-ones > 1
+	hosts := make([]string, 0, size)
+	for i := 0; i < size; i++ {
+		if skipEnds && (i == 0 || i == size-1) {
+			continue
+		}
+		b := new(big.Int).Add(start, big.NewInt(int64(i))).Bytes()
+		addr := make(net.IP, len(network.IP))
+		copy(addr[len(addr)-len(b):], b)
+		hosts = append(hosts, addr.String())
+	}
+	return hosts, nil
+}
+
+// readTargetFile 读取 @file 中的target，一行一个，忽略空行和#注释
+func readTargetFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var specs []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = strings.TrimSpace(line[:i])
+		}
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "@") {
+			return nil, fmt.Errorf("%s: nested %s is not supported", path, line)
+		}
+		specs = append(specs, line)
+	}
+	return specs, scanner.Err()
+}
+
+// expandTargets 展开 10.11.0.0/28:22、host:8000-8010 和 @file.txt，去重并保持顺序，
+// 展开后超过max个时返回错误，防止写错网段一次发起大量连接
+func expandTargets(specs []string, max int) ([]string, error) {
+	var targets []string
+	seen := map[string]bool{}
+	add := func(target string) error {
+		if seen[target] {
+			return nil
+		}
+		if len(targets) >= max {
+			return fmt.Errorf("targets expand to more than %d addresses, raise --max-targets if intended", max)
+		}
+		seen[target] = true
+		targets = append(targets, target)
+		return nil
+	}
+	var expand func(specs []string, fromFile string) error
+	expand = func(specs []string, fromFile string) error {
+		for _, spec := range specs {
+			spec = strings.TrimSpace(spec)
+			if strings.HasPrefix(spec, "@") && fromFile == "" {
+				fileSpecs, err := readTargetFile(spec[1:])
+				if err != nil {
+					return err
+				}
+				if err = expand(fileSpecs, spec[1:]); err != nil {
+					return err
+				}
+				continue
+			}
+			host, port, err := net.SplitHostPort(spec)
+			if err != nil {
+				if fromFile != "" {
+					return fmt.Errorf("%s: %w", fromFile, err)
+				}
+				return err
+			}
+			from, to, err := parsePortRange(port)
+			if err != nil {
+				return fmt.Errorf("%s: %w", spec, err)
+			}
+			hosts := []string{host}
+			if strings.Contains(host, "/") {
+				if hosts, err = cidrHosts(host, max); err != nil {
+					return err
+				}
+			}
+			for _, h := range hosts {
+				for p := from; p <= to; p++ {
+					if err = add(net.JoinHostPort(h, strconv.Itoa(p))); err != nil {
+						return err
+					}
+				}
+			}
+		}
+		return nil
+	}
+	if err := expand(specs, ""); err != nil {
+		return nil, err
+	}
+	return targets, nil
+}
+
+// addressesFromFlags 读取target参数，没有指定时用配置文件中的configKey，展开网段、端口范围和文件，
+// 开启 --each-ip 时再展开成每个IP
+func addressesFromFlags(cmd *cobra.Command, flag, configKey string, args ...string) ([]string, error) {
+	addresses, _ := cmd.Flags().GetStringSlice(flag)
+	if !cmd.Flags().Changed(flag) && viper.IsSet(configKey) {
+		addresses = viper.GetStringSlice(configKey)
+	}
+	addresses = append(addresses, args...)
+	max, _ := cmd.Flags().GetInt("max-targets")
+	addresses, err := expandTargets(addresses, max)
+	if err != nil {
+		return nil, err
+	}
+	if eachIP, _ := cmd.Flags().GetBool("each-ip"); eachIP {
+		family, _ := cmd.Flags().GetString("family")
+		if addresses, err = expandEachIP(addresses, family, lookupIPs); err != nil {
+			return nil, err
+		}
+		if len(addresses) > max {
+			return nil, fmt.Errorf("targets expand to more than %d addresses, raise --max-targets if intended", max)
+		}
+		fmt.Println("probing", strings.Join(addresses, ", "))
+	}
+	return addresses, nil
+}
+
+// addTargetFlags target展开相关的参数
+func addTargetFlags(cmd *cobra.Command) {
+	cmd.Flags().Int("max-targets", 1024, "refuse to start when CIDR ranges, port ranges and @files expand to more targets")
+}
@@ -0,0 +1,75 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsePortRange(t *testing.T) {
+	from, to, err := parsePortRange("8000-8010")
+	assert.Nil(t, err)
+	assert.Equal(t, 8000, from)
+	assert.Equal(t, 8010, to)
+	from, to, err = parsePortRange("22")
+	assert.Nil(t, err)
+	assert.Equal(t, 22, from)
+	assert.Equal(t, 22, to)
+	for _, bad := range []string{"", "0", "70000", "8010-8000", "80-x", "http"} {
+		_, _, err = parsePortRange(bad)
+		assert.NotNil(t, err, bad)
+	}
+}
+
+func TestExpandTargets(t *testing.T) {
+	targets, err := expandTargets([]string{"10.11.0.0/28:22"}, 1024)
+	assert.Nil(t, err)
+	//去掉网络地址和广播地址
+	assert.Len(t, targets, 14)
+	assert.Equal(t, "10.11.0.1:22", targets[0])
+	assert.Equal(t, "10.11.0.14:22", targets[13])
+
+	targets, err = expandTargets([]string{"10.11.0.4/31:22", "10.11.0.9/32:22"}, 1024)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"10.11.0.4:22", "10.11.0.5:22", "10.11.0.9:22"}, targets)
+
+	targets, err = expandTargets([]string{"host:8000-8002", "[fd00::/126]:22"}, 1024)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"host:8000", "host:8001", "host:8002",
+		"[fd00::]:22", "[fd00::1]:22", "[fd00::2]:22", "[fd00::3]:22"}, targets)
+
+	//去重并保持顺序
+	targets, err = expandTargets([]string{"10.11.0.1:80", "10.11.0.0/30:80-81", "10.11.0.1:80"}, 1024)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"10.11.0.1:80", "10.11.0.1:81", "10.11.0.2:80", "10.11.0.2:81"}, targets)
+
+	//超过上限
+	_, err = expandTargets([]string{"10.0.0.0/8:22"}, 1024)
+	assert.NotNil(t, err)
+	_, err = expandTargets([]string{"10.11.0.0/28:22-23"}, 20)
+	assert.NotNil(t, err)
+
+	_, err = expandTargets([]string{"10.11.0.1"}, 1024)
+	assert.NotNil(t, err)
+	_, err = expandTargets([]string{"10.11.0.0/33:22"}, 1024)
+	assert.NotNil(t, err)
+}
+
+func TestExpandTargetsFile(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "targets.txt")
+	content := "# core\n10.11.0.1:80\n\n10.11.0.0/30:22 # mgmt\nhost:8000-8001\n10.11.0.1:80\n"
+	assert.Nil(t, os.WriteFile(file, []byte(content), 0o644))
+	targets, err := expandTargets([]string{"@" + file, "10.11.0.2:22"}, 1024)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"10.11.0.1:80", "10.11.0.1:22", "10.11.0.2:22", "host:8000", "host:8001"}, targets)
+
+	nested := filepath.Join(dir, "nested.txt")
+	assert.Nil(t, os.WriteFile(nested, []byte("@"+file+"\n"), 0o644))
+	_, err = expandTargets([]string{"@" + nested}, 1024)
+	assert.NotNil(t, err)
+	_, err = expandTargets([]string{"@" + filepath.Join(dir, "missing.txt")}, 1024)
+	assert.NotNil(t, err)
+}
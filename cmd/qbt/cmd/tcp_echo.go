@@ -0,0 +1,207 @@
+package cmd
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	//长连接模式下重连的退避时间
+	echoMinBackoff = 500 * time.Millisecond
+	echoMaxBackoff = 30 * time.Second
+	//echo报文至少要放下seq和发送时间戳
+	echoMinPayload = 16
+)
+
+var errEchoBackoff = errors.New("waiting for reconnect backoff")
+
+// echoConnStats 记录长连接模式下的连接和重连统计
+type echoConnStats struct {
+	connects    int           // 成功建立连接的次数
+	reconnects  int           // 断线后重连成功的次数
+	disconnects int           // 检测到断线的次数
+	dialFails   int           // 拨号失败的次数
+	downtime    time.Duration // 累计断线时长
+}
+
+func (s echoConnStats) String() string {
+	return fmt.Sprintf("建立连接%d次, 断线%d次, 重连成功%d次, 拨号失败%d次, 累计断线时长%s",
+		s.connects, s.disconnects, s.reconnects, s.dialFails, s.downtime.Round(time.Millisecond))
+}
+
+// tcpEchoSession 对一个目标保持一条TCP长连接，通过echo小报文测量往返时间
+type tcpEchoSession struct {
+	address string
+	timeout time.Duration
+	payload int
+	secret  string
+
+	conn     net.Conn
+	seq      uint64
+	buf      []byte
+	backoff  time.Duration
+	nextDial time.Time
+	lostAt   time.Time
+	stats    echoConnStats
+}
+
+func newTcpEchoSession(address string, timeout time.Duration, payload int, secret string) *tcpEchoSession {
+	if payload < echoMinPayload {
+		payload = echoMinPayload
+	}
+	return &tcpEchoSession{
+		address: address,
+		timeout: timeout,
+		payload: payload,
+		secret:  secret,
+		buf:     make([]byte, payload*2),
+		backoff: echoMinBackoff,
+	}
+}
+
+// dial 建立连接，失败时按指数退避推迟下一次拨号
+func (s *tcpEchoSession) dial() error {
+	conn, err := net.DialTimeout("tcp", s.address, s.timeout)
+	if err == nil && s.secret != "" {
+		if err = authRespond(conn, s.secret, s.timeout); err != nil {
+			_ = conn.Close()
+		}
+	}
+	now := time.Now()
+	if err != nil {
+		s.stats.dialFails++
+		if s.lostAt.IsZero() {
+			s.lostAt = now
+		}
+		s.nextDial = now.Add(s.backoff)
+		s.backoff *= 2
+		if s.backoff > echoMaxBackoff {
+			s.backoff = echoMaxBackoff
+		}
+		return err
+	}
+	s.conn = conn
+	s.stats.connects++
+	if !s.lostAt.IsZero() {
+		s.stats.reconnects++
+		s.stats.downtime += now.Sub(s.lostAt)
+		s.lostAt = time.Time{}
+	}
+	s.backoff = echoMinBackoff
+	return nil
+}
+
+// disconnect 关闭出错的连接，下一次probe时重新拨号
+func (s *tcpEchoSession) disconnect() {
+	if s.conn == nil {
+		return
+	}
+	_ = s.conn.Close()
+	s.conn = nil
+	s.stats.disconnects++
+	s.lostAt = time.Now()
+	s.nextDial = s.lostAt
+}
+
+// probe 发送一个带序号的报文并等待对端原样返回
+func (s *tcpEchoSession) probe() (time.Duration, error) {
+	if s.conn == nil {
+		if time.Now().Before(s.nextDial) {
+			return 0, errEchoBackoff
+		}
+		if err := s.dial(); err != nil {
+			return 0, err
+		}
+	}
+	s.seq++
+	out, in := s.buf[:s.payload], s.buf[s.payload:]
+	start := time.Now()
+	binary.BigEndian.PutUint64(out[0:8], s.seq)
+	binary.BigEndian.PutUint64(out[8:16], uint64(start.UnixNano()))
+
+	_ = s.conn.SetDeadline(start.Add(s.timeout))
+	if _, err := s.conn.Write(out); err != nil {
+		s.disconnect()
+		return 0, err
+	}
+	//读到的序号比当前小说明是之前超时的旧回包，继续读
+	for {
+		if _, err := io.ReadFull(s.conn, in); err != nil {
+			s.disconnect()
+			return 0, err
+		}
+		seq := binary.BigEndian.Uint64(in[0:8])
+		if seq == s.seq {
+			break
+		}
+		if seq > s.seq {
+			s.disconnect()
+			return 0, fmt.Errorf("unexpected echo seq %d, want %d", seq, s.seq)
+		}
+	}
+	return time.Since(start), nil
+}
+
+func (s *tcpEchoSession) close() {
+	if s.conn != nil {
+		_ = s.conn.Close()
+		s.conn = nil
+	}
+}
+
+// CheckTcpEcho 长连接模式的tcp-ping，对端需要运行 qbt serve --tcp-echo
+func CheckTcpEcho(address, hostName string, interval float64, timeout time.Duration, count int,
+	payload int, secret string, displaySummaryOnly bool, writer, summaryWriter *csvRotator, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	ip, port, err := net.SplitHostPort(address)
+	if err != nil {
+		fmt.Println("invalid address", address, err)
+		return
+	}
+	csvWriteChan := make(chan tcpInformation, 1000)
+	writeDone := make(chan struct{})
+	go func() {
+		writeCSVRow(csvWriteChan, writer, summaryWriter, displaySummaryOnly, timeout)
+		close(writeDone)
+	}()
+
+	session := newTcpEchoSession(address, timeout*time.Second, payload, secret)
+	defer session.close()
+	for seq := 1; seq <= count; seq++ {
+		start := time.Now()
+		rtt, err := session.probe()
+		loss := err != nil
+		if loss {
+			rtt = timeout * time.Second
+			if !errors.Is(err, errEchoBackoff) {
+				printEvent(fmt.Sprint("\ntcp-echo ", address, " error: ", err))
+			}
+		}
+		csvWriteChan <- tcpInformation{
+			start:    start,
+			kind:     "tcp_echo",
+			hostName: hostName,
+			ip:       ip,
+			port:     port,
+			rtt:      rtt,
+			loss:     loss,
+		}
+		if seq%100 == 0 {
+			printEvent(fmt.Sprintf("\ntcp-echo (%s) 长连接统计: %s", address, session.stats.String()))
+		}
+
+		//等待interval秒再进行下一次echo
+		if !sleepOrQuit(time.Duration(interval*1000)*time.Millisecond - time.Since(start)) {
+			break
+		}
+	}
+	close(csvWriteChan)
+	<-writeDone
+	fmt.Printf("\ntcp-echo (%s) 长连接统计: %s\n", address, session.stats.String())
+}
@@ -0,0 +1,79 @@
+package cmd
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// closedAddress 返回一个没有监听的本地端口
+func closedAddress(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	address := ln.Addr().String()
+	_ = ln.Close()
+	return address
+}
+
+func TestTcpEchoSessionProbe(t *testing.T) {
+	session := newTcpEchoSession(startTcpEcho(t, newQbtServer("", 0)), time.Second, 4, "")
+	defer session.close()
+	//payload至少要放下seq和时间戳
+	assert.Equal(t, echoMinPayload, session.payload)
+	for i := 0; i < 3; i++ {
+		rtt, err := session.probe()
+		assert.Nil(t, err)
+		assert.True(t, rtt > 0)
+	}
+	assert.Equal(t, 1, session.stats.connects)
+	assert.Equal(t, uint64(3), session.seq)
+}
+
+func TestTcpEchoSessionReconnect(t *testing.T) {
+	session := newTcpEchoSession(startTcpEcho(t, newQbtServer("", 0)), time.Second, 32, "")
+	defer session.close()
+	_, err := session.probe()
+	assert.Nil(t, err)
+
+	//连接断开后这一次probe失败，下一次立即重连
+	_ = session.conn.Close()
+	_, err = session.probe()
+	assert.NotNil(t, err)
+	assert.Nil(t, session.conn)
+	assert.Equal(t, 1, session.stats.disconnects)
+	_, err = session.probe()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, session.stats.connects)
+	assert.Equal(t, 1, session.stats.reconnects)
+	assert.True(t, session.stats.downtime > 0)
+}
+
+func TestTcpEchoSessionBackoff(t *testing.T) {
+	session := newTcpEchoSession(closedAddress(t), time.Second, 32, "")
+	defer session.close()
+	_, err := session.probe()
+	assert.NotNil(t, err)
+	assert.Equal(t, 1, session.stats.dialFails)
+	assert.Equal(t, 2*echoMinBackoff, session.backoff)
+
+	//退避期间不拨号
+	_, err = session.probe()
+	assert.Equal(t, errEchoBackoff, err)
+	assert.Equal(t, 1, session.stats.dialFails)
+
+	for i := 0; i < 10; i++ {
+		session.nextDial = time.Time{}
+		_, _ = session.probe()
+	}
+	assert.Equal(t, echoMaxBackoff, session.backoff)
+
+	//对端恢复后重连成功，退避时间复位
+	session.address = startTcpEcho(t, newQbtServer("", 0))
+	session.nextDial = time.Time{}
+	_, err = session.probe()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, session.stats.reconnects)
+	assert.Equal(t, echoMinBackoff, session.backoff)
+}
@@ -1,7 +1,6 @@
 package cmd
 
 import (
-	"encoding/csv"
 	"errors"
 	"fmt"
 	"github.com/qbtrade/qbt/cmd/qbt/cf"
@@ -35,13 +34,59 @@ type tcpPingVar struct {
 
 type tcpInformation struct {
 	start    time.Time
+	kind     string // tcp_ping、tcp_echo、grpc_ping
 	hostName string
 	ip       string
 	port     string
+	service  string // grpc-ping的服务名，其他为空
+	status   string // grpc-ping的服务状态
 	rtt      time.Duration
 	loss     bool
 }
 
+// target 统计和存储用的名字，grpc-ping按服务区分
+func (t tcpInformation) target() string {
+	target := net.JoinHostPort(t.ip, t.port)
+	if t.service != "" {
+		target += "/" + t.service
+	}
+	return target
+}
+
+// csvRow 原始数据的csv行，grpc-ping多了service和status两列
+func (t tcpInformation) csvRow(rttMs float64) []string {
+	row := []string{strconv.FormatInt(t.start.UnixMilli(), 10), t.hostName, t.ip, t.port}
+	if t.kind == "grpc_ping" {
+		row = append(row, t.service, t.status)
+	}
+	return append(row, strconv.FormatFloat(rttMs, 'f', 4, 64), strconv.FormatBool(t.loss))
+}
+
+// point 原始数据的influxdb数据点，tcp_echo沿用tcp_ping
+func (t tcpInformation) point(rttMs float64) cf.InfluxdbPoint {
+	point := cf.InfluxdbPoint{
+		Measurement: "tcp_ping",
+		Tags: map[string]string{
+			"host": t.hostName,
+			"ip":   t.ip,
+			"port": t.port,
+		},
+		Fields: map[string]float64{
+			"rtt": rttMs,
+		},
+		Time: t.start,
+	}
+	if family := ipFamily(t.ip); family != "" {
+		point.Tags["family"] = family
+	}
+	if t.kind == "grpc_ping" {
+		point.Measurement = t.kind
+		point.Tags["service"] = t.service
+		point.Tags["status"] = t.status
+	}
+	return point
+}
+
 func newTcpPingVar() *tcpPingVar {
 	return &tcpPingVar{
 		sumRtt:   time.Duration(0),
@@ -104,6 +149,18 @@ func (q *tcpPingQueue) LossCount(timeout time.Duration) (lossCount int) {
 	return lossCount
 }
 
+// jitterStats 一个target的rtt抖动统计
+type jitterStats struct {
+	jitter time.Duration // RFC 3550 平滑抖动
+	masd   time.Duration // 相邻rtt差值绝对值的均值
+	ipdv50 time.Duration // 相邻rtt差值绝对值的中位数
+	ipdv99 time.Duration // 相邻rtt差值绝对值的p99
+}
+
+func (j jitterStats) String() string {
+	return fmt.Sprintf("jitter:%v, masd:%v, ipdv p50/p99:%v/%v", j.jitter, j.masd, j.ipdv50, j.ipdv99)
+}
+
 func tcpSummary(timeout time.Duration) {
 	//计算总的平均值
 	meanRtt := tpv.sumRtt.Milliseconds() / int64(tpv.cnt)
@@ -122,18 +179,38 @@ func tcpSummary(timeout time.Duration) {
 	fmt.Println("最近1000次中", loss1000, "次连接失败", "平均RTT为", tpv.rtts1000.mean,
 		"最大rtt是", tpv.rtts1000.max, "标准差为", stdDev1000)
 
+	//抖动按target分别统计，多个target交替探测时相邻的rtt来自不同的路径
+	for _, line := range tpg.jitterLines() {
+		fmt.Println(line)
+	}
+
+	//按地址族和IP分别统计
+	for _, line := range tpg.lines(timeout * time.Second) {
+		fmt.Println(line)
+	}
 	fmt.Println()
 }
 
-func writeCSVRow(csvWriteChan chan tcpInformation, writer *csv.Writer, displaySummaryOnly bool,
-	timeout time.Duration) {
+func writeCSVRow(csvWriteChan chan tcpInformation, writer *csvRotator, summaryWriter *csvRotator,
+	displaySummaryOnly bool, timeout time.Duration) {
 	influxdbPoints := make([]cf.InfluxdbPoint, 0, 1000)
+	window := newSummaryWindow(100)
 	for {
 		select {
 		case t, ok := <-csvWriteChan:
-			//管道已关闭但还是进行读取
+			//管道已关闭说明探测结束，把剩余数据刷盘后退出
 			if !ok {
-				panic("csvWriteChan channel closed")
+				if len(influxdbPoints) > 0 {
+					flushInfluxPoints(influxdbPoints)
+				}
+				flushStore()
+				if err := writer.Flush(); err != nil {
+					fmt.Println("writer error", err)
+				}
+				if err := summaryWriter.Flush(); err != nil {
+					fmt.Println("writer error", err)
+				}
+				return
 			}
 			//每次拨号cnt都要++
 			tpv.cnt++
@@ -145,60 +222,68 @@ func writeCSVRow(csvWriteChan chan tcpInformation, writer *csv.Writer, displaySu
 			//将当前rtt加入队列
 			tpv.rtts100.pushAndMaintain(t.rtt)
 			tpv.rtts1000.pushAndMaintain(t.rtt)
+			tpg.add(t.ip, t.target(), t.rtt, t.loss)
 
-			if !displaySummaryOnly {
-				fmt.Printf("\rtcp-ping (%s:%s) seq=%d rtt=%.2fms       ", t.ip, t.port, tpv.cnt, rttMs)
-			}
-
-			dataRow := []string{
-				strconv.FormatInt(t.start.UnixMilli(), 10),
-				t.hostName,
-				t.ip,
-				t.port,
-				strconv.FormatFloat(rttMs, 'f', 4, 64),
-				strconv.FormatBool(t.loss),
+			if liveTUI != nil {
+				liveTUI.add(t.target(), rttMs, t.loss)
+			} else if !displaySummaryOnly {
+				fmt.Printf("\r%s (%s) seq=%d rtt=%.2fms       ", strings.ReplaceAll(t.kind, "_", "-"), t.target(),
+					tpv.cnt, rttMs)
 			}
 
-			err := writer.Write(dataRow)
+			err := writer.Write(t.csvRow(rttMs), t.start)
 			if err != nil {
 				fmt.Println("writer.Write error", err)
 			}
 
 			//每进行100次tcp-ping进行一次统计
-			if tpv.cnt%100 == 0 {
+			if tpv.cnt%100 == 0 && liveTUI == nil {
 				tcpSummary(timeout)
 			}
-			influxdbPoints = append(influxdbPoints, cf.InfluxdbPoint{
-				Measurement: "tcp_ping",
-				Tags: map[string]string{
-					"host": t.hostName,
-					"ip":   t.ip,
-					"port": t.port,
-				},
-				Fields: map[string]float64{
-					"rtt": rttMs,
-				},
-				Time: t.start,
-			})
-			if len(influxdbPoints) >= 100 {
-				errInfluxdb := cf.WritePoints(influxdbPoints)
-				if errInfluxdb != nil {
-					fmt.Println("write to influxdb error", errInfluxdb)
-				} else {
-					influxdbPoints = make([]cf.InfluxdbPoint, 0, 1000)
+			influxdbPoints = append(influxdbPoints, t.point(rttMs))
+			probe := storedProbe{Ts: t.start, Host: t.hostName, Target: t.target(), Kind: t.kind, Rtt: rttMs,
+				Loss: t.loss}
+			if probeStore != nil {
+				probeStore.addProbe(probe)
+			}
+			if probeSlo != nil {
+				probeSlo.add(probe)
+				influxdbPoints = append(influxdbPoints, probeSlo.evaluate(t.hostName, time.Now())...)
+			}
+			if probeChanges != nil {
+				if e, ok := probeChanges.add(probe); ok {
+					printEvent("\n" + e.String())
+					influxdbPoints = append(influxdbPoints, e.point())
+				}
+			}
+			//每个地址每100次写一条汇总
+			if summary, ok := window.add(probe); ok {
+				row, point := summaryCsvRow(summary, t.ip, t.port), summaryPoint(summary, t.ip, t.port)
+				if t.kind == "grpc_ping" {
+					row = append(row[:4], append([]string{t.service}, row[4:]...)...)
+					point.Tags["service"] = t.service
+				}
+				if err = summaryWriter.Write(row, t.start); err != nil {
+					fmt.Println("writer.Write error", err)
 				}
+				influxdbPoints = append(influxdbPoints, point)
+				if probeStore != nil {
+					probeStore.addSummary(summary)
+				}
+			}
+			if len(influxdbPoints) >= 100 {
+				influxdbPoints = flushInfluxPoints(influxdbPoints)
+				flushStore()
 			}
 
 		//刷盘
 		case <-time.After(time.Second * 10):
-			errInfluxdb := cf.WritePoints(influxdbPoints)
-			if errInfluxdb != nil {
-				fmt.Println("write to influxdb error", errInfluxdb)
-			} else {
-				influxdbPoints = make([]cf.InfluxdbPoint, 0, 1000)
+			influxdbPoints = flushInfluxPoints(influxdbPoints)
+			flushStore()
+			err := writer.Flush()
+			if err == nil {
+				err = summaryWriter.Flush()
 			}
-			writer.Flush()
-			err := writer.Error()
 			if err != nil {
 				fmt.Println("writer error", err)
 				return
@@ -209,6 +294,36 @@ func writeCSVRow(csvWriteChan chan tcpInformation, writer *csv.Writer, displaySu
 	}
 }
 
+// maxBufferedPoints 写入失败时内存中最多保留的数据点，配置 --spool-dir 时失败的数据会存到磁盘
+const maxBufferedPoints = 100000
+
+// flushInfluxPoints 写入数据点，失败时返回保留的数据下次重试，超过上限丢弃最旧的数据
+func flushInfluxPoints(points []cf.InfluxdbPoint) []cf.InfluxdbPoint {
+	if errInfluxdb := cf.WritePoints(points); errInfluxdb != nil {
+		printEvent(fmt.Sprint("write to influxdb error ", errInfluxdb))
+		//collector已经缓存了这些数据，再保留会用新的seq重复发送
+		if errors.Is(errInfluxdb, errCollectorBuffered) {
+			return make([]cf.InfluxdbPoint, 0, 1000)
+		}
+		if len(points) > maxBufferedPoints {
+			fmt.Println("influxdb buffer full, dropped", len(points)-maxBufferedPoints, "points")
+			points = points[len(points)-maxBufferedPoints:]
+		}
+		return points
+	}
+	return make([]cf.InfluxdbPoint, 0, 1000)
+}
+
+// flushStore 把缓存的结果写入 --store
+func flushStore() {
+	if probeStore == nil {
+		return
+	}
+	if err := probeStore.flush(); err != nil {
+		fmt.Println("write store error", err)
+	}
+}
+
 func establishTcp(ip, port, hostName string, timeout time.Duration,
 	tcpChan chan int, csvWrite chan tcpInformation) {
 	//从管道中获得一个许可，防止并发的tcp连接过多
@@ -220,7 +335,7 @@ func establishTcp(ip, port, hostName string, timeout time.Duration,
 
 	//拨号，建立TCP连接
 	start := time.Now()
-	conn, err := net.DialTimeout("tcp", ip+":"+port, timeout*time.Second)
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(ip, port), timeout*time.Second)
 	rtt := time.Duration(0)
 	loss := false
 	if err != nil {
@@ -230,7 +345,7 @@ func establishTcp(ip, port, hostName string, timeout time.Duration,
 		if errors.As(err, &netErr) && netErr.Timeout() {
 			rtt = timeout * time.Second
 		} else {
-			fmt.Println("连接失败")
+			printEvent(fmt.Sprintf("%s 连接失败: %v", net.JoinHostPort(ip, port), err))
 			rtt = timeout * time.Second * 2
 		}
 
@@ -246,6 +361,7 @@ func establishTcp(ip, port, hostName string, timeout time.Duration,
 	}
 
 	tcpInfo := tcpInformation{
+		kind:     "tcp_ping",
 		ip:       ip,
 		port:     port,
 		hostName: hostName,
@@ -257,91 +373,89 @@ func establishTcp(ip, port, hostName string, timeout time.Duration,
 
 }
 
-func openCsvFile(filename string) (writer *csv.Writer, file *os.File, err error) {
-	_, err = os.Stat(filename)
-	if os.IsNotExist(err) {
-		//文件不存在则创建csv文件,并添加标题
-		file, err = os.OpenFile(filename, os.O_CREATE|os.O_WRONLY, 0644)
-		if err != nil {
-			fmt.Println("create csv file error:", err)
-			return
-		}
-		writer = csv.NewWriter(file)
-		dataRow := []string{"ts", "hostname", "ip", "port", "rtt", "loss"}
-		err = writer.Write(dataRow)
-		if err != nil {
-			fmt.Println("writer.Write error", err)
-			return
-		}
-		writer.Flush()
-	} else {
-		//存在则打开即可
-		file, err = os.OpenFile(filename, os.O_APPEND|os.O_WRONLY, 0644)
-		if err != nil {
-			fmt.Println("open csv file error:", err)
-			return
-		}
-		writer = csv.NewWriter(file)
-		dataRow := []string{""}
-		err = writer.Write(dataRow)
-		if err != nil {
-			fmt.Println("writer.Write error", err)
-			return
-		}
-		writer.Flush()
+// tcpPingCsvHeader tcp-ping csv文件的表头
+var tcpPingCsvHeader = []string{"ts", "hostname", "ip", "port", "rtt", "loss"}
+
+// tcpPingSummaryCsvHeader 汇总csv文件的表头，rtt相关的单位都是ms
+var tcpPingSummaryCsvHeader = []string{"ts", "hostname", "ip", "port", "count", "loss", "mean", "stddev",
+	"p50", "p99", "max", "jitter", "masd", "ipdv_p50", "ipdv_p99"}
+
+func summaryCsvRow(s storedSummary, ip, port string) []string {
+	row := []string{strconv.FormatInt(s.Ts.UnixMilli(), 10), s.Host, ip, port,
+		strconv.Itoa(s.Count), strconv.Itoa(s.Loss)}
+	for _, v := range []float64{s.Mean, s.StdDev, s.P50, s.P99, s.Max, s.Jitter, s.MASD, s.IPDV50, s.IPDV99} {
+		row = append(row, strconv.FormatFloat(v, 'f', 4, 64))
+	}
+	return row
+}
 
+func summaryPoint(s storedSummary, ip, port string) cf.InfluxdbPoint {
+	return cf.InfluxdbPoint{
+		Measurement: s.Kind + "_summary",
+		Tags: map[string]string{
+			"host": s.Host,
+			"ip":   ip,
+			"port": port,
+		},
+		Fields: map[string]float64{
+			"count":    float64(s.Count),
+			"loss":     float64(s.Loss),
+			"mean":     s.Mean,
+			"stddev":   s.StdDev,
+			"p50":      s.P50,
+			"p99":      s.P99,
+			"max":      s.Max,
+			"jitter":   s.Jitter,
+			"masd":     s.MASD,
+			"ipdv_p50": s.IPDV50,
+			"ipdv_p99": s.IPDV99,
+		},
+		Time: s.Ts,
 	}
-	return writer, file, err
 }
 
 func CheckTcpPing(address, hostName string, interval float64, timeout time.Duration, count int,
-	displaySummaryOnly bool, maxTcpConnect int, wg *sync.WaitGroup) {
+	displaySummaryOnly bool, maxTcpConnect int, writer, summaryWriter *csvRotator, wg *sync.WaitGroup) {
 	// 防止程序提前退出
 	defer wg.Done()
 
-	//求ip和端口号
-	part := strings.Split(address, ":")
-	ip := part[0]
-	port := part[1]
-	currentTime := time.Now()
-	//文件名
-	filename := hostName + "_" + "tcp_ping" + "_" + currentTime.Format("2006010215") + ".csv"
-	//文件相关变量
-	var (
-		file   *os.File
-		err    error
-		writer *csv.Writer
-	)
+	//求ip和端口号，IPv6写成[v6]:port
+	ip, port, err := net.SplitHostPort(address)
+	if err != nil {
+		fmt.Println("invalid address", address, err)
+		return
+	}
 	//用于限制同时执行的线程数量的管道
 	tcpChan := make(chan int, maxTcpConnect)
 	//用于传递给写线程数据的管道
 	csvWriteChan := make(chan tcpInformation, 1000)
 
-	//打开文件
-	writer, file, err = openCsvFile(filename)
-	if err != nil {
-		fmt.Println("open csvFile fail")
-		return
-	}
-	//关闭文件和连接以及管道
-	defer func() {
-		err = file.Close()
-		if err != nil {
-			fmt.Println("close file error", err)
-			return
-		}
-	}()
 	//写线程
-	go writeCSVRow(csvWriteChan, writer, displaySummaryOnly, timeout)
+	writeDone := make(chan struct{})
+	go func() {
+		writeCSVRow(csvWriteChan, writer, summaryWriter, displaySummaryOnly, timeout)
+		close(writeDone)
+	}()
 
+	//退出时等进行中的连接写完再关闭管道
+	var inflight sync.WaitGroup
 	for count > 0 || tpv.cnt <= count {
 
 		//建立tcp连接
-		go establishTcp(ip, port, hostName, timeout, tcpChan, csvWriteChan)
+		inflight.Add(1)
+		go func() {
+			defer inflight.Done()
+			establishTcp(ip, port, hostName, timeout, tcpChan, csvWriteChan)
+		}()
 
 		//等待interval秒再进行查询
-		time.Sleep(time.Duration(interval*1000) * time.Millisecond)
+		if !sleepOrQuit(time.Duration(interval*1000) * time.Millisecond) {
+			break
+		}
 	}
+	inflight.Wait()
+	close(csvWriteChan)
+	<-writeDone
 }
 
 var tcpPingCmd = &cobra.Command{
@@ -353,20 +467,69 @@ var tcpPingCmd = &cobra.Command{
 		if err != nil || len(addresses) == 0 {
 			return fmt.Errorf("no address to connect")
 		}
-		return nil
+		return checkFamilyFlag(cmd)
 	},
 	Run: func(cmd *cobra.Command, args []string) {
 		onlySummary, _ := cmd.Flags().GetBool("only-summary")
 		timeout, _ := cmd.Flags().GetInt("timeout")
 		interval, _ := cmd.Flags().GetFloat64("interval")
 		count, _ := cmd.Flags().GetInt("count")
-		addresses, _ := cmd.Flags().GetStringSlice("address")
+		addresses, err := addressesFromFlags(cmd, "address", "tcp_ping.addresses")
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
 		maxTcpConnect, _ := cmd.Flags().GetInt("maxTcpConnect")
+		persistent, _ := cmd.Flags().GetBool("persistent")
+		payload, _ := cmd.Flags().GetInt("payload")
+		secret := secretFromFlags(cmd)
+		pmtuInterval, _ := cmd.Flags().GetFloat64("pmtu-interval")
+		pmtuMode, _ := cmd.Flags().GetString("pmtu-mode")
 		hostname, _ := os.Hostname()
+		if collector := setupCollector(cmd); collector != nil {
+			defer collector.close()
+		}
+		setupStore(cmd)
+		setupChanges(cmd)
+		setupSlo()
+		defer setupTUI(cmd)()
+		//所有地址写同一组csv文件
+		kind := "tcp_ping"
+		if persistent {
+			kind = "tcp_echo"
+		}
+		writer, err := newCsvRotator(hostname+"_"+kind, tcpPingCsvHeader, csvOptionsFromFlags(cmd))
+		if err != nil {
+			fmt.Println("open csv file error:", err)
+			return
+		}
+		summaryWriter, err := newCsvRotator(hostname+"_"+kind+"_summary", tcpPingSummaryCsvHeader, csvOptionsFromFlags(cmd))
+		if err != nil {
+			fmt.Println("open csv file error:", err)
+			return
+		}
+		defer func() {
+			for _, w := range []*csvRotator{writer, summaryWriter} {
+				if err := w.Close(); err != nil {
+					fmt.Println("close file error", err)
+				}
+			}
+		}()
 		var wg sync.WaitGroup
 		for _, address := range addresses {
+			//同时定期检查路径MTU
+			if pmtuInterval > 0 {
+				go watchPMTU(pmtuMode, address, hostname, time.Duration(pmtuInterval*1000)*time.Millisecond,
+					math.MaxInt, pmtuOptionsFromFlags(cmd))
+			}
 			wg.Add(1)
-			go CheckTcpPing(address, hostname, interval, time.Duration(timeout), count, onlySummary, maxTcpConnect, &wg)
+			if persistent {
+				go CheckTcpEcho(address, hostname, interval, time.Duration(timeout), count, payload, secret, onlySummary,
+					writer, summaryWriter, &wg)
+				continue
+			}
+			go CheckTcpPing(address, hostname, interval, time.Duration(timeout), count, onlySummary, maxTcpConnect,
+				writer, summaryWriter, &wg)
 		}
 		wg.Wait()
 	},
@@ -379,6 +542,21 @@ func init() {
 	tcpPingCmd.Flags().IntP("timeout", "t", 2, "connect timeout")
 	tcpPingCmd.Flags().Float64P("interval", "i", 1, "connect interval")
 	tcpPingCmd.Flags().IntP("count", "c", math.MaxInt, "max count try to connect")
-	tcpPingCmd.Flags().StringSliceP("address", "a", []string{"10.11.0.1:80"}, "want to connect to IP:PORT,IP:PORT")
+	tcpPingCmd.Flags().StringSliceP("address", "a", []string{"10.11.0.1:80"}, "want to connect to IP:PORT,IP:PORT, IPv6 as [IP]:PORT, also CIDR:PORT, IP:PORT-PORT and @file (default from config key tcp_ping.addresses)")
+	tcpPingCmd.Flags().Bool("each-ip", false, "resolve host names and probe every A and AAAA address separately")
+	tcpPingCmd.Flags().String("family", "", "with --each-ip only probe addresses of this family: 4 or 6, default both")
 	tcpPingCmd.Flags().IntP("maxTcpConnect", "", 1000, "the maximum number of TCP connections")
+	tcpPingCmd.Flags().Bool("persistent", false, "keep one connection per address and measure echo rtt (peer runs qbt serve --tcp-echo)")
+	tcpPingCmd.Flags().Int("payload", 64, "echo payload size in bytes for --persistent")
+	tcpPingCmd.Flags().String("secret", "", "shared secret of qbt serve for --persistent (default from config key secret)")
+	tcpPingCmd.Flags().Float64("pmtu-interval", 0, "also check path mtu every pmtu-interval seconds, 0 disables")
+	tcpPingCmd.Flags().String("pmtu-mode", "icmp", "path mtu probe mode: icmp, udp or tcp")
+	addPMTUFlags(tcpPingCmd)
+	addCollectorFlags(tcpPingCmd)
+	addCsvFlags(tcpPingCmd)
+	addStoreFlags(tcpPingCmd)
+	tcpPingCmd.Flags().Bool("detect-changes", false, "detect latency baseline changes per address and write them as events")
+	addChangeFlags(tcpPingCmd)
+	addTUIFlags(tcpPingCmd)
+	addTargetFlags(tcpPingCmd)
 }
@@ -0,0 +1,29 @@
+package cmd
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGroupStatsJitter(t *testing.T) {
+	g := newGroupStats()
+	for _, ms := range []int{10, 12, 2000, 11, 15} {
+		//另一个target的rtt穿插其中，不计入这个target的抖动
+		g.add("10.0.0.2", "10.0.0.2:80", 100*time.Millisecond, false)
+		g.add("10.0.0.1", "10.0.0.1:80", time.Duration(ms)*time.Millisecond, ms == 2000)
+	}
+	//丢包的2000ms跳过，差值为2,1,4
+	j := g.jitters["10.0.0.1:80"]
+	assert.InDelta(t, float64(7*time.Millisecond)/3, j.MASD(), 1)
+	assert.InEpsilon(t, float64(2*time.Millisecond), j.IPDV(50), 0.01)
+	assert.InEpsilon(t, float64(4*time.Millisecond), j.IPDV(99), 0.01)
+	assert.InDelta(t, float64(time.Millisecond)*0.4185, j.Jitter(), float64(time.Microsecond))
+	assert.Equal(t, 0.0, g.jitters["10.0.0.2:80"].Jitter())
+
+	lines := g.jitterLines()
+	assert.Len(t, lines, 2)
+	assert.Contains(t, lines[0], "10.0.0.1:80 的抖动 jitter:418.")
+	assert.Contains(t, lines[1], "10.0.0.2:80 的抖动 jitter:0s, masd:0s")
+}
@@ -0,0 +1,630 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/qbtrade/qbt/cmd/qbt/cf"
+	"github.com/spf13/cobra"
+)
+
+// 吞吐测试的控制连接：鉴权后客户端发送一个header，
+// tcp模式接着发送数据直到duration结束再关闭写方向，服务端回复收到的字节数和用时；
+// udp模式服务端登记会话后回复一个字节，客户端收到后才开始发udp报文，否则最早的报文会因为会话还不存在被丢弃，
+// 结束后客户端在控制连接上发送已发的报文数，服务端回复收到的统计
+const (
+	throughputMagic     = "QBTT"
+	throughputUdpMagic  = "QBTU"
+	throughputHeaderLen = 4 + 1 + 8 + 4 + 4
+	throughputUdpHeader = 4 + 8 + 8
+	throughputModeTcp   = 0
+	throughputModeUdp   = 1
+	throughputUdpReady  = 1 // 服务端已登记udp会话
+	throughputMaxTime   = time.Hour
+	// throughputUdpGrace 客户端发完后等待在途udp报文的时间
+	throughputUdpGrace = 500 * time.Millisecond
+)
+
+var errThroughputHeader = errors.New("bad throughput header")
+
+// throughputHeader 控制连接上客户端发送的参数
+type throughputHeader struct {
+	mode     byte
+	session  uint64 // udp报文用来对应控制连接
+	duration time.Duration
+	payload  int
+}
+
+func (h throughputHeader) marshal() []byte {
+	buf := make([]byte, throughputHeaderLen)
+	copy(buf, throughputMagic)
+	buf[4] = h.mode
+	binary.BigEndian.PutUint64(buf[5:13], h.session)
+	binary.BigEndian.PutUint32(buf[13:17], uint32(h.duration.Milliseconds()))
+	binary.BigEndian.PutUint32(buf[17:21], uint32(h.payload))
+	return buf
+}
+
+func (h *throughputHeader) unmarshal(buf []byte) error {
+	if len(buf) < throughputHeaderLen || string(buf[:4]) != throughputMagic || buf[4] > throughputModeUdp {
+		return errThroughputHeader
+	}
+	h.mode = buf[4]
+	h.session = binary.BigEndian.Uint64(buf[5:13])
+	h.duration = time.Duration(binary.BigEndian.Uint32(buf[13:17])) * time.Millisecond
+	h.payload = int(binary.BigEndian.Uint32(buf[17:21]))
+	if h.duration <= 0 || h.duration > throughputMaxTime || h.payload <= 0 || h.payload > 1<<20 {
+		return errThroughputHeader
+	}
+	return nil
+}
+
+// throughputResult 服务端统计的一个流的结果
+type throughputResult struct {
+	bytes     uint64
+	elapsed   time.Duration // 从收到第一个字节到最后一个字节
+	packets   uint64        // udp收到的报文数
+	reordered uint64        // udp乱序的报文数
+}
+
+func (r throughputResult) marshal() []byte {
+	buf := make([]byte, 32)
+	binary.BigEndian.PutUint64(buf[0:8], r.bytes)
+	binary.BigEndian.PutUint64(buf[8:16], uint64(r.elapsed))
+	binary.BigEndian.PutUint64(buf[16:24], r.packets)
+	binary.BigEndian.PutUint64(buf[24:32], r.reordered)
+	return buf
+}
+
+func (r *throughputResult) unmarshal(buf []byte) {
+	r.bytes = binary.BigEndian.Uint64(buf[0:8])
+	r.elapsed = time.Duration(binary.BigEndian.Uint64(buf[8:16]))
+	r.packets = binary.BigEndian.Uint64(buf[16:24])
+	r.reordered = binary.BigEndian.Uint64(buf[24:32])
+}
+
+// mbps 按服务端的用时计算的速率
+func (r throughputResult) mbps() float64 {
+	if r.elapsed <= 0 {
+		return 0
+	}
+	return float64(r.bytes) * 8 / r.elapsed.Seconds() / 1e6
+}
+
+// udpSession 服务端一个udp流的统计
+type udpSession struct {
+	mu      sync.Mutex
+	result  throughputResult
+	first   time.Time
+	last    time.Time
+	lastSeq uint64
+}
+
+func (u *udpSession) add(seq uint64, n int, now time.Time) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.result.packets == 0 {
+		u.first = now
+	} else if seq < u.lastSeq {
+		u.result.reordered++
+	}
+	if seq > u.lastSeq {
+		u.lastSeq = seq
+	}
+	u.last = now
+	u.result.packets++
+	u.result.bytes += uint64(n)
+}
+
+func (u *udpSession) snapshot() throughputResult {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	r := u.result
+	r.elapsed = u.last.Sub(u.first)
+	return r
+}
+
+// throughputServer qbt serve --throughput 的状态，udp报文按session找到对应的控制连接
+type throughputServer struct {
+	*qbtServer
+	mu       sync.Mutex
+	sessions map[uint64]*udpSession
+}
+
+// serveThroughput 在同一个端口监听tcp和udp，作为 qbt throughput 的对端
+func (s *qbtServer) serveThroughput(address string) error {
+	ln, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	conn, err := net.ListenPacket("udp", ln.Addr().String())
+	if err != nil {
+		_ = ln.Close()
+		return err
+	}
+	fmt.Println("throughput listening on", ln.Addr(), "tcp and udp")
+	t := &throughputServer{qbtServer: s, sessions: map[uint64]*udpSession{}}
+	go func() {
+		_ = t.receiveUdp(conn)
+	}()
+	defer conn.Close()
+	return t.accept(ln)
+}
+
+func (t *throughputServer) accept(ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		active := atomic.AddInt64(&t.stats.TcpActive, 1)
+		if t.maxConns > 0 && active > t.maxConns {
+			atomic.AddInt64(&t.stats.TcpActive, -1)
+			atomic.AddInt64(&t.stats.TcpRejected, 1)
+			_ = conn.Close()
+			continue
+		}
+		atomic.AddInt64(&t.stats.TcpAccepted, 1)
+		go func() {
+			defer func() {
+				_ = conn.Close()
+				atomic.AddInt64(&t.stats.TcpActive, -1)
+			}()
+			if err := t.handle(conn); err != nil {
+				fmt.Println("throughput", conn.RemoteAddr(), "error:", err)
+			}
+		}()
+	}
+}
+
+func (t *throughputServer) handle(conn net.Conn) error {
+	if t.secret != "" {
+		if err := authChallenge(conn, t.secret, t.timeout); err != nil {
+			atomic.AddInt64(&t.stats.AuthFailures, 1)
+			return err
+		}
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(t.timeout))
+	buf := make([]byte, throughputHeaderLen)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return err
+	}
+	var h throughputHeader
+	if err := h.unmarshal(buf); err != nil {
+		atomic.AddInt64(&t.stats.InvalidPackets, 1)
+		return err
+	}
+	//客户端最多发送duration，多留出握手和在途数据的时间
+	_ = conn.SetDeadline(time.Now().Add(h.duration + 2*t.timeout))
+	var result throughputResult
+	if h.mode == throughputModeTcp {
+		result = receiveTcp(conn, h.payload)
+	} else {
+		session := &udpSession{}
+		t.mu.Lock()
+		t.sessions[h.session] = session
+		t.mu.Unlock()
+		defer func() {
+			t.mu.Lock()
+			delete(t.sessions, h.session)
+			t.mu.Unlock()
+		}()
+		if _, err := conn.Write([]byte{throughputUdpReady}); err != nil {
+			return err
+		}
+		//客户端发完后在控制连接上发送已发的报文数
+		if _, err := io.ReadFull(conn, make([]byte, 8)); err != nil {
+			return err
+		}
+		time.Sleep(throughputUdpGrace)
+		result = session.snapshot()
+	}
+	atomic.AddInt64(&t.stats.ThroughputBytes, int64(result.bytes))
+	_, err := conn.Write(result.marshal())
+	return err
+}
+
+// receiveTcp 读到EOF，统计字节数和从第一个字节到EOF的用时
+func receiveTcp(conn net.Conn, payload int) (result throughputResult) {
+	buf := make([]byte, payload)
+	var first time.Time
+	for {
+		n, err := conn.Read(buf)
+		if n > 0 {
+			if first.IsZero() {
+				first = time.Now()
+			}
+			result.bytes += uint64(n)
+		}
+		if err != nil {
+			break
+		}
+	}
+	if !first.IsZero() {
+		result.elapsed = time.Since(first)
+	}
+	return result
+}
+
+func (t *throughputServer) receiveUdp(conn net.PacketConn) error {
+	buf := make([]byte, 65536)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		if n < throughputUdpHeader || string(buf[:4]) != throughputUdpMagic {
+			atomic.AddInt64(&t.stats.InvalidPackets, 1)
+			continue
+		}
+		t.mu.Lock()
+		session := t.sessions[binary.BigEndian.Uint64(buf[4:12])]
+		t.mu.Unlock()
+		if session != nil {
+			session.add(binary.BigEndian.Uint64(buf[12:20]), n, now)
+		}
+	}
+}
+
+// throughputStream 客户端一个流的结果
+type throughputStream struct {
+	sent        uint64 // 客户端发送的字节数
+	sentPackets uint64
+	retransmits int64 // -1表示无法读取TCP_INFO
+	result      throughputResult
+	err         error
+}
+
+// lossPct udp丢包率
+func (s throughputStream) lossPct() float64 {
+	if s.sentPackets == 0 {
+		return 0
+	}
+	lost := float64(s.sentPackets) - float64(s.result.packets)
+	if lost < 0 {
+		lost = 0
+	}
+	return 100 * lost / float64(s.sentPackets)
+}
+
+// throughputDial 建立控制连接并发送header
+func throughputDial(address, secret string, h throughputHeader, timeout time.Duration) (*net.TCPConn, error) {
+	conn, err := net.DialTimeout("tcp", address, timeout)
+	if err != nil {
+		return nil, err
+	}
+	if secret != "" {
+		if err = authRespond(conn, secret, timeout); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+	}
+	if _, err = conn.Write(h.marshal()); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return conn.(*net.TCPConn), nil
+}
+
+// runTcpStream 发送duration后关闭写方向，等服务端的统计，sent用于每秒的进度
+func runTcpStream(address, secret string, h throughputHeader, timeout time.Duration, sent *uint64) (s throughputStream) {
+	conn, err := throughputDial(address, secret, h, timeout)
+	if err != nil {
+		s.err = err
+		return s
+	}
+	defer conn.Close()
+	buf := make([]byte, h.payload)
+	_, _ = rand.Read(buf)
+	end := time.Now().Add(h.duration)
+	_ = conn.SetWriteDeadline(end.Add(timeout))
+	for time.Now().Before(end) {
+		n, err := conn.Write(buf)
+		s.sent += uint64(n)
+		atomic.AddUint64(sent, uint64(n))
+		if err != nil {
+			s.err = err
+			return s
+		}
+	}
+	if err = conn.CloseWrite(); err != nil {
+		s.err = err
+		return s
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(timeout))
+	buf = buf[:32]
+	if _, err = io.ReadFull(conn, buf); err != nil {
+		s.err = err
+		return s
+	}
+	s.result.unmarshal(buf)
+	//服务端收完所有数据后重传数不会再变化
+	s.retransmits = -1
+	if raw, err := conn.SyscallConn(); err == nil {
+		if n, err := tcpRetransmits(raw); err == nil {
+			s.retransmits = int64(n)
+		}
+	}
+	return s
+}
+
+// runUdpStream 按rate(bit/s)匀速发送duration，结束后在控制连接上取服务端的统计
+func runUdpStream(address, secret string, h throughputHeader, rate float64, timeout time.Duration,
+	sent *uint64) (s throughputStream) {
+	s.retransmits = -1
+	control, err := throughputDial(address, secret, h, timeout)
+	if err != nil {
+		s.err = err
+		return s
+	}
+	defer control.Close()
+	//等服务端登记会话再发，否则最早的报文会被当作丢包
+	ready := make([]byte, 1)
+	_ = control.SetReadDeadline(time.Now().Add(timeout))
+	if _, err = io.ReadFull(control, ready); err != nil {
+		s.err = err
+		return s
+	}
+	if ready[0] != throughputUdpReady {
+		s.err = errThroughputHeader
+		return s
+	}
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		s.err = err
+		return s
+	}
+	defer conn.Close()
+	buf := make([]byte, h.payload)
+	copy(buf, throughputUdpMagic)
+	binary.BigEndian.PutUint64(buf[4:12], h.session)
+	start := time.Now()
+	end := start.Add(h.duration)
+	for now := start; now.Before(end); now = time.Now() {
+		//超前于速率时等待
+		if ahead := time.Duration(float64(s.sent*8)/rate*float64(time.Second)) - now.Sub(start); ahead > 0 {
+			time.Sleep(ahead)
+		}
+		s.sentPackets++
+		binary.BigEndian.PutUint64(buf[12:20], s.sentPackets)
+		//本机缓冲区满等错误算作丢包
+		if n, err := conn.Write(buf); err == nil {
+			atomic.AddUint64(sent, uint64(n))
+		}
+		s.sent += uint64(len(buf))
+	}
+	done := make([]byte, 8)
+	binary.BigEndian.PutUint64(done, s.sentPackets)
+	_ = control.SetDeadline(time.Now().Add(timeout + throughputUdpGrace))
+	if _, err = control.Write(done); err != nil {
+		s.err = err
+		return s
+	}
+	buf = make([]byte, 32)
+	if _, err = io.ReadFull(control, buf); err != nil {
+		s.err = err
+		return s
+	}
+	s.result.unmarshal(buf)
+	return s
+}
+
+// throughputOptions qbt throughput 的参数
+type throughputOptions struct {
+	udp      bool
+	streams  int
+	duration time.Duration
+	payload  int
+	rate     float64 // udp总速率，bit/s
+	secret   string
+	timeout  time.Duration
+}
+
+// runThroughput 并发跑所有流，每interval输出一次客户端的发送速率
+func runThroughput(address string, opts throughputOptions, interval time.Duration, progress func(string)) []throughputStream {
+	var sent uint64
+	streams := make([]throughputStream, opts.streams)
+	var wg sync.WaitGroup
+	for i := range streams {
+		session := make([]byte, 8)
+		_, _ = rand.Read(session)
+		h := throughputHeader{mode: throughputModeTcp, session: binary.BigEndian.Uint64(session),
+			duration: opts.duration, payload: opts.payload}
+		if opts.udp {
+			h.mode = throughputModeUdp
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if opts.udp {
+				streams[i] = runUdpStream(address, opts.secret, h, opts.rate/float64(opts.streams), opts.timeout, &sent)
+			} else {
+				streams[i] = runTcpStream(address, opts.secret, h, opts.timeout, &sent)
+			}
+		}(i)
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	start, last := time.Now(), uint64(0)
+	for {
+		select {
+		case <-done:
+			return streams
+		case now := <-ticker.C:
+			total := atomic.LoadUint64(&sent)
+			progress(fmt.Sprintf("[%5.1fs] sent %.2f Mbps", now.Sub(start).Seconds(),
+				float64(total-last)*8/interval.Seconds()/1e6))
+			last = total
+		}
+	}
+}
+
+// throughputReport 汇总所有流，返回输出的文字和influxdb数据点
+func throughputReport(hostName, address string, opts throughputOptions, streams []throughputStream,
+	ts time.Time) (string, cf.InfluxdbPoint, bool) {
+	proto := map[bool]string{false: "tcp", true: "udp"}[opts.udp]
+	var (
+		b                  bytes.Buffer
+		total              throughputResult
+		mbps               float64
+		sentPackets        uint64
+		retransmits        int64
+		failed             int
+		retransmitsUnknown bool
+	)
+	for i, s := range streams {
+		if s.err != nil {
+			failed++
+			_, _ = fmt.Fprintf(&b, "stream %d error: %v\n", i+1, s.err)
+			continue
+		}
+		mbps += s.result.mbps()
+		total.bytes += s.result.bytes
+		total.packets += s.result.packets
+		total.reordered += s.result.reordered
+		sentPackets += s.sentPackets
+		if s.retransmits < 0 {
+			retransmitsUnknown = true
+		} else {
+			retransmits += s.retransmits
+		}
+		if len(streams) > 1 {
+			_, _ = fmt.Fprintf(&b, "stream %d: %.2f Mbps", i+1, s.result.mbps())
+			if opts.udp {
+				_, _ = fmt.Fprintf(&b, ", loss %.3f%%", s.lossPct())
+			} else if s.retransmits >= 0 {
+				_, _ = fmt.Fprintf(&b, ", retransmits %d", s.retransmits)
+			}
+			b.WriteString("\n")
+		}
+	}
+	if failed == len(streams) {
+		return b.String(), cf.InfluxdbPoint{}, false
+	}
+	_, _ = fmt.Fprintf(&b, "throughput (%s) %s %d streams: %.2f Mbps received, %.1f MB", address, proto,
+		len(streams)-failed, mbps, float64(total.bytes)/1e6)
+	fields := map[string]float64{
+		"mbps":    mbps,
+		"bytes":   float64(total.bytes),
+		"streams": float64(len(streams) - failed),
+	}
+	if opts.udp {
+		all := throughputStream{sentPackets: sentPackets, result: total}
+		_, _ = fmt.Fprintf(&b, ", packets %d/%d, loss %.3f%%, reordered %d", total.packets, sentPackets,
+			all.lossPct(), total.reordered)
+		fields["loss_pct"] = all.lossPct()
+		fields["reordered"] = float64(total.reordered)
+	} else if retransmitsUnknown {
+		b.WriteString(", retransmits n/a")
+	} else {
+		_, _ = fmt.Fprintf(&b, ", retransmits %d", retransmits)
+		fields["retransmits"] = float64(retransmits)
+	}
+	ip, port, _ := net.SplitHostPort(address)
+	return b.String(), cf.InfluxdbPoint{
+		Measurement: "throughput",
+		Tags: map[string]string{
+			"host":  hostName,
+			"ip":    ip,
+			"port":  port,
+			"proto": proto,
+		},
+		Fields: fields,
+		Time:   ts,
+	}, true
+}
+
+var throughputCmd = &cobra.Command{
+	Use:   "throughput",
+	Short: "measure bandwidth to qbt serve --throughput",
+	Long: `send data to qbt serve --throughput for --duration seconds over --streams parallel tcp connections or udp
+flows and report the rate received by the far end. tcp reports the retransmits from TCP_INFO (linux only),
+udp sends at --bandwidth Mbps in total and reports the loss and reordering seen by the far end.
+For example:
+qbt throughput -a 10.11.1.86:7009 -P 4 -d 10
+qbt throughput -a 10.11.1.86:7009 --udp --bandwidth 500 --payload 1400`,
+	Args: func(cmd *cobra.Command, args []string) error {
+		address, _ := cmd.Flags().GetString("address")
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			return fmt.Errorf("invalid address %q: %v", address, err)
+		}
+		streams, _ := cmd.Flags().GetInt("streams")
+		duration, _ := cmd.Flags().GetFloat64("duration")
+		if streams <= 0 || duration <= 0 || time.Duration(duration*float64(time.Second)) > throughputMaxTime {
+			return fmt.Errorf("--streams must be positive and --duration between 0 and %v", throughputMaxTime)
+		}
+		return nil
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		address, _ := cmd.Flags().GetString("address")
+		udp, _ := cmd.Flags().GetBool("udp")
+		streams, _ := cmd.Flags().GetInt("streams")
+		duration, _ := cmd.Flags().GetFloat64("duration")
+		payload, _ := cmd.Flags().GetInt("payload")
+		bandwidth, _ := cmd.Flags().GetFloat64("bandwidth")
+		timeout, _ := cmd.Flags().GetFloat64("timeout")
+		interval, _ := cmd.Flags().GetFloat64("interval")
+		if payload <= 0 {
+			payload = map[bool]int{false: 128 << 10, true: 1400}[udp]
+		}
+		if udp && payload < throughputUdpHeader {
+			payload = throughputUdpHeader
+		}
+		if udp && payload > 65507 {
+			fmt.Println("--payload of udp must not exceed 65507")
+			return
+		}
+		opts := throughputOptions{
+			udp:      udp,
+			streams:  streams,
+			duration: time.Duration(duration * float64(time.Second)),
+			payload:  payload,
+			rate:     bandwidth * 1e6,
+			secret:   secretFromFlags(cmd),
+			timeout:  time.Duration(timeout * float64(time.Second)),
+		}
+		if collector := setupCollector(cmd); collector != nil {
+			defer collector.close()
+		}
+		hostname, _ := os.Hostname()
+		start := time.Now()
+		results := runThroughput(address, opts, time.Duration(interval*float64(time.Second)), func(line string) {
+			fmt.Println(line)
+		})
+		report, point, ok := throughputReport(hostname, address, opts, results, start)
+		fmt.Print(report)
+		if ok {
+			fmt.Println()
+			flushInfluxPoints([]cf.InfluxdbPoint{point})
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(throughputCmd)
+	throughputCmd.Flags().StringP("address", "a", "", "IP:PORT of qbt serve --throughput")
+	throughputCmd.Flags().Bool("udp", false, "send udp datagrams instead of tcp streams")
+	throughputCmd.Flags().IntP("streams", "P", 1, "parallel streams")
+	throughputCmd.Flags().Float64P("duration", "d", 10, "seconds to send")
+	throughputCmd.Flags().Int("payload", 0, "bytes per write for tcp (default 128KiB) or per datagram for udp (default 1400)")
+	throughputCmd.Flags().Float64("bandwidth", 100, "total udp send rate in Mbps")
+	throughputCmd.Flags().Float64P("interval", "i", 1, "seconds between progress reports")
+	throughputCmd.Flags().Float64P("timeout", "t", 5, "timeout in seconds of the connect and of the final report")
+	throughputCmd.Flags().String("secret", "", "shared secret of qbt serve (default from config key secret)")
+	addCollectorFlags(throughputCmd)
+}
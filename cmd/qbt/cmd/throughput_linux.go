@@ -0,0 +1,22 @@
+package cmd
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// tcpRetransmits 从TCP_INFO读取连接累计的重传报文数
+func tcpRetransmits(c syscall.RawConn) (retransmits uint32, err error) {
+	var opErr error
+	err = c.Control(func(fd uintptr) {
+		var info *unix.TCPInfo
+		if info, opErr = unix.GetsockoptTCPInfo(int(fd), unix.IPPROTO_TCP, unix.TCP_INFO); opErr == nil {
+			retransmits = info.Total_retrans
+		}
+	})
+	if err != nil {
+		return 0, err
+	}
+	return retransmits, opErr
+}
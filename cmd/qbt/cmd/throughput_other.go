@@ -0,0 +1,12 @@
+//go:build !linux
+
+package cmd
+
+import (
+	"errors"
+	"syscall"
+)
+
+func tcpRetransmits(c syscall.RawConn) (uint32, error) {
+	return 0, errors.New("TCP_INFO is only supported on linux")
+}
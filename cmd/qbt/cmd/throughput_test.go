@@ -0,0 +1,88 @@
+package cmd
+
+import (
+	"net"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// throughputTestServer 在随机端口上启动tcp和udp，返回地址
+func throughputTestServer(t *testing.T, secret string) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	conn, err := net.ListenPacket("udp", ln.Addr().String())
+	assert.Nil(t, err)
+	t.Cleanup(func() {
+		_ = ln.Close()
+		_ = conn.Close()
+	})
+	server := &throughputServer{qbtServer: newQbtServer(secret, 0), sessions: map[uint64]*udpSession{}}
+	go func() { _ = server.receiveUdp(conn) }()
+	go func() { _ = server.accept(ln) }()
+	return ln.Addr().String()
+}
+
+func TestThroughputHeader(t *testing.T) {
+	h := throughputHeader{mode: throughputModeUdp, session: 42, duration: 1500 * time.Millisecond, payload: 1400}
+	var got throughputHeader
+	assert.Nil(t, got.unmarshal(h.marshal()))
+	assert.Equal(t, h, got)
+	bad := h.marshal()
+	bad[0] = 'X'
+	assert.Equal(t, errThroughputHeader, got.unmarshal(bad))
+	h.duration = 2 * throughputMaxTime
+	assert.Equal(t, errThroughputHeader, got.unmarshal(h.marshal()))
+}
+
+func TestThroughputTcp(t *testing.T) {
+	address := throughputTestServer(t, "s3cret")
+	opts := throughputOptions{streams: 2, duration: 300 * time.Millisecond, payload: 64 << 10, secret: "s3cret",
+		timeout: 2 * time.Second}
+	var lines []string
+	streams := runThroughput(address, opts, 100*time.Millisecond, func(line string) { lines = append(lines, line) })
+	assert.Len(t, streams, 2)
+	assert.NotEmpty(t, lines)
+	for _, s := range streams {
+		assert.Nil(t, s.err)
+		//服务端收到的和客户端发送的一致
+		assert.Equal(t, s.sent, s.result.bytes)
+		assert.True(t, s.result.mbps() > 0)
+		if runtime.GOOS == "linux" {
+			assert.True(t, s.retransmits >= 0)
+		}
+	}
+	report, point, ok := throughputReport("h", address, opts, streams, time.Now())
+	assert.True(t, ok)
+	assert.Contains(t, report, "tcp 2 streams")
+	assert.Equal(t, "tcp", point.Tags["proto"])
+	assert.True(t, point.Fields["mbps"] > 0)
+
+	//密钥错误
+	opts.secret = "wrong"
+	streams = runThroughput(address, opts, time.Second, func(string) {})
+	assert.NotNil(t, streams[0].err)
+	_, _, ok = throughputReport("h", address, opts, streams, time.Now())
+	assert.False(t, ok)
+}
+
+func TestThroughputUdp(t *testing.T) {
+	address := throughputTestServer(t, "")
+	opts := throughputOptions{udp: true, streams: 1, duration: 300 * time.Millisecond, payload: 1000, rate: 10e6,
+		timeout: 2 * time.Second}
+	streams := runThroughput(address, opts, time.Second, func(string) {})
+	s := streams[0]
+	assert.Nil(t, s.err)
+	//10Mbps发送300ms约375个报文
+	assert.InDelta(t, 375, float64(s.sentPackets), 60)
+	//服务端登记会话后才开始发送，本机回环上不应该丢包
+	assert.Equal(t, s.sentPackets, s.result.packets)
+	assert.Equal(t, 0.0, s.lossPct())
+	assert.Equal(t, s.result.packets*1000, s.result.bytes)
+	report, point, ok := throughputReport("h", address, opts, streams, time.Now())
+	assert.True(t, ok)
+	assert.Contains(t, report, "loss")
+	assert.Contains(t, point.Fields, "loss_pct")
+}
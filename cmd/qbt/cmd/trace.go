@@ -0,0 +1,529 @@
+package cmd
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/qbtrade/qbt/cmd/qbt/cf"
+	"github.com/spf13/cobra"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+)
+
+const (
+	protocolICMP = 1
+	protocolTCP  = 6
+	//每一跳最多保留最近多少个样本用于计算分位数
+	traceHopSamples = 1000
+)
+
+// traceProbe 一次探测某个TTL的结果，也是导出CSV/JSON的一行
+type traceProbe struct {
+	Ts      time.Time `json:"ts"`
+	Target  string    `json:"target"`
+	Mode    string    `json:"mode"`
+	Round   int       `json:"round"`
+	TTL     int       `json:"ttl"`
+	Hop     string    `json:"hop"`     // 回应的路由器或目标地址，超时为空
+	RTT     float64   `json:"rtt"`     // 单位ms
+	Loss    bool      `json:"loss"`    // 该跳没有回应
+	Reached bool      `json:"reached"` // 已到达目标
+}
+
+// icmpHit 从ICMP socket上收到的、和某次探测匹配的回应
+type icmpHit struct {
+	from    net.IP
+	at      time.Time
+	reached bool
+}
+
+// tracer 以TCP-SYN或ICMP echo逐跳探测到目标的路径
+type tracer struct {
+	mode    string
+	target  string
+	dst     net.IP
+	port    int
+	timeout time.Duration
+
+	conn    *icmp.PacketConn
+	id      int
+	writeMu sync.Mutex
+	mu      sync.Mutex
+	seq     uint16
+	waiting map[int]chan icmpHit // icmp模式以seq、tcp模式以本地端口作为key
+}
+
+func newTracer(mode, address string, timeout time.Duration) (*tracer, error) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q", portStr)
+	}
+	ipAddr, err := net.ResolveIPAddr("ip4", host)
+	if err != nil {
+		return nil, err
+	}
+	if mode != "tcp" && mode != "icmp" {
+		return nil, fmt.Errorf("unknown trace mode %q", mode)
+	}
+	//收取Time Exceeded需要raw socket，一般要root或CAP_NET_RAW
+	conn, err := icmp.ListenPacket("ip4:icmp", "0.0.0.0")
+	if err != nil {
+		return nil, fmt.Errorf("open icmp socket (need root or CAP_NET_RAW): %w", err)
+	}
+	t := &tracer{
+		mode:    mode,
+		target:  address,
+		dst:     ipAddr.IP.To4(),
+		port:    port,
+		timeout: timeout,
+		conn:    conn,
+		id:      os.Getpid() & 0xffff,
+		waiting: make(map[int]chan icmpHit),
+	}
+	go t.readICMP()
+	return t, nil
+}
+
+func (t *tracer) close() {
+	_ = t.conn.Close()
+}
+
+func (t *tracer) register(key int) chan icmpHit {
+	ch := make(chan icmpHit, 1)
+	t.mu.Lock()
+	t.waiting[key] = ch
+	t.mu.Unlock()
+	return ch
+}
+
+func (t *tracer) unregister(key int) {
+	t.mu.Lock()
+	delete(t.waiting, key)
+	t.mu.Unlock()
+}
+
+func (t *tracer) deliver(key int, hit icmpHit) {
+	t.mu.Lock()
+	ch, ok := t.waiting[key]
+	t.mu.Unlock()
+	if !ok {
+		return
+	}
+	select {
+	case ch <- hit:
+	default:
+	}
+}
+
+// readICMP 持续读取ICMP报文，根据报文中携带的原始报文头找到对应的探测
+func (t *tracer) readICMP() {
+	buf := make([]byte, 1500)
+	for {
+		n, peer, err := t.conn.ReadFrom(buf)
+		at := time.Now()
+		if err != nil {
+			return
+		}
+		msg, err := icmp.ParseMessage(protocolICMP, buf[:n])
+		if err != nil {
+			continue
+		}
+		from := peer.(*net.IPAddr).IP
+		var original []byte
+		switch body := msg.Body.(type) {
+		case *icmp.Echo:
+			if msg.Type == ipv4.ICMPTypeEchoReply && t.mode == "icmp" && body.ID == t.id && from.Equal(t.dst) {
+				t.deliver(body.Seq, icmpHit{from: from, at: at, reached: true})
+			}
+			continue
+		case *icmp.TimeExceeded:
+			original = body.Data
+		case *icmp.DstUnreach:
+			original = body.Data
+		default:
+			continue
+		}
+		key, ok := t.matchOriginal(original)
+		if ok {
+			t.deliver(key, icmpHit{from: from, at: at, reached: from.Equal(t.dst)})
+		}
+	}
+}
+
+// matchOriginal 解析ICMP差错报文中引用的原始IP头和前8个字节
+func (t *tracer) matchOriginal(data []byte) (int, bool) {
+	if len(data) < 20 {
+		return 0, false
+	}
+	ihl := int(data[0]&0x0f) * 4
+	if len(data) < ihl+8 || !net.IP(data[16:20]).Equal(t.dst) {
+		return 0, false
+	}
+	payload := data[ihl:]
+	switch {
+	case t.mode == "icmp" && data[9] == protocolICMP:
+		if int(binary.BigEndian.Uint16(payload[4:6])) != t.id {
+			return 0, false
+		}
+		return int(binary.BigEndian.Uint16(payload[6:8])), true
+	case t.mode == "tcp" && data[9] == protocolTCP:
+		if int(binary.BigEndian.Uint16(payload[2:4])) != t.port {
+			return 0, false
+		}
+		return int(binary.BigEndian.Uint16(payload[0:2])), true
+	}
+	return 0, false
+}
+
+func (t *tracer) probe(ttl int) traceProbe {
+	if t.mode == "icmp" {
+		return t.probeICMP(ttl)
+	}
+	return t.probeTCP(ttl)
+}
+
+func (t *tracer) probeICMP(ttl int) traceProbe {
+	t.mu.Lock()
+	t.seq++
+	seq := int(t.seq)
+	t.mu.Unlock()
+	ch := t.register(seq)
+	defer t.unregister(seq)
+
+	msg := icmp.Message{
+		Type: ipv4.ICMPTypeEcho,
+		Body: &icmp.Echo{ID: t.id, Seq: seq, Data: []byte("qbt-trace")},
+	}
+	b, _ := msg.Marshal(nil)
+	result := traceProbe{TTL: ttl, Loss: true}
+	//同一个socket上设置TTL和发送需要串行
+	t.writeMu.Lock()
+	result.Ts = time.Now()
+	err := t.conn.IPv4PacketConn().SetTTL(ttl)
+	if err == nil {
+		_, err = t.conn.WriteTo(b, &net.IPAddr{IP: t.dst})
+	}
+	t.writeMu.Unlock()
+	if err != nil {
+		return result
+	}
+	select {
+	case hit := <-ch:
+		result.fill(hit)
+	case <-time.After(t.timeout):
+	}
+	return result
+}
+
+func (t *tracer) probeTCP(ttl int) traceProbe {
+	result := traceProbe{TTL: ttl, Loss: true}
+	bound := make(chan int, 1)
+	var ch chan icmpHit
+	dialer := net.Dialer{Control: ttlControl(ttl, func(port int) {
+		ch = t.register(port)
+		bound <- port
+	})}
+	ctx, cancel := context.WithTimeout(context.Background(), t.timeout)
+	defer cancel()
+
+	dialErr := make(chan error, 1)
+	result.Ts = time.Now()
+	go func() {
+		conn, err := dialer.DialContext(ctx, "tcp4", net.JoinHostPort(t.dst.String(), strconv.Itoa(t.port)))
+		if err == nil {
+			_ = conn.Close()
+		}
+		dialErr <- err
+	}()
+	var port int
+	select {
+	case port = <-bound:
+		defer t.unregister(port)
+	case err := <-dialErr:
+		fmt.Println("trace dial error:", err)
+		return result
+	}
+	select {
+	case hit := <-ch:
+		result.fill(hit)
+	case err := <-dialErr:
+		//握手成功或被目标RST都说明已经到达目标
+		if err == nil || errors.Is(err, syscall.ECONNREFUSED) {
+			result.fill(icmpHit{from: t.dst, at: time.Now(), reached: true})
+		}
+	case <-ctx.Done():
+	}
+	return result
+}
+
+func (p *traceProbe) fill(hit icmpHit) {
+	p.Hop = hit.from.String()
+	p.RTT = float64(hit.at.Sub(p.Ts).Nanoseconds()) / 1e6
+	p.Loss = false
+	p.Reached = hit.reached
+}
+
+// hopProber 探测某个TTL，测试中用假的实现代替raw socket
+type hopProber interface {
+	probe(ttl int) traceProbe
+}
+
+func (t *tracer) round(n, maxHops int) []traceProbe {
+	return traceRound(t, n, maxHops, t.target, t.mode)
+}
+
+// traceRound 并发探测1~maxHops每一跳，返回到达目标为止的结果
+func traceRound(p hopProber, n, maxHops int, target, mode string) []traceProbe {
+	results := make([]traceProbe, maxHops)
+	var wg sync.WaitGroup
+	for ttl := 1; ttl <= maxHops; ttl++ {
+		wg.Add(1)
+		go func(ttl int) {
+			defer wg.Done()
+			results[ttl-1] = p.probe(ttl)
+		}(ttl)
+	}
+	wg.Wait()
+	for i := range results {
+		results[i].Target = target
+		results[i].Mode = mode
+		results[i].Round = n
+		if results[i].Reached {
+			return results[:i+1]
+		}
+	}
+	return results
+}
+
+// traceHopStat MTR模式下每一跳的统计
+type traceHopStat struct {
+	ttl     int
+	hop     string
+	sent    int
+	recv    int
+	last    float64
+	best    float64
+	worst   float64
+	sum     float64
+	samples []float64
+}
+
+func (h *traceHopStat) add(p traceProbe) {
+	h.sent++
+	if p.Loss {
+		return
+	}
+	h.hop = p.Hop
+	h.recv++
+	h.last = p.RTT
+	h.sum += p.RTT
+	if h.recv == 1 || p.RTT < h.best {
+		h.best = p.RTT
+	}
+	h.worst = cf.Max(h.worst, p.RTT)
+	h.samples = append(h.samples, p.RTT)
+	if len(h.samples) > traceHopSamples {
+		h.samples = h.samples[1:]
+	}
+}
+
+func (h *traceHopStat) row() string {
+	hop := h.hop
+	if hop == "" {
+		hop = "???"
+	}
+	loss := 100 * float64(h.sent-h.recv) / float64(h.sent)
+	if h.recv == 0 {
+		return fmt.Sprintf("%3d. %-16s %6.1f%% %5d", h.ttl, hop, loss, h.sent)
+	}
+	return fmt.Sprintf("%3d. %-16s %6.1f%% %5d %8.2f %8.2f %8.2f %8.2f %8.2f %8.2f %8.2f",
+		h.ttl, hop, loss, h.sent, h.last, h.sum/float64(h.recv), h.best, h.worst,
+		cf.Percentile(h.samples, 50), cf.Percentile(h.samples, 90), cf.Percentile(h.samples, 99))
+}
+
+func printTraceTable(target string, hops []*traceHopStat) {
+	fmt.Printf("\ntrace to %s\n", target)
+	fmt.Printf("%-21s %7s %5s %8s %8s %8s %8s %8s %8s %8s\n",
+		"Host", "Loss%", "Snt", "Last", "Avg", "Best", "Wrst", "p50", "p90", "p99")
+	for _, h := range hops {
+		if h.sent > 0 {
+			fmt.Println(h.row())
+		}
+	}
+}
+
+// traceExporter 把每次探测结果写成CSV或JSON lines
+type traceExporter struct {
+	format string
+	file   *os.File
+	csv    *csv.Writer
+	json   *json.Encoder
+}
+
+func newTraceExporter(format, filename, hostName string) (*traceExporter, error) {
+	if format == "" {
+		return nil, nil
+	}
+	if format != "csv" && format != "json" {
+		return nil, fmt.Errorf("unknown export format %q", format)
+	}
+	if filename == "" {
+		filename = hostName + "_" + "trace" + "_" + time.Now().Format("2006010215") + "." + format
+	}
+	file, err := os.OpenFile(filename, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	e := &traceExporter{format: format, file: file}
+	if format == "json" {
+		e.json = json.NewEncoder(file)
+		return e, nil
+	}
+	e.csv = csv.NewWriter(file)
+	if info, err := file.Stat(); err == nil && info.Size() == 0 {
+		_ = e.csv.Write([]string{"ts", "hostname", "target", "mode", "round", "ttl", "hop", "rtt", "loss", "reached"})
+	}
+	return e, nil
+}
+
+func (e *traceExporter) write(hostName string, probes []traceProbe) {
+	for _, p := range probes {
+		var err error
+		if e.json != nil {
+			err = e.json.Encode(p)
+		} else {
+			err = e.csv.Write([]string{
+				strconv.FormatInt(p.Ts.UnixMilli(), 10),
+				hostName,
+				p.Target,
+				p.Mode,
+				strconv.Itoa(p.Round),
+				strconv.Itoa(p.TTL),
+				p.Hop,
+				strconv.FormatFloat(p.RTT, 'f', 4, 64),
+				strconv.FormatBool(p.Loss),
+				strconv.FormatBool(p.Reached),
+			})
+		}
+		if err != nil {
+			fmt.Println("export trace error", err)
+		}
+	}
+	if e.csv != nil {
+		e.csv.Flush()
+	}
+}
+
+func (e *traceExporter) close() {
+	if e.csv != nil {
+		e.csv.Flush()
+	}
+	_ = e.file.Close()
+}
+
+var traceCmd = &cobra.Command{
+	Use:   "trace",
+	Short: "traceroute / mtr style path analysis",
+	Long: `trace the path to IP:PORT with tcp syn (default, same port as tcp-ping) or icmp echo.
+Needs root or CAP_NET_RAW to receive icmp time exceeded messages.
+For example:
+qbt trace 10.110.1.86:22
+qbt trace --mtr --mode icmp -i 1 --format csv 10.110.1.86:22`,
+	Args: func(cmd *cobra.Command, args []string) error {
+		address, _ := cmd.Flags().GetString("address")
+		if address == "" && len(args) == 0 {
+			return fmt.Errorf("no address to trace")
+		}
+		return nil
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		address, _ := cmd.Flags().GetString("address")
+		if len(args) > 0 {
+			address = args[0]
+		}
+		mode, _ := cmd.Flags().GetString("mode")
+		maxHops, _ := cmd.Flags().GetInt("max-hops")
+		timeout, _ := cmd.Flags().GetFloat64("timeout")
+		interval, _ := cmd.Flags().GetFloat64("interval")
+		mtr, _ := cmd.Flags().GetBool("mtr")
+		count, _ := cmd.Flags().GetInt("count")
+		format, _ := cmd.Flags().GetString("format")
+		output, _ := cmd.Flags().GetString("output")
+		if !cmd.Flags().Changed("count") && !mtr {
+			count = 1
+		}
+		hostname, _ := os.Hostname()
+
+		t, err := newTracer(mode, address, time.Duration(timeout*1000)*time.Millisecond)
+		if err != nil {
+			fmt.Println("trace error:", err)
+			return
+		}
+		defer t.close()
+		exporter, err := newTraceExporter(format, output, hostname)
+		if err != nil {
+			fmt.Println("trace export error:", err)
+			return
+		}
+		if exporter != nil {
+			defer exporter.close()
+		}
+
+		hops := make([]*traceHopStat, maxHops)
+		for i := range hops {
+			hops[i] = &traceHopStat{ttl: i + 1}
+		}
+		for n := 1; n <= count; n++ {
+			start := time.Now()
+			probes := t.round(n, maxHops)
+			for _, p := range probes {
+				hops[p.TTL-1].add(p)
+			}
+			if exporter != nil {
+				exporter.write(hostname, probes)
+			}
+			if mtr {
+				printTraceTable(address, hops)
+			} else {
+				for _, p := range probes {
+					if p.Loss {
+						fmt.Printf("%3d. *\n", p.TTL)
+					} else {
+						fmt.Printf("%3d. %-16s %.2fms\n", p.TTL, p.Hop, p.RTT)
+					}
+				}
+			}
+			if n < count {
+				time.Sleep(time.Duration(interval*1000)*time.Millisecond - time.Since(start))
+			}
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(traceCmd)
+	traceCmd.Flags().StringP("address", "a", "", "IP:PORT to trace, port is used by tcp mode")
+	traceCmd.Flags().String("mode", "tcp", "probe mode: tcp or icmp")
+	traceCmd.Flags().Int("max-hops", 30, "max ttl to probe")
+	traceCmd.Flags().Float64P("timeout", "t", 2, "wait time for each hop in seconds")
+	traceCmd.Flags().Float64P("interval", "i", 1, "interval between rounds in seconds")
+	traceCmd.Flags().Bool("mtr", false, "keep tracing and show per-hop loss and latency percentiles")
+	traceCmd.Flags().IntP("count", "c", math.MaxInt, "rounds to trace, default 1 without --mtr")
+	traceCmd.Flags().String("format", "", "export every probe as csv or json")
+	traceCmd.Flags().String("output", "", "export file name (default <hostname>_trace_<YYYYMMDDHH>.<format>)")
+}
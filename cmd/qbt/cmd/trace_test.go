@@ -0,0 +1,146 @@
+package cmd
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/qbtrade/qbt/cmd/qbt/cf"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeHopProber 模拟一条路径，hops[ttl-1]为空表示该跳不回应，最后一跳是目标
+type fakeHopProber struct {
+	hops []string
+}
+
+func (p *fakeHopProber) probe(ttl int) traceProbe {
+	result := traceProbe{TTL: ttl, Ts: time.Now(), Loss: true}
+	if ttl > len(p.hops) {
+		ttl = len(p.hops)
+	}
+	if hop := p.hops[ttl-1]; hop != "" {
+		result.fill(icmpHit{from: net.ParseIP(hop), at: result.Ts.Add(time.Duration(ttl) * time.Millisecond),
+			reached: ttl == len(p.hops)})
+	}
+	return result
+}
+
+// originalHeader 构造ICMP差错报文中引用的原始IP头和前8个字节
+func originalHeader(ihl int, protocol byte, dst string, first8 []byte) []byte {
+	data := make([]byte, ihl+8)
+	data[0] = 0x40 | byte(ihl/4)
+	data[9] = protocol
+	copy(data[16:20], net.ParseIP(dst).To4())
+	copy(data[ihl:], first8)
+	return data
+}
+
+func TestMatchOriginal(t *testing.T) {
+	icmpEcho := func(id, seq uint16) []byte {
+		b := make([]byte, 8)
+		binary.BigEndian.PutUint16(b[4:6], id)
+		binary.BigEndian.PutUint16(b[6:8], seq)
+		return b
+	}
+	tcpSyn := func(src, dst uint16) []byte {
+		b := make([]byte, 8)
+		binary.BigEndian.PutUint16(b[0:2], src)
+		binary.BigEndian.PutUint16(b[2:4], dst)
+		return b
+	}
+	dst := net.ParseIP("192.0.2.9").To4()
+	icmpTracer := &tracer{mode: "icmp", dst: dst, id: 77}
+	tcpTracer := &tracer{mode: "tcp", dst: dst, port: 22}
+	tests := []struct {
+		name string
+		t    *tracer
+		data []byte
+		key  int
+		ok   bool
+	}{
+		{"icmp", icmpTracer, originalHeader(20, protocolICMP, "192.0.2.9", icmpEcho(77, 5)), 5, true},
+		{"icmp with ip options", icmpTracer, originalHeader(24, protocolICMP, "192.0.2.9", icmpEcho(77, 6)), 6, true},
+		{"icmp other id", icmpTracer, originalHeader(20, protocolICMP, "192.0.2.9", icmpEcho(78, 5)), 0, false},
+		{"icmp other dst", icmpTracer, originalHeader(20, protocolICMP, "192.0.2.10", icmpEcho(77, 5)), 0, false},
+		{"icmp tracer tcp packet", icmpTracer, originalHeader(20, protocolTCP, "192.0.2.9", tcpSyn(40000, 22)), 0, false},
+		{"tcp", tcpTracer, originalHeader(20, protocolTCP, "192.0.2.9", tcpSyn(40000, 22)), 40000, true},
+		{"tcp other port", tcpTracer, originalHeader(20, protocolTCP, "192.0.2.9", tcpSyn(40000, 80)), 0, false},
+		{"short", tcpTracer, originalHeader(20, protocolTCP, "192.0.2.9", nil)[:24], 0, false},
+		{"empty", tcpTracer, nil, 0, false},
+	}
+	for _, tt := range tests {
+		key, ok := tt.t.matchOriginal(tt.data)
+		assert.Equal(t, tt.ok, ok, tt.name)
+		assert.Equal(t, tt.key, key, tt.name)
+	}
+}
+
+func TestTraceRound(t *testing.T) {
+	p := &fakeHopProber{hops: []string{"10.0.0.1", "", "10.0.1.1", "192.0.2.9"}}
+	probes := traceRound(p, 3, 30, "192.0.2.9:22", "tcp")
+	//到达目标后不再返回更远的跳
+	assert.Len(t, probes, 4)
+	for i, probe := range probes {
+		assert.Equal(t, i+1, probe.TTL)
+		assert.Equal(t, 3, probe.Round)
+		assert.Equal(t, "tcp", probe.Mode)
+		assert.Equal(t, "192.0.2.9:22", probe.Target)
+	}
+	assert.True(t, probes[1].Loss)
+	assert.Equal(t, "10.0.1.1", probes[2].Hop)
+	assert.InDelta(t, 3, probes[2].RTT, 0.001)
+	assert.True(t, probes[3].Reached)
+
+	//目标不回应时返回全部跳数
+	p = &fakeHopProber{hops: []string{"10.0.0.1", ""}}
+	assert.Len(t, traceRound(p, 1, 5, "192.0.2.9:22", "icmp"), 5)
+}
+
+func TestTraceHopStat(t *testing.T) {
+	tests := []struct {
+		name  string
+		rtts  []float64 // 负数表示丢包
+		loss  string
+		last  float64
+		best  float64
+		worst float64
+		p50   float64
+	}{
+		{"all lost", []float64{-1, -1}, "100.0%", 0, 0, 0, 0},
+		{"one sample", []float64{2}, "0.0%", 2, 2, 2, 2},
+		{"mixed", []float64{5, -1, 1, 3, -1}, "40.0%", 3, 1, 5, 3},
+	}
+	for _, tt := range tests {
+		h := &traceHopStat{ttl: 2}
+		for _, rtt := range tt.rtts {
+			if rtt < 0 {
+				h.add(traceProbe{TTL: 2, Loss: true})
+			} else {
+				h.add(traceProbe{TTL: 2, Hop: "10.0.0.1", RTT: rtt})
+			}
+		}
+		assert.Equal(t, len(tt.rtts), h.sent, tt.name)
+		assert.Equal(t, tt.last, h.last, tt.name)
+		assert.Equal(t, tt.best, h.best, tt.name)
+		assert.Equal(t, tt.worst, h.worst, tt.name)
+		row := h.row()
+		assert.Contains(t, row, tt.loss, tt.name)
+		if h.recv == 0 {
+			assert.Contains(t, row, "???", tt.name)
+			continue
+		}
+		assert.Contains(t, row, "10.0.0.1", tt.name)
+		assert.Equal(t, tt.p50, cf.Percentile(h.samples, 50), tt.name)
+	}
+
+	//只保留最近traceHopSamples个样本
+	h := &traceHopStat{ttl: 1}
+	for i := 0; i < traceHopSamples+10; i++ {
+		h.add(traceProbe{TTL: 1, Hop: "10.0.0.1", RTT: float64(i)})
+	}
+	assert.Len(t, h.samples, traceHopSamples)
+	assert.Equal(t, 10.0, h.samples[0])
+	assert.Equal(t, 0.0, h.best)
+}
@@ -0,0 +1,33 @@
+//go:build !windows
+
+package cmd
+
+import (
+	"syscall"
+)
+
+// ttlControl 返回net.Dialer.Control：设置IP_TTL并提前绑定本地端口，把分配到的端口告诉onBind
+func ttlControl(ttl int, onBind func(port int)) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var opErr error
+		err := c.Control(func(fd uintptr) {
+			if opErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TTL, ttl); opErr != nil {
+				return
+			}
+			if opErr = syscall.Bind(int(fd), &syscall.SockaddrInet4{}); opErr != nil {
+				return
+			}
+			var sa syscall.Sockaddr
+			if sa, opErr = syscall.Getsockname(int(fd)); opErr != nil {
+				return
+			}
+			if inet4, ok := sa.(*syscall.SockaddrInet4); ok {
+				onBind(inet4.Port)
+			}
+		})
+		if err != nil {
+			return err
+		}
+		return opErr
+	}
+}
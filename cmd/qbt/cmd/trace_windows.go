@@ -0,0 +1,15 @@
+//go:build windows
+
+package cmd
+
+import (
+	"errors"
+	"syscall"
+)
+
+// ttlControl windows上暂不支持TCP模式的traceroute
+func ttlControl(ttl int, onBind func(port int)) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		return errors.New("tcp trace is not supported on windows, use --mode icmp")
+	}
+}
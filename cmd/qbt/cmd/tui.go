@@ -0,0 +1,352 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/qbtrade/qbt/cmd/qbt/cf"
+	"github.com/spf13/cobra"
+	"golang.org/x/term"
+)
+
+// tuiRecent 每个target保留最近的样本数，用于p99、丢包率和走势图
+const tuiRecent = 100
+
+// tuiEvents 表格下方显示的最近事件数
+const tuiEvents = 5
+
+var sparkBlocks = []rune("▁▂▃▄▅▆▇█")
+
+// tuiTarget 一个target的实时统计
+type tuiTarget struct {
+	target string
+	last   float64
+	lost   bool
+	count  int
+	loss   int
+	cost   cf.Welford
+	recent []float64 // 丢包记为NaN
+}
+
+func (t *tuiTarget) add(rtt float64, loss bool) {
+	t.count++
+	t.lost = loss
+	if loss {
+		t.loss++
+		rtt = math.NaN()
+	} else {
+		t.last = rtt
+		t.cost.Add(rtt)
+	}
+	if len(t.recent) >= tuiRecent {
+		t.recent = t.recent[1:]
+	}
+	t.recent = append(t.recent, rtt)
+}
+
+// p99 最近样本中成功的rtt的p99
+func (t *tuiTarget) p99() float64 {
+	ok := make([]float64, 0, len(t.recent))
+	for _, v := range t.recent {
+		if !math.IsNaN(v) {
+			ok = append(ok, v)
+		}
+	}
+	return cf.Percentile(ok, 99)
+}
+
+// lossPct 最近样本的丢包率
+func (t *tuiTarget) lossPct() float64 {
+	if len(t.recent) == 0 {
+		return 0
+	}
+	lost := 0
+	for _, v := range t.recent {
+		if math.IsNaN(v) {
+			lost++
+		}
+	}
+	return 100 * float64(lost) / float64(len(t.recent))
+}
+
+// sparkline 最近width个样本的走势，按这段时间的最小最大值缩放，丢包显示为×
+func sparkline(values []float64, width int) string {
+	if len(values) > width {
+		values = values[len(values)-width:]
+	}
+	lo, hi := math.Inf(1), math.Inf(-1)
+	for _, v := range values {
+		if !math.IsNaN(v) {
+			lo, hi = math.Min(lo, v), math.Max(hi, v)
+		}
+	}
+	var b strings.Builder
+	for _, v := range values {
+		switch {
+		case math.IsNaN(v):
+			b.WriteRune('×')
+		case hi == lo:
+			b.WriteRune(sparkBlocks[0])
+		default:
+			b.WriteRune(sparkBlocks[int((v-lo)/(hi-lo)*float64(len(sparkBlocks)-1)+0.5)])
+		}
+	}
+	return b.String()
+}
+
+// tuiColumns 可以排序的列，按键为列名的首字母
+var tuiColumns = []struct {
+	key  byte
+	name string
+	less func(a, b *tuiTarget) bool
+}{
+	{'t', "target", func(a, b *tuiTarget) bool { return a.target < b.target }},
+	{'l', "last", func(a, b *tuiTarget) bool { return a.last < b.last }},
+	{'m', "mean", func(a, b *tuiTarget) bool { return a.cost.Mean() < b.cost.Mean() }},
+	{'p', "p99", func(a, b *tuiTarget) bool { return a.p99() < b.p99() }},
+	{'o', "loss%", func(a, b *tuiTarget) bool { return a.lossPct() < b.lossPct() }},
+	{'c', "count", func(a, b *tuiTarget) bool { return a.count < b.count }},
+}
+
+// liveTable --tui 的实时表格，定时整屏重绘
+type liveTable struct {
+	title     string
+	alertMs   float64 // p99超过时高亮，0不检查
+	alertLoss float64 // 最近的丢包率超过时高亮
+	width     int     // 走势图的宽度
+
+	mu      sync.Mutex
+	targets map[string]*tuiTarget
+	events  []string
+	sortCol int
+	desc    bool
+}
+
+// liveTUI 开启 --tui 时的实时表格，为nil时按原来的方式输出
+var liveTUI *liveTable
+
+// probeQuit 在 --tui 中按q或Ctrl+C时关闭，探测循环结束后命令经过defer正常退出，缓存的数据不会丢失
+var probeQuit = make(chan struct{})
+
+// sleepOrQuit 等待d，收到退出信号时提前返回false
+func sleepOrQuit(d time.Duration) bool {
+	if d < 0 {
+		d = 0
+	}
+	select {
+	case <-probeQuit:
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
+
+func newLiveTable(title string, alertMs, alertLoss float64) *liveTable {
+	return &liveTable{title: title, alertMs: alertMs, alertLoss: alertLoss, width: 40, targets: map[string]*tuiTarget{}}
+}
+
+func (l *liveTable) add(target string, rtt float64, loss bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	t, ok := l.targets[target]
+	if !ok {
+		t = &tuiTarget{target: target}
+		l.targets[target] = t
+	}
+	t.add(rtt, loss)
+}
+
+// event 记录一条事件(基线变化、slo告警等)，显示在表格下方
+func (l *liveTable) event(line string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.events) >= tuiEvents {
+		l.events = l.events[1:]
+	}
+	l.events = append(l.events, strings.TrimSpace(line))
+}
+
+// sortBy 按键排序，同一列再按一次反向
+func (l *liveTable) sortBy(key byte) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i, c := range tuiColumns {
+		if c.key == key {
+			if l.sortCol == i {
+				l.desc = !l.desc
+			} else {
+				l.sortCol, l.desc = i, false
+			}
+		}
+	}
+}
+
+func (l *liveTable) breaching(t *tuiTarget) bool {
+	return (l.alertMs > 0 && t.p99() > l.alertMs) || (l.alertLoss > 0 && t.lossPct() > l.alertLoss) || t.lost
+}
+
+// render 输出一帧，行尾用\r\n兼容终端的raw模式
+func (l *liveTable) render(w io.Writer, now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	list := make([]*tuiTarget, 0, len(l.targets))
+	for _, t := range l.targets {
+		list = append(list, t)
+	}
+	less := tuiColumns[l.sortCol].less
+	sort.SliceStable(list, func(i, j int) bool {
+		if l.desc {
+			return less(list[j], list[i])
+		}
+		return less(list[i], list[j])
+	})
+
+	_, _ = fmt.Fprintf(w, "%s  %s  %d targets\r\n", l.title, now.Format("2006-01-02 15:04:05"), len(list))
+	header := make([]string, 0, len(tuiColumns)+1)
+	for i, c := range tuiColumns {
+		name := c.name
+		if i == l.sortCol {
+			name += map[bool]string{false: "▲", true: "▼"}[l.desc]
+		}
+		header = append(header, name)
+	}
+	_, _ = fmt.Fprintf(w, "\x1b[1m%-24s %9s %9s %9s %7s %8s  %s\x1b[0m\r\n", header[0], header[1], header[2], header[3],
+		header[4], header[5], "recent rtt")
+	for _, t := range list {
+		last := fmt.Sprintf("%.3f", t.last)
+		if t.lost {
+			last = "lost"
+		}
+		row := fmt.Sprintf("%-24s %9s %9.3f %9.3f %7.2f %8d  %s", t.target, last, t.cost.Mean(), t.p99(),
+			t.lossPct(), t.count, sparkline(t.recent, l.width))
+		if l.breaching(t) {
+			row = "\x1b[31m" + row + "\x1b[0m"
+		}
+		_, _ = fmt.Fprint(w, row+"\r\n")
+	}
+	_, _ = fmt.Fprint(w, "\r\n")
+	for _, e := range l.events {
+		_, _ = fmt.Fprint(w, e+"\r\n")
+	}
+	_, _ = fmt.Fprint(w, "\x1b[2msort: t)arget l)ast m)ean p)99 l(o)ss c)ount, again to reverse, q to quit\x1b[0m\r\n")
+}
+
+// run 使用备用屏幕定时重绘，读取按键排序，q或Ctrl+C时恢复终端并关闭probeQuit，返回恢复终端的函数。
+// 退出后再按一次Ctrl+C直接结束进程
+func (l *liveTable) run(interval time.Duration) (stop func()) {
+	fd := int(os.Stdin.Fd())
+	state, errRaw := term.MakeRaw(fd)
+	fmt.Print("\x1b[?1049h\x1b[?25l")
+	done := make(chan struct{})
+	//重绘和恢复终端互斥，stop之后不会再有一帧覆盖最后的输出
+	var drawMu sync.Mutex
+	var once sync.Once
+	stop = func() {
+		once.Do(func() {
+			drawMu.Lock()
+			defer drawMu.Unlock()
+			close(done)
+			fmt.Print("\x1b[?25h\x1b[?1049l")
+			if errRaw == nil {
+				_ = term.Restore(fd, state)
+			}
+		})
+	}
+	signals := make(chan os.Signal, 1)
+	var quitOnce sync.Once
+	quit := func() {
+		quitOnce.Do(func() {
+			signal.Stop(signals)
+			close(probeQuit)
+		})
+		stop()
+	}
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case <-signals:
+			quit()
+		case <-done:
+			signal.Stop(signals)
+		}
+	}()
+	if errRaw == nil {
+		go func() {
+			buf := make([]byte, 16)
+			for {
+				n, err := os.Stdin.Read(buf)
+				if err != nil {
+					return
+				}
+				for _, key := range buf[:n] {
+					if key == 'q' || key == 3 {
+						quit()
+						return
+					}
+					l.sortBy(key)
+				}
+			}
+		}()
+	}
+	go func() {
+		for {
+			var b strings.Builder
+			b.WriteString("\x1b[H\x1b[2J")
+			l.render(&b, time.Now())
+			drawMu.Lock()
+			select {
+			case <-done:
+				drawMu.Unlock()
+				return
+			default:
+			}
+			fmt.Print(b.String())
+			drawMu.Unlock()
+			select {
+			case <-done:
+				return
+			case <-time.After(interval):
+			}
+		}
+	}()
+	return stop
+}
+
+// printEvent 开启 --tui 时事件显示在表格下方，否则直接输出
+func printEvent(line string) {
+	if liveTUI != nil {
+		liveTUI.event(line)
+		return
+	}
+	fmt.Println(line)
+}
+
+// addTUIFlags 实时表格相关的参数
+func addTUIFlags(cmd *cobra.Command) {
+	cmd.Flags().Bool("tui", false, "show a live table of all addresses instead of the plain output (falls back when stdout is not a terminal)")
+	cmd.Flags().Float64("tui-alert-ms", 0, "highlight addresses whose recent p99 rtt exceeds this, 0 disables")
+	cmd.Flags().Float64("tui-alert-loss", 1, "highlight addresses whose recent loss exceeds this percent, 0 disables")
+}
+
+// setupTUI 开启 --tui 且stdout是终端时设置liveTUI，返回恢复终端的函数
+func setupTUI(cmd *cobra.Command) (stop func()) {
+	if enabled, _ := cmd.Flags().GetBool("tui"); !enabled {
+		return func() {}
+	}
+	if !term.IsTerminal(int(os.Stdout.Fd())) {
+		fmt.Println("stdout is not a terminal, --tui disabled")
+		return func() {}
+	}
+	alertMs, _ := cmd.Flags().GetFloat64("tui-alert-ms")
+	alertLoss, _ := cmd.Flags().GetFloat64("tui-alert-loss")
+	liveTUI = newLiveTable("qbt "+cmd.Name(), alertMs, alertLoss)
+	return liveTUI.run(500 * time.Millisecond)
+}
@@ -0,0 +1,83 @@
+package cmd
+
+import (
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSparkline(t *testing.T) {
+	assert.Equal(t, "▁▅█×▁", sparkline([]float64{1, 1.5, 2, math.NaN(), 1}, 10))
+	assert.Equal(t, "█▁", sparkline([]float64{5, 2, 9, 1}, 2))
+	assert.Equal(t, "▁▁", sparkline([]float64{3, 3}, 10))
+}
+
+func TestLiveTable(t *testing.T) {
+	table := newLiveTable("qbt tcp-ping", 5, 1)
+	for i := 0; i < 10; i++ {
+		table.add("10.0.0.1:22", 1, false)
+		table.add("10.0.0.2:22", 8, false)
+		table.add("10.0.0.3:22", 2, i == 0)
+	}
+	table.event("\n[change] something")
+
+	render := func() []string {
+		var b strings.Builder
+		table.render(&b, time.Date(2026, 10, 19, 10, 0, 0, 0, time.Local))
+		return strings.Split(b.String(), "\r\n")
+	}
+	lines := render()
+	assert.Equal(t, "qbt tcp-ping  2026-10-19 10:00:00  3 targets", lines[0])
+	assert.Contains(t, lines[1], "target▲")
+	assert.True(t, strings.HasPrefix(lines[2], "10.0.0.1:22"))
+	//p99超过5ms和丢包率超过1%的高亮
+	assert.True(t, strings.HasPrefix(lines[3], "\x1b[31m10.0.0.2:22"))
+	assert.True(t, strings.HasPrefix(lines[4], "\x1b[31m10.0.0.3:22"))
+	assert.Contains(t, lines[4], "10.00")
+	assert.Contains(t, lines[4], "×▁▁")
+	assert.Equal(t, "[change] something", lines[6])
+
+	table.sortBy('m')
+	table.sortBy('m')
+	lines = render()
+	assert.Contains(t, lines[1], "mean▼")
+	assert.Contains(t, lines[2], "10.0.0.2:22")
+	assert.Contains(t, lines[4], "10.0.0.1:22")
+}
+
+func TestProbeQuit(t *testing.T) {
+	old := probeQuit
+	probeQuit = make(chan struct{})
+	defer func() { probeQuit = old }()
+	assert.True(t, sleepOrQuit(time.Millisecond))
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer ln.Close()
+	dir := t.TempDir()
+	writer, err := newCsvRotator("host_tcp_ping", tcpPingCsvHeader, csvRotateOptions{dir: dir, every: "none"})
+	assert.Nil(t, err)
+	summaryWriter, err := newCsvRotator("host_tcp_ping_summary", tcpPingSummaryCsvHeader,
+		csvRotateOptions{dir: dir, every: "none"})
+	assert.Nil(t, err)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go CheckTcpPing(ln.Addr().String(), "host", 0.01, 1, 1<<30, true, 10, writer, summaryWriter, &wg)
+	time.Sleep(100 * time.Millisecond)
+	//按q之后探测循环结束，剩余的行在返回前写入文件
+	close(probeQuit)
+	wg.Wait()
+	assert.False(t, sleepOrQuit(time.Hour))
+	content, err := os.ReadFile(filepath.Join(dir, "host_tcp_ping.csv"))
+	assert.Nil(t, err)
+	assert.True(t, strings.Count(string(content), "\n") > 2)
+	assert.Nil(t, writer.Close())
+	assert.Nil(t, summaryWriter.Close())
+}